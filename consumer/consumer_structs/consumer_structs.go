@@ -1,8 +1,110 @@
 package consumer_structs
 
+import (
+	"shared/envelope"
+	"shared/labels"
+	"shared/logging"
+	"shared/tracing"
+)
+
 type ConsumerConfig struct {
-	AppName       string `json:"app_name"`
-	BadgerTempDir string `json:"badger_temp_dir"`
+	AppName        string           `json:"app_name"`
+	BadgerTempDir  string           `json:"badger_temp_dir"`
+	KafkaVersion   string           `json:"kafka_version"`
+	IsolationLevel string           `json:"isolation_level"`
+	Dedup          DedupConfig      `json:"dedup"`
+	Encoding       EncodingConfig   `json:"encoding"`
+	Validation     ValidationConfig `json:"validation"`
+	Topics         []TopicConfig    `json:"topics"`
+	Admin          AdminConfig      `json:"admin"`
+	Lag            LagConfig        `json:"lag"`
+	Metrics        MetricsConfig    `json:"metrics"`
+	Tracing        tracing.Config   `json:"tracing"`
+	Logging        logging.Config   `json:"logging"`
+	Health         HealthConfig     `json:"health"`
+}
+
+// HealthConfig runs the health checks every Interval milliseconds, failing those that take longer
+// than Timeout. The consumer isn't ready while its group lags more than MaxLag messages, 0 disables
+// the lag check, which also needs lag to be enabled.
+type HealthConfig struct {
+	Interval int64 `json:"interval"`
+	Timeout  int64 `json:"timeout"`
+	MaxLag   int64 `json:"max_lag"`
+}
+
+// MetricsConfig overrides the buckets of latency histograms by name, in seconds: event_time,
+// kafka, decode, store_write, process and id_api. LegacySummaries also exports the summaries
+// the histograms replaced. IdLabels bounds the values of id labels.
+type MetricsConfig struct {
+	LatencyBuckets  map[string][]float64 `json:"latency_buckets"`
+	LegacySummaries bool                 `json:"legacy_summaries"`
+	IdLabels        labels.Config        `json:"id_labels"`
+	IdValues        IdValuesConfig       `json:"id_values"`
+}
+
+// IdValuesConfig exports the aggregates of at most MaxIds ids, read from badger every Interval
+// milliseconds.
+type IdValuesConfig struct {
+	Enabled  bool  `json:"enabled"`
+	Interval int64 `json:"interval"`
+	MaxIds   int   `json:"max_ids"`
+}
+
+// LagConfig exports the lag of Groups, or of every consumer group when empty, every Interval
+// milliseconds. Time lag is estimated from the last Samples high watermarks of each partition.
+type LagConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Interval int64    `json:"interval"`
+	Groups   []string `json:"groups"`
+	Samples  int      `json:"samples"`
+}
+
+// AdminConfig protects the admin api, which is disabled while Token is empty.
+type AdminConfig struct {
+	Token string `json:"token"`
+}
+
+// TopicConfig routes a topic, by exact Topic name or by Pattern, to a handler with its own
+// encoding and validation. Values are aggregated under "<Namespace>/<id>" in badger, or under the
+// bare id for an empty Namespace.
+type TopicConfig struct {
+	Name       string           `json:"name"`
+	Topic      string           `json:"topic"`
+	Pattern    string           `json:"pattern"`
+	Namespace  string           `json:"namespace"`
+	Encoding   EncodingConfig   `json:"encoding"`
+	Validation ValidationConfig `json:"validation"`
+}
+
+// EncodingConfig sets the encoding of messages without an encoding header. Avro schemas are
+// looked up in the registry at SchemaRegistryUrl, or in memory when that is empty.
+type EncodingConfig struct {
+	Type              string `json:"type"`
+	SchemaRegistryUrl string `json:"schema_registry_url"`
+	Subject           string `json:"subject"`
+}
+
+// DedupConfig drops redelivered messages seen within the last Ttl milliseconds. Key is event_id,
+// falling back to the hash for messages without one, or hash to dedupe on the kafka key, value
+// and timestamp. The bloom filter in front of badger is sized by BloomCapacity keys.
+type DedupConfig struct {
+	Enabled                bool    `json:"enabled"`
+	Key                    string  `json:"key"`
+	Ttl                    int64   `json:"ttl"`
+	BloomCapacity          int     `json:"bloom_capacity"`
+	BloomFalsePositiveRate float64 `json:"bloom_false_positive_rate"`
+}
+
+// ValidationConfig holds the rules consumed messages must pass before they are stored. Empty
+// rules are skipped, ValueMin and ValueMax are pointers so that zero can be a bound.
+type ValidationConfig struct {
+	RequiredFields  []string `json:"required_fields"`
+	IdPattern       string   `json:"id_pattern"`
+	ValueMin        *float64 `json:"value_min"`
+	ValueMax        *float64 `json:"value_max"`
+	Finite          bool     `json:"finite"`
+	MaxPayloadBytes int      `json:"max_payload_bytes"`
 }
 
 type Response struct {
@@ -11,7 +113,5 @@ type Response struct {
 	Data    interface{} `json:"data"`
 }
 
-type Message struct {
-	Id    string  `json:"id"`
-	Value float64 `json:"value"`
-}
+// Message is the payload shared with the producer, consumed either bare or wrapped in an envelope.
+type Message = envelope.Message
@@ -0,0 +1,319 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"shared/logging"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	PartitionPausedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "consumer",
+		Name:      "partition_paused",
+		Help:      "Whether consumption of a claimed partition is paused, 1 when paused",
+	}, []string{"topic", "partition"})
+	LastSeekOffsetGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "consumer",
+		Name:      "last_seek_offset",
+		Help:      "Offset the partition was last moved to through the admin api",
+	}, []string{"topic", "partition"})
+	LastSeekTimestampGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "consumer",
+		Name:      "last_seek_timestamp_seconds",
+		Help:      "Unix time the last seek was applied",
+	})
+)
+
+var ErrNoSession = errors.New("the consumer has no active group session")
+
+// Partitions maps topics to partitions, an empty map selects every claimed partition.
+type Partitions map[string][]int32
+
+// Seek moves partitions of Topic to Offset, or to the first offset at or after Timestamp in unix
+// milliseconds. Offset accepts sarama.OffsetOldest and sarama.OffsetNewest.
+type Seek struct {
+	Topic      string  `json:"topic"`
+	Partitions []int32 `json:"partitions"`
+	Offset     *int64  `json:"offset"`
+	Timestamp  *int64  `json:"timestamp"`
+}
+
+// SeekResult is the offset a partition is moved to.
+type SeekResult struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Status reports the pause state and the last applied seek.
+type Status struct {
+	PausedAll bool         `json:"paused_all"`
+	Paused    Partitions   `json:"paused"`
+	Claimed   Partitions   `json:"claimed"`
+	LastSeek  []SeekResult `json:"last_seek"`
+	SeekedAt  *time.Time   `json:"seeked_at,omitempty"`
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// Controller pauses, resumes and seeks the partitions this member of the consumer group claims.
+// Pauses outlive rebalances, they are applied again when a partition is claimed. A seek ends the
+// session, the new offsets are committed in Cleanup before the group is joined again.
+type Controller struct {
+	group  sarama.ConsumerGroup
+	client sarama.Client
+
+	mu        sync.Mutex
+	session   sarama.ConsumerGroupSession
+	restart   chan struct{}
+	pausedAll bool
+	paused    map[topicPartition]bool
+	pending   []SeekResult
+	lastSeek  []SeekResult
+	seekedAt  time.Time
+}
+
+func NewController(group sarama.ConsumerGroup, client sarama.Client) *Controller {
+	return &Controller{
+		group:   group,
+		client:  client,
+		restart: make(chan struct{}),
+		paused:  make(map[topicPartition]bool),
+	}
+}
+
+// Setup tracks a new group session, to be called from the handler's Setup.
+func (c *Controller) Setup(session sarama.ConsumerGroupSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session = session
+	c.restart = make(chan struct{})
+}
+
+// Cleanup applies pending seeks before the session commits its offsets, to be called from the
+// handler's Cleanup. Claims have stopped by then, so no processed message can move them on again.
+func (c *Controller) Cleanup(session sarama.ConsumerGroupSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, seek := range c.pending {
+		// ResetOffset only moves back and MarkOffset only moves forward, one of them applies
+		session.ResetOffset(seek.Topic, seek.Partition, seek.Offset, "")
+		session.MarkOffset(seek.Topic, seek.Partition, seek.Offset, "")
+		LastSeekOffsetGauge.WithLabelValues(seek.Topic, strconv.Itoa(int(seek.Partition))).Set(float64(seek.Offset))
+		logging.Info("Seeked partition", logging.String("topic", seek.Topic), logging.Int32("partition", seek.Partition), logging.Int64("offset", seek.Offset))
+	}
+	if len(c.pending) > 0 {
+		c.lastSeek, c.seekedAt = c.pending, time.Now()
+		LastSeekTimestampGauge.Set(float64(c.seekedAt.Unix()))
+		c.pending = nil
+	}
+	c.session = nil
+}
+
+// Claimed pauses a newly claimed partition if it was paused before, to be called at the start
+// of ConsumeClaim. The returned channel is closed when the claim should stop for a seek.
+func (c *Controller) Claimed(topic string, partition int32) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tp := topicPartition{topic, partition}
+	if c.pausedAll || c.paused[tp] {
+		c.group.Pause(map[string][]int32{topic: {partition}})
+		PartitionPausedGauge.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(1)
+	} else {
+		PartitionPausedGauge.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(0)
+	}
+	return c.restart
+}
+
+// Pause stops fetching the given partitions, or every partition when none are given.
+func (c *Controller) Pause(partitions Partitions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(partitions) == 0 {
+		c.pausedAll = true
+		c.group.PauseAll()
+	} else {
+		for _, tp := range flatten(partitions) {
+			c.paused[tp] = true
+		}
+		c.group.Pause(partitions)
+	}
+	c.updateGauges()
+}
+
+// Resume restarts fetching the given partitions, or every partition when none are given.
+func (c *Controller) Resume(partitions Partitions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(partitions) == 0 {
+		c.pausedAll = false
+		c.paused = make(map[topicPartition]bool)
+		c.group.ResumeAll()
+	} else {
+		if c.pausedAll {
+			// Keep the other claimed partitions paused
+			c.pausedAll = false
+			for _, tp := range flatten(c.claimed()) {
+				c.paused[tp] = true
+			}
+		}
+		for _, tp := range flatten(partitions) {
+			delete(c.paused, tp)
+		}
+		c.group.Resume(partitions)
+	}
+	c.updateGauges()
+}
+
+// Seek resolves the target offsets of the claimed partitions of seek.Topic and ends the session
+// so that they are applied. Partitions claimed by other group members can't be moved from here.
+func (c *Controller) Seek(seek Seek) ([]SeekResult, error) {
+	if seek.Topic == "" {
+		return nil, errors.New("field 'topic' is required")
+	}
+	if (seek.Offset == nil) == (seek.Timestamp == nil) {
+		return nil, errors.New("exactly one of the fields 'offset' and 'timestamp' is required")
+	}
+	if seek.Offset != nil && *seek.Offset < 0 && *seek.Offset != sarama.OffsetOldest && *seek.Offset != sarama.OffsetNewest {
+		return nil, errors.New("field 'offset' must be a non negative offset, -1 for newest or -2 for oldest")
+	}
+	if seek.Timestamp != nil && *seek.Timestamp < 0 {
+		return nil, errors.New("field 'timestamp' must be a non negative unix time in milliseconds")
+	}
+
+	c.mu.Lock()
+	active := c.session != nil
+	claimed := c.claimed()[seek.Topic]
+	c.mu.Unlock()
+	if !active {
+		return nil, ErrNoSession
+	}
+
+	partitions := seek.Partitions
+	if len(partitions) == 0 {
+		partitions = claimed
+	}
+	var results []SeekResult
+	for _, partition := range partitions {
+		if !contains(claimed, partition) {
+			return nil, fmt.Errorf("partition %d of topic %q isn't claimed by this consumer", partition, seek.Topic)
+		}
+		offset, err := c.resolve(seek, partition)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, SeekResult{Topic: seek.Topic, Partition: partition, Offset: offset})
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no partitions of topic %q are claimed by this consumer", seek.Topic)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, results...)
+	select {
+	case <-c.restart:
+	default:
+		close(c.restart)
+	}
+	return results, nil
+}
+
+// Active reports whether the consumer currently holds a group session.
+func (c *Controller) Active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session != nil
+}
+
+// Status returns the pause state of the claimed partitions and the last seek.
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := Status{PausedAll: c.pausedAll, Paused: make(Partitions), Claimed: c.claimed(), LastSeek: c.lastSeek}
+	for tp := range c.paused {
+		status.Paused[tp.topic] = append(status.Paused[tp.topic], tp.partition)
+	}
+	for topic := range status.Paused {
+		sortPartitions(status.Paused[topic])
+	}
+	if !c.seekedAt.IsZero() {
+		seekedAt := c.seekedAt
+		status.SeekedAt = &seekedAt
+	}
+	return status
+}
+
+// resolve turns a seek into an absolute offset of partition.
+func (c *Controller) resolve(seek Seek, partition int32) (int64, error) {
+	if seek.Offset != nil && *seek.Offset >= 0 {
+		return *seek.Offset, nil
+	}
+	// GetOffset takes either a timestamp or sarama.OffsetOldest/OffsetNewest
+	var at int64
+	if seek.Offset != nil {
+		at = *seek.Offset
+	} else {
+		at = *seek.Timestamp
+	}
+	offset, err := c.client.GetOffset(seek.Topic, partition, at)
+	if err != nil {
+		return 0, fmt.Errorf("resolving offset of partition %d of topic %q: %w", partition, seek.Topic, err)
+	}
+	// No message at or after the timestamp, continue from the end
+	if offset == sarama.OffsetNewest {
+		return c.client.GetOffset(seek.Topic, partition, sarama.OffsetNewest)
+	}
+	return offset, nil
+}
+
+// claimed returns the partitions of the current session, callers hold mu.
+func (c *Controller) claimed() Partitions {
+	if c.session == nil {
+		return Partitions{}
+	}
+	return c.session.Claims()
+}
+
+// updateGauges reports the pause state of every claimed partition, callers hold mu.
+func (c *Controller) updateGauges() {
+	for _, tp := range flatten(c.claimed()) {
+		value := 0.0
+		if c.pausedAll || c.paused[tp] {
+			value = 1
+		}
+		PartitionPausedGauge.WithLabelValues(tp.topic, strconv.Itoa(int(tp.partition))).Set(value)
+	}
+}
+
+func flatten(partitions Partitions) []topicPartition {
+	var tps []topicPartition
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			tps = append(tps, topicPartition{topic, p})
+		}
+	}
+	return tps
+}
+
+func contains(partitions []int32, partition int32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+func sortPartitions(partitions []int32) {
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"consumer/control"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"shared/admin"
+	"shared/logging"
+)
+
+const (
+	// maxAdminRequestBytes limits admin request bodies
+	maxAdminRequestBytes = 1 << 16
+)
+
+// AdminChanges counts the runtime changes made through the admin api
+var AdminChanges = admin.NewChanges("consumer", "admin")
+
+// AdminHandler pauses, resumes and seeks consumption at runtime.
+type AdminHandler struct {
+	Token      string
+	Controller *control.Controller
+}
+
+// logLevel is the body of log level requests and responses.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// partitionsRequest selects partitions by topic, an empty body selects every claimed partition.
+type partitionsRequest struct {
+	Partitions control.Partitions `json:"partitions"`
+}
+
+func (h *AdminHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPost) {
+		return
+	}
+	var req partitionsRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	h.Controller.Pause(req.Partitions)
+	AdminChanges.Record("pause", describePartitions(req.Partitions))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Consumption paused.", h.Controller.Status())
+}
+
+func (h *AdminHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPost) {
+		return
+	}
+	var req partitionsRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	h.Controller.Resume(req.Partitions)
+	AdminChanges.Record("resume", describePartitions(req.Partitions))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Consumption resumed.", h.Controller.Status())
+}
+
+// Seek moves claimed partitions to an offset or timestamp. The group session restarts to apply
+// it, so the new position is reported by GetStatus once the consumer has rejoined.
+func (h *AdminHandler) Seek(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPost) {
+		return
+	}
+	var req control.Seek
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	results, err := h.Controller.Seek(req)
+	if errors.Is(err, control.ErrNoSession) {
+		admin.WriteResponse(w, http.StatusConflict, "Failure", err.Error(), nil)
+		return
+	}
+	if err != nil {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", err.Error(), nil)
+		return
+	}
+	AdminChanges.Record("seek", fmt.Sprintf("%v", results))
+	admin.WriteResponse(w, http.StatusAccepted, "Success", "Seek scheduled.", results)
+}
+
+func (h *AdminHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodGet) {
+		return
+	}
+	admin.WriteResponse(w, http.StatusOK, "Success", "Status fetched successfully.", h.Controller.Status())
+}
+
+// LogLevel reports the level of the consumer's logger on GET and changes it on PUT or POST.
+func (h *AdminHandler) LogLevel(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodGet, http.MethodPut, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		admin.WriteResponse(w, http.StatusOK, "Success", "Log level fetched successfully.", logLevel{logging.Default().Level().String()})
+		return
+	}
+	var req logLevel
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	level, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Field 'level' must be one of debug, info, warn or error", nil)
+		return
+	}
+	logging.Default().SetLevel(level)
+	AdminChanges.Record("log_level", fmt.Sprintf("level=%v", level))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Log level updated.", logLevel{level.String()})
+}
+
+// decodeAdminRequest reads an optional JSON body into req.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestBytes)).Decode(req)
+	if err != nil && err != io.EOF {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Invalid request body: "+err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+func describePartitions(partitions control.Partitions) string {
+	if len(partitions) == 0 {
+		return "all partitions"
+	}
+	return fmt.Sprintf("partitions=%v", partitions)
+}
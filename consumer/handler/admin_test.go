@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"consumer/control"
+	"encoding/json"
+	"github.com/Shopify/sarama"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"shared/logging"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret"
+
+// fakeGroup records the partitions paused through the consumer group. The embedded interface
+// panics on the methods the controller doesn't use.
+type fakeGroup struct {
+	sarama.ConsumerGroup
+	pausedAll bool
+	paused    map[string][]int32
+}
+
+func (g *fakeGroup) Pause(partitions map[string][]int32) {
+	for topic, ps := range partitions {
+		g.paused[topic] = append(g.paused[topic], ps...)
+	}
+}
+
+func (g *fakeGroup) Resume(partitions map[string][]int32) {
+	for topic := range partitions {
+		delete(g.paused, topic)
+	}
+}
+
+func (g *fakeGroup) PauseAll() {
+	g.pausedAll = true
+}
+
+func (g *fakeGroup) ResumeAll() {
+	g.pausedAll = false
+}
+
+// fakeClient resolves every timestamp to offset 100.
+type fakeClient struct {
+	sarama.Client
+}
+
+func (fakeClient) GetOffset(_ string, _ int32, at int64) (int64, error) {
+	if at == sarama.OffsetNewest {
+		return 500, nil
+	}
+	return 100, nil
+}
+
+// fakeSession claims partitions 0 and 1 of topic and records the offsets seeks reset it to.
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	reset map[int32]int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32 {
+	return map[string][]int32{"topic": {0, 1}}
+}
+
+func (s *fakeSession) ResetOffset(_ string, partition int32, offset int64, _ string) {
+	s.reset[partition] = offset
+}
+
+func (s *fakeSession) MarkOffset(string, int32, int64, string) {}
+
+func newTestAdminHandler() (*AdminHandler, *fakeGroup) {
+	group := &fakeGroup{paused: make(map[string][]int32)}
+	return &AdminHandler{Token: testToken, Controller: control.NewController(group, fakeClient{})}, group
+}
+
+// callAdmin calls handle with an authorized request and decodes the data of the response into data.
+func callAdmin(t *testing.T, handle http.HandlerFunc, method string, body string, data interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, "/admin", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	handle(w, r)
+
+	resp := struct {
+		Data interface{} `json:"data"`
+	}{Data: data}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response %q: %v", w.Body.String(), err)
+	}
+	return w.Code
+}
+
+func TestAdminRequiresBearerToken(t *testing.T) {
+	h, group := newTestAdminHandler()
+	for _, header := range []string{"", testToken, "Bearer wrong"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/admin/pause", nil)
+		r.Header.Set("Authorization", header)
+		h.Pause(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: code = %d, want %d", header, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if group.pausedAll {
+		t.Error("an unauthorized request paused consumption")
+	}
+}
+
+func TestAdminPauseAndResume(t *testing.T) {
+	h, group := newTestAdminHandler()
+	session := &fakeSession{reset: make(map[int32]int64)}
+	h.Controller.Setup(session)
+
+	var status control.Status
+	if code := callAdmin(t, h.Pause, http.MethodPost, `{"partitions": {"topic": [1]}}`, &status); code != http.StatusOK {
+		t.Fatalf("pause: code = %d", code)
+	}
+	if !reflect.DeepEqual(status.Paused, control.Partitions{"topic": {1}}) || !reflect.DeepEqual(group.paused["topic"], []int32{1}) {
+		t.Errorf("paused %v in the status and %v in the group, want partition 1", status.Paused, group.paused)
+	}
+
+	// Resuming one partition after pausing all keeps the other claimed partitions paused
+	callAdmin(t, h.Pause, http.MethodPost, "", &status)
+	if !status.PausedAll || !group.pausedAll {
+		t.Error("an empty pause request didn't pause every partition")
+	}
+	status = control.Status{}
+	callAdmin(t, h.Resume, http.MethodPost, `{"partitions": {"topic": [1]}}`, &status)
+	if status.PausedAll || !reflect.DeepEqual(status.Paused, control.Partitions{"topic": {0}}) {
+		t.Errorf("status after resuming partition 1 = %+v, want only partition 0 paused", status)
+	}
+
+	status = control.Status{}
+	callAdmin(t, h.Resume, http.MethodPost, "", &status)
+	if len(status.Paused) != 0 || group.pausedAll {
+		t.Errorf("status after resuming everything = %+v", status)
+	}
+}
+
+func TestAdminSeek(t *testing.T) {
+	h, _ := newTestAdminHandler()
+	if code := callAdmin(t, h.Seek, http.MethodPost, `{"topic": "topic", "offset": 5}`, nil); code != http.StatusConflict {
+		t.Errorf("seek without session: code = %d, want %d", code, http.StatusConflict)
+	}
+
+	session := &fakeSession{reset: make(map[int32]int64)}
+	h.Controller.Setup(session)
+	restart := h.Controller.Claimed("topic", 0)
+	for _, body := range []string{`{"topic": "topic"}`, `{"topic": "topic", "offset": 1, "timestamp": 1}`, `{"topic": "topic", "offset": -3}`, `{"topic": "topic", "partitions": [7], "offset": 1}`} {
+		if code := callAdmin(t, h.Seek, http.MethodPost, body, nil); code != http.StatusBadRequest {
+			t.Errorf("seek %s: code = %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+
+	var results []control.SeekResult
+	if code := callAdmin(t, h.Seek, http.MethodPost, `{"topic": "topic", "timestamp": 1700000000000}`, &results); code != http.StatusAccepted {
+		t.Fatalf("seek: code = %d, want %d", code, http.StatusAccepted)
+	}
+	want := []control.SeekResult{{Topic: "topic", Partition: 0, Offset: 100}, {Topic: "topic", Partition: 1, Offset: 100}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %+v, want %+v", results, want)
+	}
+	select {
+	case <-restart:
+	default:
+		t.Error("a seek didn't stop the claims of the session")
+	}
+
+	// The offsets are only applied when the session ends
+	h.Controller.Cleanup(session)
+	if !reflect.DeepEqual(session.reset, map[int32]int64{0: 100, 1: 100}) {
+		t.Errorf("reset offsets %v, want both partitions at 100", session.reset)
+	}
+	var status control.Status
+	callAdmin(t, h.GetStatus, http.MethodGet, "", &status)
+	if !reflect.DeepEqual(status.LastSeek, want) || status.SeekedAt == nil {
+		t.Errorf("status = %+v, want the last seek", status)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	h, _ := newTestAdminHandler()
+	defer logging.Default().SetLevel(logging.Default().Level())
+
+	var level logLevel
+	if code := callAdmin(t, h.LogLevel, http.MethodPut, `{"level": "loud"}`, &level); code != http.StatusBadRequest {
+		t.Errorf("unknown level: code = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := callAdmin(t, h.LogLevel, http.MethodPut, `{"level": "debug"}`, &level); code != http.StatusOK || level.Level != "debug" {
+		t.Errorf("code = %d, level = %q", code, level.Level)
+	}
+	level = logLevel{}
+	if callAdmin(t, h.LogLevel, http.MethodGet, "", &level); level.Level != "debug" {
+		t.Errorf("GET level = %q, want debug", level.Level)
+	}
+}
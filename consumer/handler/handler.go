@@ -5,30 +5,57 @@ import (
 	"consumer/store"
 	"encoding/json"
 	"github.com/prometheus/client_golang/prometheus"
-	"log"
 	"net/http"
+	"shared/labels"
+	"shared/logging"
+	"shared/tracing"
 	"time"
 )
 
 var (
-	storageSvc   *store.StorageService
+	storageSvc     *store.StorageService
+	tracer         = tracing.Tracer("consumer/handler")
+	IdApiHistogram = NewIdApiHistogram(prometheus.DefBuckets)
+	// IdApiSummary is only observed with LegacySummaries, for dashboards built on the old metric
 	IdApiSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace: "consumer",
 		Name:      "id_api_latency",
 		Help:      "Latency for /getValueForId api, initiating from consumer_service",
 	}, []string{"id"})
+	LegacySummaries bool
+	// IdLabels bounds the ids used as label values, they come straight from the query string
+	IdLabels *labels.Policy
 )
 
+// NewIdApiHistogram creates the api latency histogram with custom buckets, to replace
+// IdApiHistogram before it is registered.
+func NewIdApiHistogram(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "consumer",
+		Name:      "id_api_latency_seconds",
+		Help:      "Latency for /getValueForId api, initiating from consumer_service",
+		Buckets:   buckets,
+	}, []string{"id"})
+}
+
 func GetValueForId(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
+	// The dashboard propagates its trace context, so its requests continue in this span
+	ctx, span := tracing.StartServerSpan(tracer, r)
+	defer span.End()
 
-	log.Printf("In consumer.GetValueForId handler..")
 	id := r.URL.Query().Get("id")
-	log.Printf("ID in request: [%v]", id)
+	namespace := r.URL.Query().Get("namespace")
+	logger := logging.WithContext(ctx).With(logging.String("id", id), logging.String("namespace", namespace))
+	logger.Debug("Value requested")
 
 	defer func() {
 		elapsedTime := time.Since(startTime).Seconds()
-		IdApiSummary.WithLabelValues(id).Observe(elapsedTime)
+		label := IdLabels.Value(id)
+		tracing.Observe(ctx, IdApiHistogram.WithLabelValues(label), elapsedTime)
+		if LegacySummaries {
+			IdApiSummary.WithLabelValues(label).Observe(elapsedTime)
+		}
 	}()
 
 	// set common header
@@ -36,9 +63,10 @@ func GetValueForId(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodGet:
-		data, err := getValue(id)
+		data, err := getValue(namespace, id)
 		if err != nil {
-			log.Printf("consumer.GetValueForId Error: [%v]", err)
+			tracing.RecordError(span, err)
+			logger.Warn("Error in getting value", logging.Err(err))
 			resp := consumer_structs.Response{
 				Status:  "Failure",
 				Message: err.Error(),
@@ -53,7 +81,7 @@ func GetValueForId(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		log.Printf("consumer.GetValueForId Response: [%v]", data)
+		logger.Debug("Value found", logging.Float64("value", data.Value))
 		resp := consumer_structs.Response{
 			Status:  "Success",
 			Message: "Data fetched successfully.",
@@ -78,11 +106,10 @@ func GetValueForId(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getValue(id string) (consumer_structs.Message, error) {
+func getValue(namespace string, id string) (consumer_structs.Message, error) {
 	storageSvc = store.GetService()
-	respMessage, err := storageSvc.GetValue(id)
+	respMessage, err := storageSvc.GetValue(namespace, id)
 	if err != nil {
-		log.Printf("consumer.GetValueForId Error in getting value for id: [%v]. Error: [%v]", id, err)
 		return consumer_structs.Message{}, err
 	}
 
@@ -3,8 +3,8 @@ package helper
 import (
 	"consumer/consumer_structs"
 	"encoding/json"
-	"log"
 	"os"
+	"shared/logging"
 )
 
 func LoadConsumerConfiguration(file string) (cConfig consumer_structs.ConsumerConfig) {
@@ -12,17 +12,17 @@ func LoadConsumerConfiguration(file string) (cConfig consumer_structs.ConsumerCo
 	defer func(configFile *os.File) {
 		err := configFile.Close()
 		if err != nil {
-			log.Printf("Error in closing consumer config file. Error: [%v]", err)
+			logging.Error("Error in closing consumer config file", logging.Err(err))
 		}
 	}(configFile)
 	if err != nil {
-		log.Printf("Error in opening consumer config file. Error: [%v]", err)
+		logging.Error("Error in opening consumer config file", logging.String("file", file), logging.Err(err))
 		return
 	}
 	jsonParser := json.NewDecoder(configFile)
 	er := jsonParser.Decode(&cConfig)
 	if er != nil {
-		log.Printf("Error in json decoding consumer config. Error: [%v]", er)
+		logging.Error("Error in json decoding consumer config", logging.Err(er))
 		return
 	}
 
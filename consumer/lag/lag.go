@@ -0,0 +1,264 @@
+package lag
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"shared/logging"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = 15 * time.Second
+	// defaultSamples keeps an hour of watermark history at the default interval
+	defaultSamples = 240
+)
+
+var (
+	lagDesc = prometheus.NewDesc(
+		"kafka_consumergroup_lag",
+		"Messages a consumer group is behind, the high watermark minus the committed offset",
+		[]string{"group", "topic", "partition"}, nil)
+	timeLagDesc = prometheus.NewDesc(
+		"kafka_consumergroup_lag_seconds",
+		"Estimated age of the oldest message a consumer group hasn't committed yet, interpolated from the watermark history",
+		[]string{"group", "topic", "partition"}, nil)
+	ScrapeErrorCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "lag_scrape_errors",
+		Help:      "Counter for failed lag scrapes",
+	})
+	ScrapeDurationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "consumer",
+		Name:      "lag_scrape_duration_seconds",
+		Help:      "Duration of the last lag scrape",
+	})
+)
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+type groupPartitionKey struct {
+	group string
+	partitionKey
+}
+
+// sample is the high watermark of a partition at a point in time.
+type sample struct {
+	at     time.Time
+	offset int64
+}
+
+type lagValue struct {
+	messages int64
+	seconds  float64
+}
+
+// Exporter periodically computes the lag of consumer groups and exports the last result as
+// kafka_consumergroup_lag. Time lag is estimated from the history of high watermarks: it is the
+// time since the watermark was at the committed offset.
+type Exporter struct {
+	admin    sarama.ClusterAdmin
+	client   sarama.Client
+	groups   []string
+	interval time.Duration
+	samples  int
+
+	mu      sync.Mutex
+	history map[partitionKey][]sample
+	lags    map[groupPartitionKey]lagValue
+}
+
+// NewExporter connects its own client, closing the cluster admin closes the client it was made from.
+// Without groups every consumer group of the cluster is exported.
+func NewExporter(brokers []string, config *sarama.Config, groups []string, interval time.Duration, samples int) (*Exporter, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if samples < 2 {
+		samples = defaultSamples
+	}
+	return &Exporter{
+		admin:    admin,
+		client:   client,
+		groups:   groups,
+		interval: interval,
+		samples:  samples,
+		history:  make(map[partitionKey][]sample),
+		lags:     make(map[groupPartitionKey]lagValue),
+	}, nil
+}
+
+// Run scrapes every interval until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.scrape()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Exporter) Close() error {
+	return e.admin.Close()
+}
+
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lagDesc
+	ch <- timeLagDesc
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, value := range e.lags {
+		labels := []string{key.group, key.topic, strconv.Itoa(int(key.partition))}
+		ch <- prometheus.MustNewConstMetric(lagDesc, prometheus.GaugeValue, float64(value.messages), labels...)
+		ch <- prometheus.MustNewConstMetric(timeLagDesc, prometheus.GaugeValue, value.seconds, labels...)
+	}
+}
+
+// GroupLag returns the messages group is behind over all its partitions as of the last scrape.
+// Partitions without a committed offset don't count.
+func (e *Exporter) GroupLag(group string) int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var total int64
+	for key, value := range e.lags {
+		if key.group == group {
+			total += value.messages
+		}
+	}
+	return total
+}
+
+// scrape replaces the exported lags, partitions that fail to scrape are left out until they recover.
+func (e *Exporter) scrape() {
+	startTime := time.Now()
+	defer func() {
+		ScrapeDurationGauge.Set(time.Since(startTime).Seconds())
+	}()
+
+	groups := e.groups
+	if len(groups) == 0 {
+		all, err := e.admin.ListConsumerGroups()
+		if err != nil {
+			logging.Error("Error in listing consumer groups for lag", logging.Err(err))
+			ScrapeErrorCounter.Inc()
+			return
+		}
+		for group := range all {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+	}
+
+	complete := true
+	watermarks := make(map[partitionKey]int64)
+	lags := make(map[groupPartitionKey]lagValue)
+	for _, group := range groups {
+		offsets, err := e.admin.ListConsumerGroupOffsets(group, nil)
+		if err != nil {
+			logging.Error("Error in fetching offsets of group for lag", logging.String("group", group), logging.Err(err))
+			ScrapeErrorCounter.Inc()
+			complete = false
+			continue
+		}
+		for topic, partitions := range offsets.Blocks {
+			for partition, block := range partitions {
+				// Partitions without a committed offset have no lag to report
+				if block.Err != sarama.ErrNoError || block.Offset < 0 {
+					continue
+				}
+				key := partitionKey{topic, partition}
+				watermark, ok := watermarks[key]
+				if !ok {
+					if watermark, err = e.client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+						logging.Error("Error in fetching high watermark for lag", logging.String("topic", topic), logging.Int32("partition", partition), logging.Err(err))
+						ScrapeErrorCounter.Inc()
+						complete = false
+						continue
+					}
+					watermarks[key] = watermark
+				}
+				lags[groupPartitionKey{group, key}] = lagValue{messages: max(watermark-block.Offset, 0)}
+			}
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if complete {
+		// Forget partitions no group commits to anymore
+		for key := range e.history {
+			if _, ok := watermarks[key]; !ok {
+				delete(e.history, key)
+			}
+		}
+	}
+	for key, watermark := range watermarks {
+		history := append(e.history[key], sample{at: now, offset: watermark})
+		if len(history) > e.samples {
+			history = history[len(history)-e.samples:]
+		}
+		e.history[key] = history
+	}
+	for key, value := range lags {
+		value.seconds = timeLag(e.history[key.partitionKey], watermarks[key.partitionKey]-value.messages, now)
+		lags[key] = value
+	}
+	e.lags = lags
+}
+
+// timeLag estimates how long ago the high watermark was at offset, interpolating between the
+// samples around it. Offsets older than the history extrapolate the rate of its oldest samples.
+func timeLag(history []sample, offset int64, now time.Time) float64 {
+	if len(history) == 0 || offset >= history[len(history)-1].offset {
+		return 0
+	}
+	for i := len(history) - 1; i > 0; i-- {
+		newer, older := history[i], history[i-1]
+		if offset >= older.offset {
+			return now.Sub(interpolate(older, newer, offset)).Seconds()
+		}
+	}
+	if len(history) < 2 || history[1].offset == history[0].offset {
+		return now.Sub(history[0].at).Seconds()
+	}
+	return now.Sub(interpolate(history[0], history[1], offset)).Seconds()
+}
+
+// interpolate returns the time the watermark was at offset on the line through two samples.
+func interpolate(older, newer sample, offset int64) time.Time {
+	if newer.offset == older.offset {
+		return newer.at
+	}
+	fraction := float64(offset-older.offset) / float64(newer.offset-older.offset)
+	return older.at.Add(time.Duration(fraction * float64(newer.at.Sub(older.at))))
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,52 @@
+package lag
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTimeLag(t *testing.T) {
+	start := time.Date(2023, 1, 5, 8, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	// The watermark moves 10 messages per second
+	steady := []sample{{at(0), 100}, {at(10), 200}, {at(20), 300}, {at(30), 400}}
+	now := at(30)
+
+	tests := []struct {
+		name    string
+		history []sample
+		offset  int64
+		want    float64
+	}{
+		{"no history", nil, 100, 0},
+		{"caught up", steady, 400, 0},
+		{"ahead of the last sample", steady, 450, 0},
+		{"between the newest samples", steady, 350, 5},
+		{"at a sample", steady, 300, 10},
+		{"between the oldest samples", steady, 150, 25},
+		{"at the oldest sample", steady, 100, 30},
+		{"older than the history", steady, 50, 35},
+		{"single sample", []sample{{at(10), 200}}, 150, 20},
+		{"idle partition", []sample{{at(0), 100}, {at(10), 100}}, 50, 30},
+		{"idle then moving", []sample{{at(0), 100}, {at(10), 100}, {at(20), 200}}, 100, 20},
+	}
+	for _, tt := range tests {
+		if got := timeLag(tt.history, tt.offset, now); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("%s: timeLag = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	older := sample{at: time.Unix(100, 0), offset: 1000}
+	newer := sample{at: time.Unix(110, 0), offset: 2000}
+	if got := interpolate(older, newer, 1250); !got.Equal(time.Unix(102, 500000000)) {
+		t.Errorf("interpolate = %v, want 2.5s after the older sample", got)
+	}
+	if got := interpolate(older, sample{at: time.Unix(110, 0), offset: 1000}, 1000); !got.Equal(time.Unix(110, 0)) {
+		t.Errorf("interpolate between equal offsets = %v, want the newer sample", got)
+	}
+}
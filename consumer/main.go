@@ -2,45 +2,167 @@ package main
 
 import (
 	"consumer/consumer_structs"
+	"consumer/control"
 	"consumer/handler"
+	"consumer/lag"
+	"consumer/router"
 	"consumer/routes"
 	"consumer/store"
+	"consumer/validation"
+	"consumer/values"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dgraph-io/badger"
-	"log"
 	"net/http"
+	"os"
+	"shared/envelope"
+	"shared/health"
+	"shared/kafkametrics"
+	"shared/labels"
+	"shared/logging"
+	"shared/serde"
+	"shared/tracing"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Consumer represents a Sarama consumer group consumer
 type Consumer struct {
-	ready chan bool
+	ready      chan bool
+	readyOnce  sync.Once
+	controller *control.Controller
 }
 
 // Sarama configuration options
 var (
-	brokers            = "broker_1:9092"
-	topic              = "user_details_1"
-	group              = "user_group_1"
-	oldest             = true
-	storageSvc         *store.StorageService
-	consumptionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	brokers              = "broker_1:9092"
+	topic                = "user_details_1"
+	group                = "user_group_1"
+	oldest               = true
+	storageSvc           *store.StorageService
+	topicRegistry        *router.Registry
+	labelsDroppedCounter = labels.NewDroppedCounter("consumer")
+	idLabels             *labels.Policy
+	tracer               = tracing.Tracer("consumer")
+	consumptionCounter   = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "consumer",
 		Name:      "message_consumed",
 		Help:      "Counter for message consumed",
-	}, []string{"id"})
+	}, []string{"handler", "id"})
+	failureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "message_failed",
+		Help:      "Counter for consumed messages that could not be processed by topic handler and reason",
+	}, []string{"handler", "reason"})
+	duplicateCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "duplicates_dropped",
+		Help:      "Counter for redelivered messages dropped because they were already consumed by topic handler and dedup key",
+	}, []string{"handler", "key"})
+	injectedFaultCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "injected_faults_seen",
+		Help:      "Counter for consumed messages tagged with a fault injected by the producer by type",
+	}, []string{"type"})
+
+	// Latency histograms are created by initLatencyMetrics, once their buckets are configured
+	eventTimeLatency   prometheus.Histogram
+	kafkaLatency       *prometheus.HistogramVec
+	deserializeLatency *prometheus.HistogramVec
+	storeLatency       *prometheus.HistogramVec
+	processLatency     *prometheus.HistogramVec
 )
 
-func registerPrometheusMetrics() {
-	prometheus.MustRegister(handler.IdApiSummary)
+const (
+	IsolationReadCommitted = "read_committed"
+	DedupKeyEventId        = "event_id"
+	DedupKeyHash           = "hash"
+	InjectedFaultHeader    = "x-injected-fault"
+)
+
+// initLatencyMetrics creates the latency histograms with the buckets configured under their name
+// in metrics.latency_buckets, or with the defaults.
+func initLatencyMetrics(config consumer_structs.MetricsConfig) {
+	buckets := func(name string, defaults []float64) []float64 {
+		if configured := config.LatencyBuckets[name]; len(configured) > 0 {
+			return configured
+		}
+		return defaults
+	}
+
+	eventTimeLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "consumer",
+		Name:      "event_time_latency_seconds",
+		Help:      "Time between an event's envelope timestamp and its consumption",
+		Buckets:   buckets("event_time", prometheus.ExponentialBuckets(0.005, 2, 14)),
+	})
+	kafkaLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "consumer",
+		Name:      "kafka_latency_seconds",
+		Help:      "Time between a message's kafka timestamp and its consumption by topic handler",
+		Buckets:   buckets("kafka", prometheus.ExponentialBuckets(0.005, 2, 14)),
+	}, []string{"handler"})
+	deserializeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "consumer",
+		Name:      "deserialize_duration_seconds",
+		Help:      "Time spent deserializing consumed messages by encoding",
+		Buckets:   buckets("decode", prometheus.ExponentialBuckets(0.000001, 4, 10)),
+	}, []string{"encoding"})
+	storeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "consumer",
+		Name:      "store_write_duration_seconds",
+		Help:      "Time spent saving consumed messages in badger by topic handler",
+		Buckets:   buckets("store_write", prometheus.ExponentialBuckets(0.00001, 4, 10)),
+	}, []string{"handler"})
+	processLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "consumer",
+		Name:      "process_duration_seconds",
+		Help:      "Total time spent processing a consumed message by topic handler",
+		Buckets:   buckets("process", prometheus.ExponentialBuckets(0.00001, 4, 10)),
+	}, []string{"handler"})
+	if configured := config.LatencyBuckets["id_api"]; len(configured) > 0 {
+		handler.IdApiHistogram = handler.NewIdApiHistogram(configured)
+	}
+	handler.LegacySummaries = config.LegacySummaries
+}
+
+func registerPrometheusMetrics(config consumer_structs.MetricsConfig) {
+	prometheus.MustRegister(handler.IdApiHistogram)
+	// Summaries can't be aggregated across replicas, they are only kept for existing dashboards
+	if config.LegacySummaries {
+		prometheus.MustRegister(handler.IdApiSummary)
+	}
 	prometheus.MustRegister(consumptionCounter)
+	prometheus.MustRegister(failureCounter)
+	prometheus.MustRegister(duplicateCounter)
+	prometheus.MustRegister(eventTimeLatency)
+	prometheus.MustRegister(injectedFaultCounter)
+	prometheus.MustRegister(kafkaLatency)
+	prometheus.MustRegister(deserializeLatency)
+	prometheus.MustRegister(storeLatency)
+	prometheus.MustRegister(processLatency)
+	prometheus.MustRegister(validation.RejectedCounter)
+	prometheus.MustRegister(store.BloomLookupCounter)
+	prometheus.MustRegister(control.PartitionPausedGauge)
+	prometheus.MustRegister(control.LastSeekOffsetGauge)
+	prometheus.MustRegister(control.LastSeekTimestampGauge)
+	prometheus.MustRegister(handler.AdminChanges.Counter)
+	prometheus.MustRegister(handler.AdminChanges.LastChange)
+	prometheus.MustRegister(lag.ScrapeErrorCounter)
+	prometheus.MustRegister(lag.ScrapeDurationGauge)
+	prometheus.MustRegister(values.ScrapeErrorCounter)
+	prometheus.MustRegister(values.ScrapeDurationGauge)
+	prometheus.MustRegister(values.TruncatedGauge)
+	prometheus.MustRegister(labelsDroppedCounter)
+	prometheus.MustRegister(logging.SampledCounter)
 }
 
 func main() {
@@ -48,96 +170,269 @@ func main() {
 	defer cancel()
 
 	if err := store.InitiateStorageService(); err != nil {
-		log.Fatalf("Consumer. Error in initiating storage service. Error: [%v]", err)
+		logging.Fatal("Error in initiating storage service", logging.Err(err))
 	}
 	storageSvc = store.GetService()
+	logger, err := logging.New(storageSvc.ConsumerConfig.AppName, storageSvc.ConsumerConfig.Logging)
+	if err != nil {
+		logging.Fatal("Error in creating logger", logging.Err(err))
+	}
+	logging.SetDefault(logger)
 	defer func(Db *badger.DB) {
 		err := Db.Close()
 		if err != nil {
-			log.Printf("Consumer. Error in closing DB connection. Error: [%v]", err)
+			logging.Error("Error in closing DB connection", logging.Err(err))
 		}
 	}(storageSvc.Db)
 
+	if topicRegistry, err = router.NewRegistry(storageSvc.ConsumerConfig, topic); err != nil {
+		logging.Fatal("Error in creating topic handlers", logging.Err(err))
+	}
+
+	initLatencyMetrics(storageSvc.ConsumerConfig.Metrics)
+	if idLabels, err = labels.New("id", storageSvc.ConsumerConfig.Metrics.IdLabels, labelsDroppedCounter); err != nil {
+		logging.Fatal("Error in creating id label policy", logging.Err(err))
+	}
+	idLabels.OnEvict(consumptionCounter, handler.IdApiHistogram, handler.IdApiSummary)
+	handler.IdLabels = idLabels
+
+	shutdownTracing, err := tracing.Init(ctx, storageSvc.ConsumerConfig.AppName, storageSvc.ConsumerConfig.Tracing)
+	if err != nil {
+		logging.Fatal("Error in initiating tracing", logging.Err(err))
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logging.Error("Error in flushing traces", logging.Err(err))
+		}
+	}()
+
 	config := sarama.NewConfig()
 	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.BalanceStrategyRoundRobin}
 	if oldest {
 		config.Consumer.Offsets.Initial = sarama.OffsetOldest
 	}
+	consumerConfig := storageSvc.ConsumerConfig
+	if consumerConfig.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(consumerConfig.KafkaVersion)
+		if err != nil {
+			logging.Warn("Invalid kafka version, using sarama default", logging.String("kafka_version", consumerConfig.KafkaVersion), logging.Err(err))
+		} else {
+			config.Version = version
+		}
+	}
+	// read_committed hides messages of aborted or still open producer transactions
+	if consumerConfig.IsolationLevel == IsolationReadCommitted {
+		config.Consumer.IsolationLevel = sarama.ReadCommitted
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+
+	prometheus.MustRegister(kafkametrics.NewCollector(config.MetricRegistry))
+
+	kafkaClient, err := sarama.NewClient(strings.Split(brokers, ","), config)
+	if err != nil {
+		logging.Panic("Error creating kafka client", logging.Err(err))
+	}
+	client, err := sarama.NewConsumerGroupFromClient(group, kafkaClient)
+	if err != nil {
+		logging.Panic("Error creating consumer group client", logging.Err(err))
+	}
+	topics := subscribedTopics(kafkaClient)
+	logging.Info("Subscribing to topics", logging.Any("topics", topics))
 
 	// Set up a new Sarama consumer group
 	consumer := Consumer{
-		ready: make(chan bool),
+		ready:      make(chan bool),
+		controller: control.NewController(client, kafkaClient),
 	}
 
-	client, err := sarama.NewConsumerGroup(strings.Split(brokers, ","), group, config)
-	if err != nil {
-		log.Panicf("Error creating consumer group client: %v", err)
-	}
+	lagExporter := newLagExporter(config)
+	checker := newHealthChecker(consumer.controller, lagExporter)
 
 	// Register http routes
-	routes.RegisterRoutes()
+	routes.RegisterRoutes(&handler.AdminHandler{
+		Token:      adminToken(consumerConfig),
+		Controller: consumer.controller,
+	}, checker)
 
-	// Prometheus metric
-	http.Handle("/metrics", promhttp.Handler())
+	// Prometheus metric, exemplars are only served in the OpenMetrics format
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 
 	// Start http server
-	fmt.Printf("Starting server at port 8080...\n")
+	logging.Info("Starting server", logging.Int("port", 8080))
 	go func() {
 		if err := http.ListenAndServe(":8080", nil); err != nil {
-			log.Fatal(err)
+			logging.Fatal("Error in serving http", logging.Err(err))
 		}
 	}()
 
 	// Register Prometheus custom metrics
-	registerPrometheusMetrics()
+	registerPrometheusMetrics(consumerConfig.Metrics)
 
-	log.Println("Starting a new Sarama consumer...")
 	wg := &sync.WaitGroup{}
+	if lagExporter != nil {
+		prometheus.MustRegister(lagExporter)
+		defer func() {
+			if err := lagExporter.Close(); err != nil {
+				logging.Error("Error closing lag exporter", logging.Err(err))
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lagExporter.Run(ctx)
+		}()
+	}
+	if valuesConfig := consumerConfig.Metrics.IdValues; valuesConfig.Enabled {
+		valuesCollector := values.NewCollector(storageSvc, topicRegistry.Namespaces(),
+			time.Duration(valuesConfig.Interval)*time.Millisecond, valuesConfig.MaxIds)
+		prometheus.MustRegister(valuesCollector)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			valuesCollector.Run(ctx)
+		}()
+	}
+
+	prometheus.MustRegister(checker.Collector())
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := client.Consume(ctx, strings.Split(topic, ","), &consumer); err != nil {
-			log.Panicf("Consumer: Error: %v", err)
-		}
-		// check if context was cancelled, signaling that the consumer should stop
-		if ctx.Err() != nil {
-			return
+		checker.Run(ctx)
+	}()
+
+	logging.Info("Starting a new Sarama consumer")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Consume returns when the session ends, after a rebalance or a seek, so join again
+		for {
+			if err := client.Consume(ctx, topics, &consumer); err != nil {
+				logging.Panic("Error in consuming", logging.Err(err))
+			}
+			// check if context was cancelled, signaling that the consumer should stop
+			if ctx.Err() != nil {
+				return
+			}
 		}
-		consumer.ready = make(chan bool)
 	}()
 
 	<-consumer.ready // wait till the consumer has been set up
-	log.Println("Sarama consumer up and running!...")
+	logging.Info("Sarama consumer up and running")
 
 	select {
 	case <-ctx.Done():
-		log.Println("terminating: context cancelled")
+		logging.Info("Terminating: context cancelled")
 	}
 
 	wg.Wait()
 	if err = client.Close(); err != nil {
-		log.Panicf("Consumer: error closing client: %v", err)
+		logging.Panic("Error closing consumer group", logging.Err(err))
+	}
+	// A consumer group created from a client leaves closing the client to its owner
+	if err = kafkaClient.Close(); err != nil {
+		logging.Error("Error closing kafka client", logging.Err(err))
+	}
+}
+
+// adminToken returns the admin api token, CONSUMER_ADMIN_TOKEN takes precedence over the config.
+func adminToken(config consumer_structs.ConsumerConfig) string {
+	if token := os.Getenv("CONSUMER_ADMIN_TOKEN"); token != "" {
+		return token
 	}
+	return config.Admin.Token
+}
+
+// newLagExporter starts exporting consumer group lag, returning nil when it is disabled or can't connect.
+func newLagExporter(config *sarama.Config) *lag.Exporter {
+	lagConfig := storageSvc.ConsumerConfig.Lag
+	if !lagConfig.Enabled {
+		return nil
+	}
+	exporter, err := lag.NewExporter(strings.Split(brokers, ","), config, lagConfig.Groups,
+		time.Duration(lagConfig.Interval)*time.Millisecond, lagConfig.Samples)
+	if err != nil {
+		logging.Error("Error in creating lag exporter, lag won't be exported", logging.Err(err))
+		return nil
+	}
+	return exporter
+}
+
+// newHealthChecker checks that badger is readable for liveness, and for readiness that the
+// consumer holds a group session and, with lag exported, that its group isn't too far behind.
+func newHealthChecker(controller *control.Controller, lagExporter *lag.Exporter) *health.Checker {
+	healthConfig := storageSvc.ConsumerConfig.Health
+	checker := health.NewChecker("consumer", time.Duration(healthConfig.Interval)*time.Millisecond,
+		time.Duration(healthConfig.Timeout)*time.Millisecond)
+	checker.Live("badger", func(context.Context) error {
+		return storageSvc.Ping()
+	})
+	checker.Ready("group_session", func(context.Context) error {
+		if !controller.Active() {
+			return control.ErrNoSession
+		}
+		return nil
+	})
+	if lagExporter == nil || healthConfig.MaxLag <= 0 {
+		logging.Info("Lag isn't exported or has no threshold, readiness won't check it")
+		return checker
+	}
+	checker.Ready("lag", func(context.Context) error {
+		if messages := lagExporter.GroupLag(group); messages > healthConfig.MaxLag {
+			return fmt.Errorf("group %v lags %d messages, more than %d", group, messages, healthConfig.MaxLag)
+		}
+		return nil
+	})
+	return checker
+}
+
+// subscribedTopics resolves the topics served by the topic handlers. Topics matching a handler
+// pattern are looked up once at startup, topics created later are picked up on restart.
+func subscribedTopics(client sarama.Client) []string {
+	candidates := strings.Split(topic, ",")
+	if topicRegistry.HasPatterns() {
+		available, err := client.Topics()
+		if err != nil {
+			logging.Warn("Error in listing topics, pattern handlers only get configured topics", logging.Err(err))
+		}
+		candidates = append(candidates, available...)
+	}
+	return topicRegistry.Topics(candidates)
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	// Mark the consumer as ready
-	close(consumer.ready)
+func (consumer *Consumer) Setup(session sarama.ConsumerGroupSession) error {
+	consumer.controller.Setup(session)
+	// Mark the consumer as ready, once
+	consumer.readyOnce.Do(func() {
+		close(consumer.ready)
+	})
 	return nil
 }
 
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
+func (consumer *Consumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	consumer.controller.Cleanup(session)
 	return nil
 }
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	restart := consumer.controller.Claimed(claim.Topic(), claim.Partition())
 	for {
 		select {
-		case message := <-claim.Messages():
-			if err := processMessage(message); err != nil {
+		case <-restart:
+			// A seek is pending, stop without marking anything else so the session applies it
+			return nil
+
+		case message, ok := <-claim.Messages():
+			// The channel is closed when the claim ends with the session
+			if !ok {
+				return nil
+			}
+			if err := processMessage(session.Context(), message); err != nil {
 				return err
 			}
 			session.MarkMessage(message, "")
@@ -148,22 +443,122 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	}
 }
 
-func processMessage(message *sarama.ConsumerMessage) error {
-	var consumedMessage consumer_structs.Message
-	if err := json.Unmarshal(message.Value, &consumedMessage); err != nil {
-		log.Printf("Consumer: Error in formatting consumed message. Error: [%v]", err)
-		return err
+// processMessage handles message in a span continuing the trace of its producer, with child spans
+// for decoding and the badger write.
+func processMessage(ctx context.Context, message *sarama.ConsumerMessage) (err error) {
+	startTime := time.Now()
+	logger := logging.With(logging.String("topic", message.Topic), logging.Int32("partition", message.Partition), logging.Int64("offset", message.Offset))
+	h := topicRegistry.Handler(message.Topic)
+	if h == nil {
+		// Subscriptions follow the handlers, so this only happens if a topic pattern is changed
+		logger.Warn("No handler for topic, skipping message")
+		failureCounter.WithLabelValues("", "unrouted").Inc()
+		return nil
+	}
+	ctx, span := tracing.StartProcessSpan(ctx, tracer, message, attribute.String("handler", h.Name))
+	logger = logger.WithContext(ctx).With(logging.String("handler", h.Name))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+		tracing.Observe(ctx, processLatency.WithLabelValues(h.Name), time.Since(startTime).Seconds())
+	}()
+	if !message.Timestamp.IsZero() {
+		tracing.Observe(ctx, kafkaLatency.WithLabelValues(h.Name), startTime.Sub(message.Timestamp).Seconds())
 	}
-	log.Printf("Message consumed: [%v]", consumedMessage)
+
+	encoding := h.DefaultEncoding
+	for _, header := range message.Headers {
+		switch string(header.Key) {
+		case InjectedFaultHeader:
+			injectedFaultCounter.WithLabelValues(string(header.Value)).Inc()
+		case serde.EncodingHeader:
+			encoding = string(header.Value)
+		}
+	}
+
+	// Retrying can't fix an invalid message, so rejected messages are skipped instead of blocking the partition
+	if err := h.Validator.CheckPayload(message.Value); err != nil {
+		tracing.RecordError(span, err)
+		logger.Warn("Rejected consumed message, skipping it", logging.Err(err), logging.String("sample", validation.Sample(message.Value)))
+		return nil
+	}
+
+	// Accepts both the legacy {id, value} shape and the versioned envelope
+	consumedMessage, err := decodeMessage(ctx, h, encoding, message.Value)
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.Warn("Error in decoding consumed message, skipping it", logging.String("encoding", encoding), logging.Err(err))
+		failureCounter.WithLabelValues(h.Name, "decode").Inc()
+		return nil
+	}
+	span.SetAttributes(tracing.EnvelopeAttributes(consumedMessage)...)
+	logger = logger.With(logging.String("id", consumedMessage.Id))
+	if err := h.Validator.CheckMessage(encoding, message.Value, consumedMessage); err != nil {
+		tracing.RecordError(span, err)
+		logger.Warn("Rejected consumed message, skipping it", logging.Err(err), logging.String("sample", validation.Sample(message.Value)))
+		return nil
+	}
+	logger.Debug("Message consumed", logging.String("event_id", consumedMessage.EventId), logging.Float64("value", consumedMessage.Value))
 
 	// Save consumed message in badger KV store
-	if err := storageSvc.SaveConsumedMessage(consumedMessage); err != nil {
-		log.Printf("Consumer: Error processing consumed message. Error: [%v]", err)
+	keyType, seenKey := dedupKey(h, message, consumedMessage)
+	storeCtx, storeSpan := tracer.Start(ctx, "store_write", trace.WithAttributes(attribute.String("namespace", h.Namespace)))
+	storeStartTime := time.Now()
+	duplicate, err := storageSvc.SaveConsumedMessage(h.Namespace, consumedMessage, seenKey)
+	tracing.Observe(storeCtx, storeLatency.WithLabelValues(h.Name), time.Since(storeStartTime).Seconds())
+	storeSpan.SetAttributes(attribute.Bool("duplicate", duplicate))
+	tracing.RecordError(storeSpan, err)
+	storeSpan.End()
+	if errors.Is(err, store.ErrInvalidId) {
+		logger.Warn("Id can't be stored, skipping message", logging.Err(err))
+		failureCounter.WithLabelValues(h.Name, "invalid_id").Inc()
+		return nil
+	}
+	if err != nil {
+		logger.Error("Error in storing consumed message", logging.Err(err))
+		failureCounter.WithLabelValues(h.Name, "store").Inc()
 		return err
 	}
+	if duplicate {
+		logger.Debug("Dropping duplicate message", logging.String("key", string(seenKey)))
+		duplicateCounter.WithLabelValues(h.Name, keyType).Inc()
+		return nil
+	}
+
+	if !consumedMessage.EventTime.IsZero() {
+		tracing.Observe(ctx, eventTimeLatency, time.Since(consumedMessage.EventTime).Seconds())
+	}
 
 	// Update consumption counter metric
-	consumptionCounter.WithLabelValues(consumedMessage.Id).Inc()
+	consumptionCounter.WithLabelValues(h.Name, idLabels.Value(consumedMessage.Id)).Inc()
 
 	return nil
 }
+
+// dedupKey returns the seen-set key of a message and its type, or a nil key when dedup is off.
+// Messages without an event id are deduped on their hash.
+func dedupKey(h *router.Handler, message *sarama.ConsumerMessage, event envelope.Envelope) (string, []byte) {
+	dedup := storageSvc.ConsumerConfig.Dedup
+	if !dedup.Enabled {
+		return "", nil
+	}
+	if dedup.Key != DedupKeyHash && event.EventId != "" {
+		return DedupKeyEventId, store.EventIdKey(h.Namespace, event.EventId)
+	}
+	return DedupKeyHash, store.HashKey(h.Namespace, message.Key, message.Value, message.Timestamp)
+}
+
+func decodeMessage(ctx context.Context, h *router.Handler, encoding string, data []byte) (e envelope.Envelope, err error) {
+	serializer, ok := h.Serializers[encoding]
+	if !ok {
+		return envelope.Envelope{}, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	ctx, span := tracer.Start(ctx, "decode", trace.WithAttributes(attribute.String("encoding", encoding)))
+	startTime := time.Now()
+	defer func() {
+		tracing.Observe(ctx, deserializeLatency.WithLabelValues(encoding), time.Since(startTime).Seconds())
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	return serializer.Decode(data)
+}
@@ -0,0 +1,197 @@
+package router
+
+import (
+	"consumer/consumer_structs"
+	"consumer/validation"
+	"fmt"
+	"regexp"
+	"shared/logging"
+	"shared/serde"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultHandler names the handler built from the top-level config when no topics are configured.
+const DefaultHandler = "default"
+
+// Handler processes the messages of the topics it is routed, with its own decoder, validation
+// rules and badger key namespace.
+type Handler struct {
+	Name            string
+	Namespace       string
+	DefaultEncoding string
+	Serializers     map[string]serde.Serializer
+	Validator       *validation.Validator
+
+	topic   string
+	pattern *regexp.Regexp
+}
+
+// matches reports whether h serves topic, an empty topic and pattern serve every topic.
+func (h *Handler) matches(topic string) bool {
+	switch {
+	case h.topic != "":
+		return h.topic == topic
+	case h.pattern != nil:
+		return h.pattern.MatchString(topic)
+	default:
+		return true
+	}
+}
+
+// Registry routes topics to handlers. Exact topic names take precedence over patterns, which are
+// tried in config order.
+type Registry struct {
+	handlers []*Handler
+	routes   sync.Map // topic -> *Handler, nil when no handler matches
+}
+
+// NewRegistry creates a handler per topic config. Without topic configs every topic is served by
+// a single handler using the top-level encoding and validation, with an empty namespace.
+func NewRegistry(config consumer_structs.ConsumerConfig, defaultTopic string) (*Registry, error) {
+	topics := config.Topics
+	if len(topics) == 0 {
+		topics = []consumer_structs.TopicConfig{{
+			Name:       DefaultHandler,
+			Encoding:   config.Encoding,
+			Validation: config.Validation,
+		}}
+	}
+
+	r := &Registry{}
+	names := make(map[string]bool)
+	for _, topicConfig := range topics {
+		if topicConfig.Name == "" || names[topicConfig.Name] {
+			return nil, fmt.Errorf("topic handlers need a unique name, got %q", topicConfig.Name)
+		}
+		names[topicConfig.Name] = true
+		handler, err := newHandler(topicConfig, defaultTopic)
+		if err != nil {
+			return nil, fmt.Errorf("topic handler %q: %w", topicConfig.Name, err)
+		}
+		r.handlers = append(r.handlers, handler)
+	}
+	// Stable sort keeps config order within exact topics and within patterns
+	sort.SliceStable(r.handlers, func(i, j int) bool {
+		return r.handlers[i].topic != "" && r.handlers[j].topic == ""
+	})
+	return r, nil
+}
+
+func newHandler(config consumer_structs.TopicConfig, defaultTopic string) (*Handler, error) {
+	if config.Topic != "" && config.Pattern != "" {
+		return nil, fmt.Errorf("set either topic or pattern, not both")
+	}
+	if strings.HasPrefix(config.Namespace, "_") {
+		return nil, fmt.Errorf("namespace %q is reserved, it can't start with '_'", config.Namespace)
+	}
+	handler := &Handler{Name: config.Name, Namespace: config.Namespace, topic: config.Topic}
+	if config.Pattern != "" {
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		handler.pattern = pattern
+	}
+
+	validator, err := validation.NewValidator(config.Name, config.Validation)
+	if err != nil {
+		return nil, err
+	}
+	handler.Validator = validator
+
+	handler.DefaultEncoding = config.Encoding.Type
+	if handler.DefaultEncoding == "" {
+		handler.DefaultEncoding = serde.JSON
+	}
+	subject := config.Encoding.Subject
+	if subject == "" {
+		if config.Topic != "" {
+			defaultTopic = config.Topic
+		}
+		subject = defaultTopic + "-value"
+	}
+	handler.Serializers = newSerializers(config.Encoding.SchemaRegistryUrl, subject)
+	return handler, nil
+}
+
+// newSerializers creates a serializer for every encoding a handler can read. Avro is left out
+// when its schema can't be registered, its messages then fail to decode.
+func newSerializers(registryUrl string, subject string) map[string]serde.Serializer {
+	registry := serde.NewRegistry(registryUrl)
+	serializers := make(map[string]serde.Serializer)
+	for _, encoding := range []string{serde.JSON, serde.Protobuf, serde.Avro} {
+		serializer, err := serde.New(encoding, registry, subject)
+		if err != nil {
+			logging.Error("Error in creating serializer", logging.String("encoding", encoding), logging.Err(err))
+			continue
+		}
+		serializers[encoding] = serializer
+	}
+	return serializers
+}
+
+// Handler returns the handler serving topic, or nil if none does.
+func (r *Registry) Handler(topic string) *Handler {
+	if cached, ok := r.routes.Load(topic); ok {
+		return cached.(*Handler)
+	}
+	var handler *Handler
+	for _, h := range r.handlers {
+		if h.matches(topic) {
+			handler = h
+			break
+		}
+	}
+	r.routes.Store(topic, handler)
+	return handler
+}
+
+// Topics returns the topics to subscribe to: those of handlers routed by name plus the candidates
+// some handler serves. Internal topics starting with '__' are never subscribed to.
+func (r *Registry) Topics(candidates []string) []string {
+	seen := make(map[string]bool)
+	var topics []string
+	add := func(topic string) {
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	for _, h := range r.handlers {
+		add(h.topic)
+	}
+	for _, topic := range candidates {
+		if strings.HasPrefix(topic, "__") {
+			continue
+		}
+		if r.Handler(topic) != nil {
+			add(topic)
+		}
+	}
+	return topics
+}
+
+// HasPatterns reports whether any handler is routed by pattern, and thus needs the topic list.
+func (r *Registry) HasPatterns() bool {
+	for _, h := range r.handlers {
+		if h.pattern != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Namespaces returns the badger key namespaces of all handlers, without duplicates.
+func (r *Registry) Namespaces() []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, h := range r.handlers {
+		if !seen[h.Namespace] {
+			seen[h.Namespace] = true
+			namespaces = append(namespaces, h.Namespace)
+		}
+	}
+	return namespaces
+}
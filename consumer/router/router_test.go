@@ -0,0 +1,133 @@
+package router
+
+import (
+	"consumer/consumer_structs"
+	"fmt"
+	"shared/envelope"
+	"shared/serde"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T, topics ...consumer_structs.TopicConfig) *Registry {
+	t.Helper()
+	r, err := NewRegistry(consumer_structs.ConsumerConfig{Topics: topics}, "user_details_1")
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	return r
+}
+
+func TestHandlerRouting(t *testing.T) {
+	r := newTestRegistry(t,
+		consumer_structs.TopicConfig{Name: "suffixed", Pattern: "_1$", Namespace: "suffixed"},
+		consumer_structs.TopicConfig{Name: "orders", Pattern: "^orders_", Namespace: "orders"},
+		consumer_structs.TopicConfig{Name: "users", Topic: "orders_1"},
+	)
+
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		// Exact topics take precedence over patterns listed before them
+		{"orders_1", "users"},
+		// Patterns are tried in config order
+		{"orders_2", "orders"},
+		{"payments_1", "suffixed"},
+		{"payments_2", ""},
+	}
+	for _, tt := range tests {
+		name := ""
+		if h := r.Handler(tt.topic); h != nil {
+			name = h.Name
+		}
+		if name != tt.want {
+			t.Errorf("Handler(%s) = %q, want %q", tt.topic, name, tt.want)
+		}
+	}
+
+	topics := r.Topics([]string{"orders_2", "payments_2", "__consumer_offsets", "orders_2"})
+	if fmt.Sprint(topics) != "[orders_1 orders_2]" {
+		t.Errorf("Topics = %v, want [orders_1 orders_2]", topics)
+	}
+	if !r.HasPatterns() {
+		t.Error("HasPatterns = false with pattern handlers")
+	}
+}
+
+func TestDefaultHandler(t *testing.T) {
+	r, err := NewRegistry(consumer_structs.ConsumerConfig{Encoding: consumer_structs.EncodingConfig{Type: serde.Protobuf}}, "user_details_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.Handler("anything")
+	if h == nil || h.Name != DefaultHandler || h.Namespace != "" || h.DefaultEncoding != serde.Protobuf {
+		t.Fatalf("Handler = %+v, want the default handler with the top-level encoding", h)
+	}
+	if r.HasPatterns() || fmt.Sprint(r.Topics([]string{"user_details_1"})) != "[user_details_1]" {
+		t.Error("the default handler should serve the configured topic without listing topics")
+	}
+}
+
+func TestHandlerSerializers(t *testing.T) {
+	r := newTestRegistry(t,
+		consumer_structs.TopicConfig{Name: "users", Topic: "user_details_1"},
+		consumer_structs.TopicConfig{Name: "orders", Topic: "orders_1", Namespace: "orders", Encoding: consumer_structs.EncodingConfig{Type: serde.Avro}},
+	)
+	users, orders := r.Handler("user_details_1"), r.Handler("orders_1")
+	if users.DefaultEncoding != serde.JSON || orders.DefaultEncoding != serde.Avro {
+		t.Errorf("default encodings %q and %q, want %q and %q", users.DefaultEncoding, orders.DefaultEncoding, serde.JSON, serde.Avro)
+	}
+
+	// Every handler reads every encoding, whatever its default, through its own serializers
+	e := envelope.New(envelope.Message{Id: "1", Value: 2.5}, "producer-1")
+	for _, h := range []*Handler{users, orders} {
+		for _, encoding := range []string{serde.JSON, serde.Protobuf, serde.Avro} {
+			serializer, ok := h.Serializers[encoding]
+			if !ok || serializer.Name() != encoding {
+				t.Errorf("%s: no %s serializer", h.Name, encoding)
+				continue
+			}
+			data, err := serializer.Encode(e)
+			if err != nil {
+				t.Fatalf("%s: Encode(%s): %v", h.Name, encoding, err)
+			}
+			if decoded, err := serializer.Decode(data); err != nil || decoded.EventId != e.EventId || decoded.Value != e.Value {
+				t.Errorf("%s: %s round trip = %+v, %v", h.Name, encoding, decoded, err)
+			}
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	r := newTestRegistry(t,
+		consumer_structs.TopicConfig{Name: "users", Topic: "user_details_1"},
+		consumer_structs.TopicConfig{Name: "orders", Pattern: "^orders_", Namespace: "orders"},
+		consumer_structs.TopicConfig{Name: "returns", Topic: "returns_1", Namespace: "orders"},
+	)
+	if namespaces := r.Namespaces(); fmt.Sprint(namespaces) != "[ orders]" {
+		t.Errorf("Namespaces = %q, want the empty namespace and orders once", namespaces)
+	}
+	if h := r.Handler("returns_1"); h.Namespace != "orders" {
+		t.Errorf("returns namespace = %q, want orders", h.Namespace)
+	}
+}
+
+func TestNewRegistryRejectsBadConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		topics []consumer_structs.TopicConfig
+	}{
+		{"missing name", []consumer_structs.TopicConfig{{Topic: "a"}}},
+		{"duplicate name", []consumer_structs.TopicConfig{{Name: "a", Topic: "a"}, {Name: "a", Topic: "b"}}},
+		{"topic and pattern", []consumer_structs.TopicConfig{{Name: "a", Topic: "a", Pattern: "a"}}},
+		{"invalid pattern", []consumer_structs.TopicConfig{{Name: "a", Pattern: "("}}},
+		{"reserved namespace", []consumer_structs.TopicConfig{{Name: "a", Topic: "a", Namespace: "_stats"}}},
+		{"unknown required field", []consumer_structs.TopicConfig{{Name: "a", Topic: "a",
+			Validation: consumer_structs.ValidationConfig{RequiredFields: []string{"name"}}}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewRegistry(consumer_structs.ConsumerConfig{Topics: tt.topics}, "user_details_1"); err == nil {
+			t.Errorf("%s: NewRegistry accepted the config", tt.name)
+		}
+	}
+}
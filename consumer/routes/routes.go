@@ -3,9 +3,25 @@ package routes
 import (
 	"consumer/handler"
 	"net/http"
+	"shared/health"
+	"shared/logging"
 )
 
-func RegisterRoutes() {
+func RegisterRoutes(admin *handler.AdminHandler, checker *health.Checker) {
 	// accepts a message and pushes it to kafka topic along with other details
 	http.HandleFunc("/getValueForId", handler.GetValueForId)
+
+	// liveness and readiness with the results of the last health checks
+	checker.Register(http.DefaultServeMux)
+
+	if admin.Token == "" {
+		logging.Info("No admin token configured, the admin api is disabled")
+		return
+	}
+	// runtime control of consumption, every request needs the admin token as bearer token
+	http.HandleFunc("/admin/status", admin.GetStatus)
+	http.HandleFunc("/admin/pause", admin.Pause)
+	http.HandleFunc("/admin/resume", admin.Resume)
+	http.HandleFunc("/admin/seek", admin.Seek)
+	http.HandleFunc("/admin/log-level", admin.LogLevel)
 }
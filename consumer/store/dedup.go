@@ -0,0 +1,170 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/AndreasBriese/bbloom"
+	"github.com/dgraph-io/badger"
+	"github.com/prometheus/client_golang/prometheus"
+	"shared/logging"
+	"sync"
+	"time"
+)
+
+const (
+	// hashKeyPrefix namespaces the hashes of messages deduped by content
+	hashKeyPrefix = "_hash/"
+
+	defaultBloomCapacity          = 1000000
+	defaultBloomFalsePositiveRate = 0.01
+)
+
+var (
+	BloomLookupCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "dedup_bloom_lookups",
+		Help:      "Counter for dedup lookups by bloom filter result, only positives are checked in badger",
+	}, []string{"result"})
+)
+
+// EventIdKey is the seen-set key of an event id in namespace.
+func EventIdKey(namespace string, eventId string) []byte {
+	return append([]byte(eventKeyPrefix), valueKey(namespace, eventId)...)
+}
+
+// HashKey is the seen-set key of a message without a usable event id in namespace, derived from
+// its kafka key, value and timestamp.
+func HashKey(namespace string, key, value []byte, timestamp time.Time) []byte {
+	h := sha256.New()
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(key)))
+	h.Write(length[:])
+	h.Write(key)
+	h.Write(value)
+	binary.BigEndian.PutUint64(length[:], uint64(timestamp.UnixNano()))
+	h.Write(length[:])
+	return append([]byte(hashKeyPrefix), valueKey(namespace, hex.EncodeToString(h.Sum(nil)))...)
+}
+
+// seenSet is a bloom filter over the seen-set keys in badger. A negative answer is definite,
+// so only possible duplicates cost a badger lookup. Keys expire from badger but not from the
+// filter, which is rebuilt from badger in the background once more keys were added than it was
+// sized for.
+type seenSet struct {
+	mu       sync.Mutex
+	db       *badger.DB
+	bloom    bbloom.Bloom
+	added    int
+	capacity int
+	fpRate   float64
+	// pending collects the keys added while a rebuild scans badger, which its scan may miss
+	pending    [][]byte
+	rebuilding bool
+}
+
+func newSeenSet(db *badger.DB, capacity int, fpRate float64) (*seenSet, error) {
+	if capacity <= 0 {
+		capacity = defaultBloomCapacity
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = defaultBloomFalsePositiveRate
+	}
+	set := &seenSet{db: db, capacity: capacity, fpRate: fpRate}
+	keys, err := set.scan()
+	if err != nil {
+		return nil, err
+	}
+	set.bloom, set.capacity = set.fill(keys, capacity)
+	set.added = len(keys)
+	return set, nil
+}
+
+func (set *seenSet) mayContain(key []byte) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.bloom.Has(key) {
+		BloomLookupCounter.WithLabelValues("positive").Inc()
+		return true
+	}
+	BloomLookupCounter.WithLabelValues("negative").Inc()
+	return false
+}
+
+func (set *seenSet) add(key []byte) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.bloom.Add(key)
+	set.added++
+	if set.rebuilding {
+		set.pending = append(set.pending, key)
+		return
+	}
+	if set.added <= set.capacity {
+		return
+	}
+	// The full filter keeps answering, with more false positives, until the new one is swapped in
+	set.rebuilding = true
+	go set.rebuild()
+}
+
+// rebuild refills a new filter with the keys still in badger without holding mu, so that
+// consuming carries on meanwhile, and swaps it in.
+func (set *seenSet) rebuild() {
+	set.mu.Lock()
+	capacity := set.capacity
+	set.mu.Unlock()
+
+	keys, err := set.scan()
+	var bloom bbloom.Bloom
+	if err == nil {
+		bloom, capacity = set.fill(keys, capacity)
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if err != nil {
+		// The full filter keeps answering, retry after another capacity worth of keys
+		logging.Error("Error in rebuilding bloom filter", logging.Err(err))
+		set.added = 0
+	} else {
+		for _, key := range set.pending {
+			bloom.Add(key)
+		}
+		set.bloom, set.capacity = bloom, capacity
+		set.added = len(keys) + len(set.pending)
+	}
+	set.pending = nil
+	set.rebuilding = false
+}
+
+// scan returns the seen-set keys in badger.
+func (set *seenSet) scan() ([][]byte, error) {
+	var keys [][]byte
+	err := set.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for _, prefix := range []string{eventKeyPrefix, hashKeyPrefix} {
+			for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// fill creates a filter holding keys, growing capacity if the window holds more keys than it.
+func (set *seenSet) fill(keys [][]byte, capacity int) (bbloom.Bloom, int) {
+	if len(keys)*2 > capacity {
+		capacity = len(keys) * 2
+	}
+	bloom := bbloom.New(float64(capacity), set.fpRate)
+	for _, key := range keys {
+		bloom.Add(key)
+	}
+	logging.Info("Loaded seen keys into bloom filter", logging.Int("keys", len(keys)), logging.Int("capacity", capacity))
+	return bloom, capacity
+}
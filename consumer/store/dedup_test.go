@@ -0,0 +1,154 @@
+package store
+
+import (
+	"consumer/consumer_structs"
+	"fmt"
+	"shared/envelope"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openDedupStore(t *testing.T, capacity int, ttl int64) *StorageService {
+	t.Helper()
+	s := openTestStore(t)
+	s.ConsumerConfig.Dedup = consumer_structs.DedupConfig{Enabled: true, Ttl: ttl, BloomCapacity: capacity}
+	seen, err := newSeenSet(s.Db, capacity, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.seen = seen
+	return s
+}
+
+// saveEvent stores a message of event and reports whether it was a duplicate.
+func saveEvent(t *testing.T, s *StorageService, event int) bool {
+	t.Helper()
+	e := envelope.Envelope{EventId: fmt.Sprint("event-", event), Message: consumer_structs.Message{Id: "42", Value: 1}}
+	duplicate, err := s.SaveConsumedMessage("", e, EventIdKey("", e.EventId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return duplicate
+}
+
+func waitRebuilt(t *testing.T, set *seenSet) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		set.mu.Lock()
+		rebuilding := set.rebuilding
+		set.mu.Unlock()
+		if !rebuilding {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the bloom filter rebuild")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDedupAcrossRebuilds(t *testing.T) {
+	s := openDedupStore(t, 10, 0)
+	for event := 0; event < 100; event++ {
+		if saveEvent(t, s, event) {
+			t.Fatalf("event %d reported as a duplicate on first delivery", event)
+		}
+	}
+	waitRebuilt(t, s.seen)
+
+	s.seen.mu.Lock()
+	capacity := s.seen.capacity
+	s.seen.mu.Unlock()
+	if capacity < 100 {
+		t.Errorf("capacity = %d after rebuilding with 100 keys, want it grown", capacity)
+	}
+	// A rebuilt filter must not forget any key still in badger
+	checkFalsePositives(t, s.seen)
+	for event := 0; event < 100; event++ {
+		if !saveEvent(t, s, event) {
+			t.Errorf("redelivered event %d wasn't reported as a duplicate", event)
+		}
+	}
+
+	// Reopening loads the filter from badger
+	reopened, err := newSeenSet(s.Db, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for event := 0; event < 100; event++ {
+		if !reopened.mayContain(EventIdKey("", fmt.Sprint("event-", event))) {
+			t.Errorf("reloaded filter misses event %d", event)
+		}
+	}
+}
+
+func TestDedupTtlExpiry(t *testing.T) {
+	s := openDedupStore(t, 100, 1000)
+	if saveEvent(t, s, 1) || !saveEvent(t, s, 1) {
+		t.Fatal("event wasn't deduped within the ttl")
+	}
+
+	// Badger expires keys with a granularity of seconds
+	time.Sleep(2100 * time.Millisecond)
+	// A rebuild leaves the expired key out
+	if keys, err := s.seen.scan(); err != nil || len(keys) != 0 {
+		t.Errorf("scan = %d keys, %v, want the expired key left out", len(keys), err)
+	}
+	if saveEvent(t, s, 1) {
+		t.Error("event was still deduped after the ttl")
+	}
+	if value, err := s.GetValue("", "42"); err != nil || value.Value != 2 {
+		t.Errorf("GetValue = %v, %v, want both deliveries outside the ttl added", value.Value, err)
+	}
+}
+
+func TestSeenDuringRebuild(t *testing.T) {
+	s := openDedupStore(t, 10, 0)
+
+	// Several partitions store and look up events while the filter rebuilds
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				e := envelope.Envelope{EventId: fmt.Sprintf("event-%d-%d", worker, i), Message: consumer_structs.Message{Id: fmt.Sprint(worker), Value: 1}}
+				key := EventIdKey("", e.EventId)
+				if duplicate, err := s.SaveConsumedMessage("", e, key); err != nil || duplicate {
+					t.Errorf("SaveConsumedMessage(%s) = %v, %v on first delivery", e.EventId, duplicate, err)
+				}
+				if !s.seen.mayContain(key) {
+					t.Errorf("key %s missing right after it was stored", key)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	waitRebuilt(t, s.seen)
+
+	for worker := 0; worker < 4; worker++ {
+		for i := 0; i < 100; i++ {
+			if key := EventIdKey("", fmt.Sprintf("event-%d-%d", worker, i)); !s.seen.mayContain(key) {
+				t.Fatalf("key %s lost by a rebuild", key)
+			}
+		}
+	}
+	checkFalsePositives(t, s.seen)
+}
+
+// checkFalsePositives fails when the filter answers positive for most unknown keys, which would
+// hide lost keys behind an overfull filter.
+func checkFalsePositives(t *testing.T, set *seenSet) {
+	t.Helper()
+	positives := 0
+	for i := 0; i < 1000; i++ {
+		if set.mayContain(EventIdKey("", fmt.Sprint("unknown-", i))) {
+			positives++
+		}
+	}
+	if positives > 100 {
+		t.Errorf("%d of 1000 unknown keys reported as seen, the filter wasn't resized", positives)
+	}
+}
@@ -3,20 +3,40 @@ package store
 import (
 	"consumer/consumer_structs"
 	"consumer/helper"
+	"errors"
 	"fmt"
 	"github.com/dgraph-io/badger"
-	"log"
 	"os"
+	"shared/envelope"
+	"shared/logging"
 	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// eventKeyPrefix namespaces the event ids seen, away from the per-id aggregates
+	eventKeyPrefix  = "_event/"
+	defaultDedupTtl = 24 * time.Hour
+	// statsKeyPrefix namespaces the count, min and max kept next to each id's sum
+	statsKeyPrefix = "_stats/"
+
+	// KeySeparator separates the namespace of an id from the id in keys, ids can't contain it
+	KeySeparator = "/"
 )
 
 var (
 	storageService StorageService
+
+	// ErrInvalidId is returned for ids that can't be stored, their key would collide with another
+	// namespace's
+	ErrInvalidId = errors.New("id contains the key separator " + KeySeparator)
 )
 
 type StorageService struct {
 	ConsumerConfig consumer_structs.ConsumerConfig
 	Db             *badger.DB
+	seen           *seenSet
 }
 
 func GetService() *StorageService {
@@ -27,7 +47,7 @@ func InitiateStorageService() error {
 	consumerConfig := helper.LoadConsumerConfiguration(os.Getenv("APP_HOME") + "/config/config.json")
 	db, err := InitiateBadgerDB(consumerConfig)
 	if err != nil {
-		log.Printf("Consumer.InitiateStorageService. Error: [%v]", err)
+		logging.Error("Error in initiating storage service", logging.Err(err))
 		return err
 	}
 
@@ -35,6 +55,19 @@ func InitiateStorageService() error {
 		ConsumerConfig: consumerConfig,
 		Db:             db,
 	}
+	if err = storageService.backfillStats(); err != nil {
+		logging.Error("Error in backfilling id stats", logging.Err(err))
+		_ = db.Close()
+		return err
+	}
+	if consumerConfig.Dedup.Enabled {
+		dedup := consumerConfig.Dedup
+		if storageService.seen, err = newSeenSet(db, dedup.BloomCapacity, dedup.BloomFalsePositiveRate); err != nil {
+			logging.Error("Error in loading dedup seen-set", logging.Err(err))
+			_ = db.Close()
+			return err
+		}
+	}
 
 	return nil
 }
@@ -43,71 +76,157 @@ func InitiateBadgerDB(consumerConfig consumer_structs.ConsumerConfig) (*badger.D
 	opt := badger.DefaultOptions(consumerConfig.BadgerTempDir)
 	db, err := badger.Open(opt)
 	if err != nil {
-		log.Printf("consumer.store.InitiateBadgerDB: Error in opening badger DB connection. Err: [%v]", err)
+		logging.Error("Error in opening badger DB connection", logging.String("dir", consumerConfig.BadgerTempDir), logging.Err(err))
 		return nil, err
 	}
 	return db, nil
 }
 
-func (s *StorageService) SaveConsumedMessage(message consumer_structs.Message) error {
-	key := []byte(message.Id)
+// SaveConsumedMessage adds the event's value to the aggregate of its id in namespace. With dedup
+// enabled the seen-set key is recorded in the same transaction, so a redelivered event is
+// reported as a duplicate and not added twice. A nil seenKey skips dedup. Ids containing the key
+// separator are refused with ErrInvalidId.
+func (s *StorageService) SaveConsumedMessage(namespace string, event envelope.Envelope, seenKey []byte) (bool, error) {
+	message := event.Message
+	// "ns/x" in the default namespace would land on the key of x in namespace ns
+	if strings.Contains(message.Id, KeySeparator) {
+		return false, fmt.Errorf("id %q: %w", message.Id, ErrInvalidId)
+	}
+	key := valueKey(namespace, message.Id)
 	value := []byte(fmt.Sprintf("%.2f", message.Value))
 
 	txn := s.Db.NewTransaction(true)
 	defer txn.Discard()
 
+	if seenKey != nil && s.seen != nil {
+		if s.seen.mayContain(seenKey) {
+			_, er := txn.Get(seenKey)
+			if er == nil {
+				return true, nil
+			}
+			if er != badger.ErrKeyNotFound {
+				logging.Error("Error in looking up seen key", logging.String("key", string(seenKey)), logging.Err(er))
+				return false, er
+			}
+		}
+		if err := txn.SetEntry(badger.NewEntry(seenKey, nil).WithTTL(s.dedupTtl())); err != nil {
+			logging.Error("Error in recording seen key", logging.String("key", string(seenKey)), logging.Err(err))
+			return false, err
+		}
+	}
+
 	// Get the value for key first to check value already exists or not
 	entry, er := txn.Get(key)
 	if er != nil && er != badger.ErrKeyNotFound {
-		log.Printf("consumer.store.SaveConsumedMessage:Error in getting value from badgerDB for key [%v]. Error: [%v]", message.Id, er)
-		return er
+		logging.Error("Error in getting value from badger", logging.String("id", message.Id), logging.Err(er))
+		return false, er
 	}
 	if er == nil {
 		// previous entry found, add the value to the new value
 		prevValue, _ := entry.ValueCopy(nil)
-		log.Printf("Found value: [%v]", string(prevValue))
 		prevValueFloat, gErr := strconv.ParseFloat(string(prevValue), 64)
 		if gErr != nil {
-			log.Printf("consumer.store.SaveConsumedMessage: Error in converting []byte to float. Error: [%v]", gErr)
-			return gErr
+			logging.Error("Error in parsing stored value", logging.String("id", message.Id), logging.Err(gErr))
+			return false, gErr
 		}
 		value = []byte(fmt.Sprintf("%.2f", message.Value+prevValueFloat))
 	}
 
+	if err := s.updateStats(txn, namespace, message); err != nil {
+		return false, err
+	}
+
 	// Set the final value
 	if err := txn.Set(key, value); err != nil {
-		log.Printf("consumer.store.SaveConsumedMessage: Error in setting KV in badger db. Error: [%v]", err)
-		return err
+		logging.Error("Error in setting value in badger", logging.String("id", message.Id), logging.Err(err))
+		return false, err
 	}
 	if err := txn.Commit(); err != nil {
-		log.Printf("consumer.store.SaveConsumedMessage: Error in committing KV in badger db. Error: [%v]", err)
-		return err
+		logging.Error("Error in committing value in badger", logging.String("id", message.Id), logging.Err(err))
+		return false, err
+	}
+	if seenKey != nil && s.seen != nil {
+		s.seen.add(seenKey)
 	}
 
+	return false, nil
+}
+
+// updateStats folds the message's value into the count, min and max of its id.
+func (s *StorageService) updateStats(txn *badger.Txn, namespace string, message consumer_structs.Message) error {
+	key := statsKey(namespace, message.Id)
+	stats := idStats{Count: 1, Min: message.Value, Max: message.Value}
+	entry, er := txn.Get(key)
+	if er != nil && er != badger.ErrKeyNotFound {
+		logging.Error("Error in getting stats from badger", logging.String("id", message.Id), logging.Err(er))
+		return er
+	}
+	if er == nil {
+		prevStats, _ := entry.ValueCopy(nil)
+		prev, pErr := parseStats(prevStats)
+		if pErr != nil {
+			logging.Error("Error in parsing stored stats", logging.String("id", message.Id), logging.String("stats", string(prevStats)), logging.Err(pErr))
+			return pErr
+		}
+		stats = prev.add(message.Value)
+	}
+	if err := txn.Set(key, stats.encode()); err != nil {
+		logging.Error("Error in setting stats in badger", logging.String("id", message.Id), logging.Err(err))
+		return err
+	}
 	return nil
 }
 
-func (s *StorageService) GetValue(id string) (consumer_structs.Message, error) {
+// valueKey is the badger key of an id's aggregate, ids of the empty namespace are stored bare.
+func valueKey(namespace string, id string) []byte {
+	if namespace == "" {
+		return []byte(id)
+	}
+	return []byte(namespace + KeySeparator + id)
+}
+
+// dedupTtl is the dedup window.
+func (s *StorageService) dedupTtl() time.Duration {
+	if s.ConsumerConfig.Dedup.Ttl > 0 {
+		return time.Duration(s.ConsumerConfig.Dedup.Ttl) * time.Millisecond
+	}
+	return defaultDedupTtl
+}
+
+// Ping reads from badger, to check that it is open and readable.
+func (s *StorageService) Ping() error {
+	return s.Db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(statsKeyPrefix))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *StorageService) GetValue(namespace string, id string) (consumer_structs.Message, error) {
 	var message consumer_structs.Message
 	txn := s.Db.NewTransaction(false)
 	defer txn.Discard()
 
-	key := []byte(id)
+	key := valueKey(namespace, id)
 	entry, err := txn.Get(key)
 	if err != nil {
-		log.Printf("consumer.store.GetValue: Error in getting value from badgerDB for key [%v]. Error: [%v]", id, err)
+		// Unknown ids are an expected answer of the id api, not a store failure
+		if err != badger.ErrKeyNotFound {
+			logging.Error("Error in getting value from badger", logging.String("id", id), logging.Err(err))
+		}
 		return consumer_structs.Message{}, err
 	}
 	if err := txn.Commit(); err != nil {
-		log.Printf("consumer.store.GetValue: Error in committing KV read in badger db. Error: [%v]", err)
+		logging.Error("Error in committing read in badger", logging.Err(err))
 		return consumer_structs.Message{}, err
 	}
 
 	value, _ := entry.ValueCopy(nil)
-	log.Printf("Found value: [%v]", string(value))
 	valueFloat, gErr := strconv.ParseFloat(string(value), 64)
 	if gErr != nil {
-		log.Printf("consumer.store.GetValue: Error in converting []byte to float. Error: [%v]", gErr)
+		logging.Error("Error in parsing stored value", logging.String("id", id), logging.Err(gErr))
 		return consumer_structs.Message{}, gErr
 	}
 
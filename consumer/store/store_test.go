@@ -0,0 +1,68 @@
+package store
+
+import (
+	"consumer/consumer_structs"
+	"errors"
+	"shared/envelope"
+	"testing"
+)
+
+func save(t *testing.T, s *StorageService, namespace string, id string, value float64) error {
+	t.Helper()
+	_, err := s.SaveConsumedMessage(namespace, envelope.Envelope{Message: consumer_structs.Message{Id: id, Value: value}}, nil)
+	return err
+}
+
+func TestNamespacedKeys(t *testing.T) {
+	s := openTestStore(t)
+	for _, message := range []struct {
+		namespace string
+		value     float64
+	}{{"", 1}, {"orders", 2}, {"orders", 3}, {"returns", 4}} {
+		if err := save(t, s, message.namespace, "42", message.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for namespace, want := range map[string]float64{"": 1, "orders": 5, "returns": 4} {
+		message, err := s.GetValue(namespace, "42")
+		if err != nil || message.Value != want {
+			t.Errorf("GetValue(%q) = %v, %v, want %v", namespace, message.Value, err, want)
+		}
+	}
+}
+
+func TestSaveRejectsKeySeparator(t *testing.T) {
+	s := openTestStore(t)
+	// In the default namespace "orders/42" would be stored on the key of 42 in namespace orders
+	if err := save(t, s, "", "orders/42", 1); !errors.Is(err, ErrInvalidId) {
+		t.Errorf("SaveConsumedMessage = %v, want ErrInvalidId", err)
+	}
+	if _, err := s.GetValue("orders", "42"); err == nil {
+		t.Error("the rejected id was stored in another namespace")
+	}
+}
+
+func TestSplitValueKey(t *testing.T) {
+	namespaces := []string{"", "orders", "orders/eu"}
+	tests := []struct {
+		key           string
+		namespace, id string
+	}{
+		{"42", "", "42"},
+		{"orders/42", "orders", "42"},
+		// The longest namespace wins
+		{"orders/eu/42", "orders/eu", "42"},
+		// Ids stored before the separator was rejected belong to the empty namespace
+		{"payments/42", "", "payments/42"},
+	}
+	for _, tt := range tests {
+		namespace, id := splitValueKey([]byte(tt.key), namespaces)
+		if namespace != tt.namespace || id != tt.id {
+			t.Errorf("splitValueKey(%s) = %q, %q, want %q, %q", tt.key, namespace, id, tt.namespace, tt.id)
+		}
+		if key := string(valueKey(namespace, id)); key != tt.key {
+			t.Errorf("valueKey(%q, %q) = %s, want %s", namespace, id, key, tt.key)
+		}
+	}
+}
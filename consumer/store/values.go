@@ -0,0 +1,198 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"shared/logging"
+	"strconv"
+	"strings"
+)
+
+// IdValue is the aggregate the consumer holds for an id of a namespace.
+type IdValue struct {
+	Namespace string
+	Id        string
+	Sum       float64
+	Count     float64
+	Min       float64
+	Max       float64
+}
+
+// idStats is stored as "<count>,<min>,<max>" under the stats key of an id.
+type idStats struct {
+	Count float64
+	Min   float64
+	Max   float64
+}
+
+func (stats idStats) add(value float64) idStats {
+	stats.Count++
+	if value < stats.Min {
+		stats.Min = value
+	}
+	if value > stats.Max {
+		stats.Max = value
+	}
+	return stats
+}
+
+func (stats idStats) encode() []byte {
+	return []byte(strconv.FormatFloat(stats.Count, 'f', -1, 64) + "," +
+		strconv.FormatFloat(stats.Min, 'f', -1, 64) + "," +
+		strconv.FormatFloat(stats.Max, 'f', -1, 64))
+}
+
+func parseStats(value []byte) (idStats, error) {
+	fields := strings.Split(string(value), ",")
+	if len(fields) != 3 {
+		return idStats{}, fmt.Errorf("expected 3 fields, got %d", len(fields))
+	}
+	var numbers [3]float64
+	for i, field := range fields {
+		number, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return idStats{}, err
+		}
+		numbers[i] = number
+	}
+	return idStats{Count: numbers[0], Min: numbers[1], Max: numbers[2]}, nil
+}
+
+func statsKey(namespace string, id string) []byte {
+	return append([]byte(statsKeyPrefix), valueKey(namespace, id)...)
+}
+
+// backfillStats gives the ids stored before stats were kept stats of their own, so that every id
+// is exported from the start. Only the sum of their earlier values is known, it is counted as a
+// single value which is also the id's min and max.
+func (s *StorageService) backfillStats() error {
+	batch := s.Db.NewWriteBatch()
+	defer batch.Cancel()
+
+	backfilled := 0
+	err := s.Db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if isInternalKey(item.Key()) {
+				continue
+			}
+			key := append([]byte(statsKeyPrefix), item.Key()...)
+			if _, err := txn.Get(key); err != badger.ErrKeyNotFound {
+				// err is nil for ids that already have stats
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			raw, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			sum, err := strconv.ParseFloat(string(raw), 64)
+			if err != nil {
+				return fmt.Errorf("value of [%s]: %v", item.Key(), err)
+			}
+			if err := batch.Set(key, idStats{Count: 1, Min: sum, Max: sum}.encode()); err != nil {
+				return err
+			}
+			backfilled++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+	if backfilled > 0 {
+		logging.Info("Backfilled stats of ids stored before stats were kept", logging.Int("ids", backfilled))
+	}
+	return nil
+}
+
+// isInternalKey reports whether key holds dedup or stats bookkeeping rather than an id's sum.
+func isInternalKey(key []byte) bool {
+	for _, prefix := range []string{eventKeyPrefix, hashKeyPrefix, statsKeyPrefix} {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanValues reads the aggregates of at most limit ids, in key order, from a read-only snapshot
+// that doesn't hold up writes. It also returns how many ids were left out by the limit, a limit of
+// zero or less reads every id.
+func (s *StorageService) ScanValues(namespaces []string, limit int) ([]IdValue, int, error) {
+	var values []IdValue
+	skipped := 0
+	err := s.Db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(statsKeyPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if limit > 0 && len(values) >= limit {
+				skipped++
+				continue
+			}
+			item := it.Item()
+			namespace, id := splitValueKey(bytes.TrimPrefix(item.Key(), prefix), namespaces)
+			raw, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			stats, err := parseStats(raw)
+			if err != nil {
+				return fmt.Errorf("stats of [%s]: %v", item.Key(), err)
+			}
+			sumEntry, err := txn.Get(valueKey(namespace, id))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			rawSum, err := sumEntry.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			sum, err := strconv.ParseFloat(string(rawSum), 64)
+			if err != nil {
+				return fmt.Errorf("value of [%s]: %v", id, err)
+			}
+			values = append(values, IdValue{
+				Namespace: namespace,
+				Id:        id,
+				Sum:       sum,
+				Count:     stats.Count,
+				Min:       stats.Min,
+				Max:       stats.Max,
+			})
+		}
+		return nil
+	})
+	return values, skipped, err
+}
+
+// splitValueKey reverses valueKey. Ids stored before slashes were rejected may contain them, so a
+// key is only split off at the longest known namespace it starts with and belongs to the empty
+// namespace otherwise.
+func splitValueKey(key []byte, namespaces []string) (string, string) {
+	match := ""
+	for _, namespace := range namespaces {
+		if namespace != "" && len(namespace) > len(match) && bytes.HasPrefix(key, []byte(namespace+KeySeparator)) {
+			match = namespace
+		}
+	}
+	if match == "" {
+		return "", string(key)
+	}
+	return match, string(key[len(match)+1:])
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"consumer/consumer_structs"
+	"github.com/dgraph-io/badger"
+	"shared/envelope"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *StorageService {
+	t.Helper()
+	db, err := InitiateBadgerDB(consumer_structs.ConsumerConfig{BadgerTempDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return &StorageService{Db: db}
+}
+
+func TestBackfillStats(t *testing.T) {
+	s := openTestStore(t)
+	// An id stored before stats were kept, next to one that has them
+	if err := s.Db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(valueKey("orders", "old"), []byte("12.50")); err != nil {
+			return err
+		}
+		return txn.Set(append([]byte(eventKeyPrefix), "orders/event"...), nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SaveConsumedMessage("orders", envelope.Envelope{Message: consumer_structs.Message{Id: "new", Value: 3}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SaveConsumedMessage("orders", envelope.Envelope{Message: consumer_structs.Message{Id: "new", Value: 5}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	values, _, err := s.ScanValues([]string{"orders"}, 0)
+	if err != nil || len(values) != 1 {
+		t.Fatalf("ScanValues = %v, %v before the backfill, want only the new id", values, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.backfillStats(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, _, err = s.ScanValues([]string{"orders"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []IdValue{
+		{Namespace: "orders", Id: "new", Sum: 8, Count: 2, Min: 3, Max: 5},
+		{Namespace: "orders", Id: "old", Sum: 12.5, Count: 1, Min: 12.5, Max: 12.5},
+	}
+	if len(values) != len(want) {
+		t.Fatalf("ScanValues = %v, want %v", values, want)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Errorf("value %d = %+v, want %+v", i, values[i], want[i])
+		}
+	}
+}
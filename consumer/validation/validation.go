@@ -0,0 +1,149 @@
+package validation
+
+import (
+	"consumer/consumer_structs"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"regexp"
+	"shared/envelope"
+	"shared/serde"
+)
+
+// Rules, used as the rule label of rejected messages
+const (
+	RuleMaxPayloadBytes = "max_payload_bytes"
+	RuleRequired        = "required"
+	RuleIdPattern       = "id_pattern"
+	RuleFinite          = "finite"
+	RuleValueMin        = "value_min"
+	RuleValueMax        = "value_max"
+
+	// sampleBytes caps how much of a rejected payload is logged
+	sampleBytes = 256
+)
+
+var (
+	RejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "message_rejected",
+		Help:      "Counter for consumed messages rejected by validation by topic handler and rule",
+	}, []string{"handler", "rule"})
+)
+
+// Rejection explains why a message failed validation.
+type Rejection struct {
+	Rule   string
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return r.Rule + ": " + r.Reason
+}
+
+// Validator checks consumed messages against the configured rules. A zero valued rule is not
+// checked, so an empty config accepts everything.
+type Validator struct {
+	handler   string
+	config    consumer_structs.ValidationConfig
+	idPattern *regexp.Regexp
+}
+
+func NewValidator(handler string, config consumer_structs.ValidationConfig) (*Validator, error) {
+	v := &Validator{handler: handler, config: config}
+	if config.IdPattern != "" {
+		pattern, err := regexp.Compile(config.IdPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id_pattern: %w", err)
+		}
+		v.idPattern = pattern
+	}
+	for _, field := range config.RequiredFields {
+		if !knownField(field) {
+			return nil, fmt.Errorf("unknown required field %q", field)
+		}
+	}
+	return v, nil
+}
+
+// CheckPayload runs the rules that don't need the decoded message, so oversized payloads are
+// rejected before they are decoded.
+func (v *Validator) CheckPayload(data []byte) error {
+	if v.config.MaxPayloadBytes > 0 && len(data) > v.config.MaxPayloadBytes {
+		return v.reject(RuleMaxPayloadBytes, "payload is %d bytes, limit is %d", len(data), v.config.MaxPayloadBytes)
+	}
+	return nil
+}
+
+// CheckMessage runs the rules on a decoded message. Binary encodings always carry every field,
+// so for them a required field only has to be non-empty.
+func (v *Validator) CheckMessage(encoding string, data []byte, e envelope.Envelope) error {
+	if len(v.config.RequiredFields) > 0 {
+		var present map[string]json.RawMessage
+		if encoding == serde.JSON {
+			// Decoding succeeded, so this is a JSON object
+			_ = json.Unmarshal(data, &present)
+		}
+		for _, field := range v.config.RequiredFields {
+			if present != nil {
+				if raw, ok := present[field]; !ok || string(raw) == "null" {
+					return v.reject(RuleRequired, "field '%s' is missing", field)
+				}
+			}
+			if isEmpty(field, e) {
+				return v.reject(RuleRequired, "field '%s' is empty", field)
+			}
+		}
+	}
+	if v.idPattern != nil && !v.idPattern.MatchString(e.Id) {
+		return v.reject(RuleIdPattern, "id %q doesn't match %s", e.Id, v.config.IdPattern)
+	}
+	if v.config.Finite && (math.IsNaN(e.Value) || math.IsInf(e.Value, 0)) {
+		return v.reject(RuleFinite, "value %v is not a finite number", e.Value)
+	}
+	if v.config.ValueMin != nil && e.Value < *v.config.ValueMin {
+		return v.reject(RuleValueMin, "value %v is below %v", e.Value, *v.config.ValueMin)
+	}
+	if v.config.ValueMax != nil && e.Value > *v.config.ValueMax {
+		return v.reject(RuleValueMax, "value %v is above %v", e.Value, *v.config.ValueMax)
+	}
+	return nil
+}
+
+// Sample returns the start of a payload, for logging rejected messages.
+func Sample(data []byte) string {
+	if len(data) > sampleBytes {
+		return string(data[:sampleBytes]) + "..."
+	}
+	return string(data)
+}
+
+func (v *Validator) reject(rule string, format string, args ...interface{}) *Rejection {
+	RejectedCounter.WithLabelValues(v.handler, rule).Inc()
+	return &Rejection{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+}
+
+func knownField(field string) bool {
+	switch field {
+	case "id", "value", "event_id", "event_time", "source":
+		return true
+	}
+	return false
+}
+
+// isEmpty reports whether a field holds its zero value. Zero is a valid value, so value is
+// only ever missing, never empty.
+func isEmpty(field string, e envelope.Envelope) bool {
+	switch field {
+	case "id":
+		return e.Id == ""
+	case "event_id":
+		return e.EventId == ""
+	case "event_time":
+		return e.EventTime.IsZero()
+	case "source":
+		return e.Source == ""
+	}
+	return false
+}
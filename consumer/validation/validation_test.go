@@ -0,0 +1,124 @@
+package validation
+
+import (
+	"consumer/consumer_structs"
+	"errors"
+	"math"
+	"shared/envelope"
+	"shared/serde"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newValidator(t *testing.T, config consumer_structs.ValidationConfig) *Validator {
+	t.Helper()
+	v, err := NewValidator("default", config)
+	if err != nil {
+		t.Fatalf("NewValidator: %v", err)
+	}
+	return v
+}
+
+// rule returns the rule that rejected a message, or an empty string when it was accepted.
+func rule(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var rejection *Rejection
+	if !errors.As(err, &rejection) {
+		t.Fatalf("error %v is not a Rejection", err)
+	}
+	return rejection.Rule
+}
+
+func TestEmptyConfigAcceptsEverything(t *testing.T) {
+	v := newValidator(t, consumer_structs.ValidationConfig{})
+	if err := v.CheckPayload(make([]byte, 1<<20)); err != nil {
+		t.Errorf("CheckPayload: %v", err)
+	}
+	e := envelope.Envelope{Message: envelope.Message{Value: math.NaN()}}
+	if err := v.CheckMessage(serde.JSON, []byte(`{}`), e); err != nil {
+		t.Errorf("CheckMessage: %v", err)
+	}
+}
+
+func TestCheckPayload(t *testing.T) {
+	v := newValidator(t, consumer_structs.ValidationConfig{MaxPayloadBytes: 10})
+	if got := rule(t, v.CheckPayload(make([]byte, 10))); got != "" {
+		t.Errorf("payload at the limit rejected by %s", got)
+	}
+	if got := rule(t, v.CheckPayload(make([]byte, 11))); got != RuleMaxPayloadBytes {
+		t.Errorf("rule = %q, want %q", got, RuleMaxPayloadBytes)
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	min, max := 0.0, 100.0
+	v := newValidator(t, consumer_structs.ValidationConfig{
+		RequiredFields: []string{"id", "value"},
+		IdPattern:      `^[0-9]+$`,
+		ValueMin:       &min,
+		ValueMax:       &max,
+		Finite:         true,
+	})
+	message := func(id string, value float64) envelope.Envelope {
+		return envelope.Envelope{Message: envelope.Message{Id: id, Value: value}}
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		data     string
+		message  envelope.Envelope
+		want     string
+	}{
+		{"valid", serde.JSON, `{"id": "42", "value": 0}`, message("42", 0), ""},
+		{"missing value", serde.JSON, `{"id": "42"}`, message("42", 0), RuleRequired},
+		{"null value", serde.JSON, `{"id": "42", "value": null}`, message("42", 0), RuleRequired},
+		{"empty id", serde.JSON, `{"id": "", "value": 1}`, message("", 1), RuleRequired},
+		{"binary encodings carry every field", serde.Protobuf, "", message("42", 0), ""},
+		{"empty id in a binary encoding", serde.Avro, "", message("", 1), RuleRequired},
+		{"id pattern", serde.JSON, `{"id": "abc", "value": 1}`, message("abc", 1), RuleIdPattern},
+		{"not finite", serde.Protobuf, "", message("42", math.Inf(1)), RuleFinite},
+		{"below min", serde.JSON, `{"id": "42", "value": -1}`, message("42", -1), RuleValueMin},
+		{"above max", serde.JSON, `{"id": "42", "value": 101}`, message("42", 101), RuleValueMax},
+		{"at max", serde.JSON, `{"id": "42", "value": 100}`, message("42", 100), ""},
+	}
+	for _, tt := range tests {
+		if got := rule(t, v.CheckMessage(tt.encoding, []byte(tt.data), tt.message)); got != tt.want {
+			t.Errorf("%s: rule = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredEnvelopeFields(t *testing.T) {
+	v := newValidator(t, consumer_structs.ValidationConfig{RequiredFields: []string{"event_id", "event_time", "source"}})
+	e := envelope.New(envelope.Message{Id: "1"}, "producer-1")
+	if err := v.CheckMessage(serde.Protobuf, nil, e); err != nil {
+		t.Errorf("complete envelope rejected: %v", err)
+	}
+	e.EventTime = time.Time{}
+	if err := v.CheckMessage(serde.Protobuf, nil, e); err == nil || !strings.Contains(err.Error(), "event_time") {
+		t.Errorf("CheckMessage = %v, want event_time reported", err)
+	}
+}
+
+func TestNewValidatorRejectsBadConfig(t *testing.T) {
+	if _, err := NewValidator("default", consumer_structs.ValidationConfig{IdPattern: "("}); err == nil {
+		t.Error("accepted an invalid id_pattern")
+	}
+	if _, err := NewValidator("default", consumer_structs.ValidationConfig{RequiredFields: []string{"name"}}); err == nil {
+		t.Error("accepted an unknown required field")
+	}
+}
+
+func TestSample(t *testing.T) {
+	if got := Sample([]byte("short")); got != "short" {
+		t.Errorf("Sample = %q, want the whole payload", got)
+	}
+	if got := Sample(make([]byte, 1000)); len(got) != sampleBytes+3 || !strings.HasSuffix(got, "...") {
+		t.Errorf("Sample is %d bytes, want %d and an ellipsis", len(got), sampleBytes+3)
+	}
+}
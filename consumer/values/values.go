@@ -0,0 +1,106 @@
+package values
+
+import (
+	"consumer/store"
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"shared/logging"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = 30 * time.Second
+	defaultMaxIds   = 1000
+)
+
+var (
+	valueDesc = prometheus.NewDesc(
+		"consumer_id_value",
+		"Aggregate the consumer holds for an id by stat: sum, count, min and max of the consumed values",
+		[]string{"namespace", "id", "stat"}, nil)
+	ScrapeErrorCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "consumer",
+		Name:      "id_value_scrape_errors",
+		Help:      "Counter for failed scans of the id values",
+	})
+	ScrapeDurationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "consumer",
+		Name:      "id_value_scrape_duration_seconds",
+		Help:      "Duration of the last scan of the id values",
+	})
+	TruncatedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "consumer",
+		Name:      "id_value_ids_truncated",
+		Help:      "Ids left out of consumer_id_value by the cardinality cap in the last scan",
+	})
+)
+
+// Collector exports the per-id aggregates of the store as consumer_id_value. Badger is scanned
+// every interval in the background and scrapes are served from the last scan, so a scrape neither
+// waits for nor adds to the load of the store. At most maxIds ids are exported.
+type Collector struct {
+	store      *store.StorageService
+	namespaces []string
+	interval   time.Duration
+	maxIds     int
+
+	mu     sync.Mutex
+	values []store.IdValue
+}
+
+func NewCollector(storageSvc *store.StorageService, namespaces []string, interval time.Duration, maxIds int) *Collector {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if maxIds <= 0 {
+		maxIds = defaultMaxIds
+	}
+	return &Collector{store: storageSvc, namespaces: namespaces, interval: interval, maxIds: maxIds}
+}
+
+// Run scans every interval until ctx is done.
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.scan()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- valueDesc
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, value := range c.values {
+		ch <- prometheus.MustNewConstMetric(valueDesc, prometheus.GaugeValue, value.Sum, value.Namespace, value.Id, "sum")
+		ch <- prometheus.MustNewConstMetric(valueDesc, prometheus.GaugeValue, value.Count, value.Namespace, value.Id, "count")
+		ch <- prometheus.MustNewConstMetric(valueDesc, prometheus.GaugeValue, value.Min, value.Namespace, value.Id, "min")
+		ch <- prometheus.MustNewConstMetric(valueDesc, prometheus.GaugeValue, value.Max, value.Namespace, value.Id, "max")
+	}
+}
+
+// scan replaces the exported values, a failed scan keeps exporting the previous ones.
+func (c *Collector) scan() {
+	startTime := time.Now()
+	values, truncated, err := c.store.ScanValues(c.namespaces, c.maxIds)
+	ScrapeDurationGauge.Set(time.Since(startTime).Seconds())
+	if err != nil {
+		logging.Error("Error in scanning id values", logging.Err(err))
+		ScrapeErrorCounter.Inc()
+		return
+	}
+	TruncatedGauge.Set(float64(truncated))
+
+	c.mu.Lock()
+	c.values = values
+	c.mu.Unlock()
+}
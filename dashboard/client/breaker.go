@@ -0,0 +1,87 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit states, exported as the value of http_client_circuit_state
+const (
+	stateClosed   = 0
+	stateHalfOpen = 1
+	stateOpen     = 2
+)
+
+// breaker opens after threshold consecutive failures and rejects requests for openFor. Then a
+// single probe is let through, its success closes the circuit and its failure opens it again.
+type breaker struct {
+	host      string
+	threshold int
+	openFor   time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(host string, threshold int, openFor time.Duration) *breaker {
+	b := &breaker{host: host, threshold: threshold, openFor: openFor}
+	CircuitStateGauge.WithLabelValues(host).Set(stateClosed)
+	return b
+}
+
+// allow reports whether a request may be sent, callers report its result with record.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.setState(stateHalfOpen)
+		b.probing = true
+		return true
+	case stateHalfOpen:
+		// Only the probe is sent while half open
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record counts the result of an allowed request.
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		b.setState(stateClosed)
+		return
+	}
+	b.failures++
+	if b.state == stateHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(stateOpen)
+	}
+}
+
+// release lets another probe through when an allowed request ended without a result.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// setState updates the gauge, callers hold mu.
+func (b *breaker) setState(state int) {
+	b.state = state
+	CircuitStateGauge.WithLabelValues(b.host).Set(float64(state))
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+	"time"
+)
+
+func checkState(t *testing.T, b *breaker, want int) {
+	t.Helper()
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+	if state != want {
+		t.Errorf("state = %d, want %d", state, want)
+	}
+	var gauge dto.Metric
+	if err := CircuitStateGauge.WithLabelValues(b.host).Write(&gauge); err != nil {
+		t.Fatal(err)
+	}
+	if value := gauge.GetGauge().GetValue(); value != float64(want) {
+		t.Errorf("gauge = %v, want %d", value, want)
+	}
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := newBreaker("opens", 3, time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatal("closed breaker rejected a request")
+		}
+		b.record(false)
+	}
+	checkState(t, b, stateClosed)
+
+	// A success resets the consecutive failures
+	b.record(true)
+	for i := 0; i < 3; i++ {
+		b.allow()
+		b.record(false)
+	}
+	checkState(t, b, stateOpen)
+	if b.allow() {
+		t.Error("open breaker allowed a request")
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	b := newBreaker("probe", 1, 10*time.Millisecond)
+	b.allow()
+	b.record(false)
+	checkState(t, b, stateOpen)
+
+	time.Sleep(20 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker didn't let a probe through after the open duration")
+	}
+	checkState(t, b, stateHalfOpen)
+	if b.allow() {
+		t.Error("half open breaker allowed a second request next to the probe")
+	}
+
+	// A failed probe opens the circuit again right away
+	b.record(false)
+	checkState(t, b, stateOpen)
+	if b.allow() {
+		t.Error("breaker allowed a request right after a failed probe")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	b.allow()
+	b.record(true)
+	checkState(t, b, stateClosed)
+	if !b.allow() || !b.allow() {
+		t.Error("closed breaker rejected requests")
+	}
+}
+
+func TestBreakerReleaseLetsAnotherProbeThrough(t *testing.T) {
+	b := newBreaker("release", 1, 10*time.Millisecond)
+	b.allow()
+	b.record(false)
+	time.Sleep(20 * time.Millisecond)
+	b.allow()
+
+	// The probe was cancelled, which says nothing about the host
+	b.release()
+	checkState(t, b, stateHalfOpen)
+	if !b.allow() {
+		t.Error("breaker didn't let another probe through after a release")
+	}
+}
@@ -0,0 +1,307 @@
+// Package client is the http client of the dashboard for its data host. Requests are bounded by
+// connect and request timeouts, failed attempts are retried with backoff and a circuit breaker per
+// host stops sending to a host that keeps failing.
+package client
+
+import (
+	"context"
+	"dashboard/dashboard_structs"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"shared/tracing"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultConnectTimeout   = 1 * time.Second
+	defaultRequestTimeout   = 5 * time.Second
+	defaultKeepAlive        = 30 * time.Second
+	defaultIdleConnTimeout  = 90 * time.Second
+	defaultMaxIdleConns     = 100
+	defaultMaxIdlePerHost   = 10
+	defaultMaxResponseBytes = 1 << 20
+	defaultMaxAttempts      = 3
+	defaultInitialBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff       = 2 * time.Second
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 10 * time.Second
+
+	// maxDrainBytes bounds what is read of an unwanted body to reuse its connection, larger
+	// bodies are cheaper to drop with their connection
+	maxDrainBytes = 64 << 10
+
+	// Error classes of failed attempts, errorNone for attempts that got a response
+	errorNone     = "none"
+	errorTimeout  = "timeout"
+	errorCanceled = "canceled"
+	errorRefused  = "connection_refused"
+	errorReset    = "connection_reset"
+	errorDNS      = "dns"
+	errorOther    = "other"
+)
+
+var (
+	// ErrCircuitOpen is returned without sending while the breaker of the host is open.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	RetryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dashboard",
+		Name:      "http_client_retries",
+		Help:      "Counter for retried data host requests by host",
+	}, []string{"host"})
+	CircuitStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dashboard",
+		Name:      "http_client_circuit_state",
+		Help:      "State of the circuit breaker by host, 0 closed, 1 half open and 2 open",
+	}, []string{"host"})
+	CircuitRejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dashboard",
+		Name:      "http_client_circuit_rejected",
+		Help:      "Counter for data host requests rejected without sending by an open circuit breaker by host",
+	}, []string{"host"})
+
+	tracer = tracing.Tracer("dashboard/client")
+)
+
+// NewRequestDurationHistogram creates the attempt latency histogram of a client with custom
+// buckets, to be registered by the service.
+func NewRequestDurationHistogram(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dashboard",
+		Name:      "http_client_request_duration_seconds",
+		Help:      "Latency of every data host request attempt by host, status code and error class",
+		Buckets:   buckets,
+	}, []string{"host", "code", "error_class"})
+}
+
+// Response is a response whose body has been read and closed.
+type Response struct {
+	StatusCode int
+	Body       []byte
+}
+
+// Client sends requests to the data host. It is safe for concurrent use.
+type Client struct {
+	http             *http.Client
+	requestDuration  *prometheus.HistogramVec
+	maxResponseBytes int64
+	maxAttempts      int
+	initialBackoff   time.Duration
+	maxBackoff       time.Duration
+	failureThreshold int
+	openDuration     time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// New creates a client with its own connection pool, zero values of config take the defaults.
+// Every attempt is observed in requestDuration, see NewRequestDurationHistogram.
+func New(config dashboard_structs.ClientConfig, requestDuration *prometheus.HistogramVec) *Client {
+	millis := func(value int64, defaultValue time.Duration) time.Duration {
+		if value > 0 {
+			return time.Duration(value) * time.Millisecond
+		}
+		return defaultValue
+	}
+	orDefault := func(value int, defaultValue int) int {
+		if value > 0 {
+			return value
+		}
+		return defaultValue
+	}
+
+	connectTimeout := millis(config.ConnectTimeout, defaultConnectTimeout)
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: millis(config.KeepAlive, defaultKeepAlive),
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          orDefault(config.MaxIdleConns, defaultMaxIdleConns),
+		MaxIdleConnsPerHost:   orDefault(config.MaxIdleConnsPerHost, defaultMaxIdlePerHost),
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       millis(config.IdleConnTimeout, defaultIdleConnTimeout),
+		TLSHandshakeTimeout:   connectTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	maxResponseBytes := config.MaxResponseBytes
+	if maxResponseBytes <= 0 {
+		maxResponseBytes = defaultMaxResponseBytes
+	}
+	initialBackoff := millis(config.Retry.InitialBackoff, defaultInitialBackoff)
+	maxBackoff := millis(config.Retry.MaxBackoff, defaultMaxBackoff)
+	if maxBackoff < initialBackoff {
+		maxBackoff = initialBackoff
+	}
+
+	return &Client{
+		// The client timeout covers a whole attempt, from dialing to reading the body
+		http:             &http.Client{Transport: transport, Timeout: millis(config.RequestTimeout, defaultRequestTimeout)},
+		requestDuration:  requestDuration,
+		maxResponseBytes: maxResponseBytes,
+		maxAttempts:      orDefault(config.Retry.MaxAttempts, defaultMaxAttempts),
+		initialBackoff:   initialBackoff,
+		maxBackoff:       maxBackoff,
+		failureThreshold: orDefault(config.Breaker.FailureThreshold, defaultFailureThreshold),
+		openDuration:     millis(config.Breaker.OpenDuration, defaultOpenDuration),
+		breakers:         make(map[string]*breaker),
+	}
+}
+
+// Get fetches rawURL, retrying attempts that fail or get a retryable status with backoff. The last
+// response is returned whatever its status, an error when the last attempt got no response or ctx
+// ended while backing off.
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b := c.breaker(target.Host)
+
+	var res *Response
+	for attempt := 1; ; attempt++ {
+		if !b.allow() {
+			CircuitRejectedCounter.WithLabelValues(target.Host).Inc()
+			return nil, fmt.Errorf("%w for %v", ErrCircuitOpen, target.Host)
+		}
+		startTime := time.Now()
+		res, err = c.attempt(ctx, rawURL)
+		code, class := strconv.Itoa(statusCode(res)), errorNone
+		if err != nil {
+			code, class = errorNone, errorClass(err)
+		}
+		tracing.Observe(ctx, c.requestDuration.WithLabelValues(target.Host, code, class), time.Since(startTime).Seconds())
+
+		// A cancelled caller says nothing about the host
+		if class == errorCanceled {
+			b.release()
+		} else {
+			b.record(err == nil && res.StatusCode < http.StatusInternalServerError)
+		}
+		if !retryable(res, err) || attempt >= c.maxAttempts || ctx.Err() != nil {
+			return res, err
+		}
+		RetryCounter.WithLabelValues(target.Host).Inc()
+		if err := sleep(ctx, c.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Probe fetches rawURL once, bypassing retries and the breaker, for health checks.
+func (c *Client) Probe(ctx context.Context, rawURL string) (*Response, error) {
+	return c.attempt(ctx, rawURL)
+}
+
+// attempt sends a single request in a client span and reads its body, draining what is left of
+// it so that the connection goes back to the pool.
+func (c *Client) attempt(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, span := tracing.StartClientSpan(ctx, tracer, req)
+	res, err := c.http.Do(req)
+	tracing.EndClientSpan(span, res, err)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxDrainBytes))
+		_ = res.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, c.maxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > c.maxResponseBytes {
+		return nil, fmt.Errorf("response body exceeds %d bytes", c.maxResponseBytes)
+	}
+	return &Response{StatusCode: res.StatusCode, Body: body}, nil
+}
+
+// breaker returns the circuit breaker of host, creating it on first use.
+func (c *Client) breaker(host string) *breaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[host]
+	if !ok {
+		b = newBreaker(host, c.failureThreshold, c.openDuration)
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// backoff doubles the delay after every attempt up to maxBackoff, with full jitter so that
+// dashboards don't retry in lockstep.
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.initialBackoff << (attempt - 1)
+	if delay <= 0 || delay > c.maxBackoff {
+		delay = c.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryable reports whether another attempt may succeed. Requests are GETs, so a failed attempt
+// can be repeated safely.
+func retryable(res *Response, err error) bool {
+	if err != nil {
+		return errorClass(err) != errorCanceled
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func statusCode(res *Response) int {
+	if res == nil {
+		return 0
+	}
+	return res.StatusCode
+}
+
+// errorClass maps err to a small set of label values.
+func errorClass(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errorCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorTimeout
+	case errors.As(err, &dnsErr):
+		return errorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorReset
+	default:
+		return errorOther
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"dashboard/dashboard_structs"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestClient(config dashboard_structs.ClientConfig) *Client {
+	config.Retry.InitialBackoff = 1
+	config.Retry.MaxBackoff = 1
+	return New(config, NewRequestDurationHistogram([]float64{0.1}))
+}
+
+func TestGetRetriesRetryableStatus(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("42"))
+	}))
+	defer server.Close()
+
+	res, err := newTestClient(dashboard_structs.ClientConfig{}).Get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || string(res.Body) != "42" || requests != 3 {
+		t.Errorf("got %d %q after %d requests, want 200 \"42\" after 3", res.StatusCode, res.Body, requests)
+	}
+}
+
+func TestGetDoesNotRetryClientErrors(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	res, err := newTestClient(dashboard_structs.ClientConfig{}).Get(context.Background(), server.URL)
+	if err != nil || res.StatusCode != http.StatusNotFound || requests != 1 {
+		t.Errorf("got %v, %v after %d requests, want a single 404", res, err, requests)
+	}
+}
+
+func TestGetOpensCircuit(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := newTestClient(dashboard_structs.ClientConfig{Breaker: dashboard_structs.BreakerConfig{FailureThreshold: 2, OpenDuration: 60000}})
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(context.Background(), server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Get(context.Background(), server.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Get = %v, want ErrCircuitOpen", err)
+	}
+	if requests != 2 {
+		t.Errorf("%d requests reached the host, want 2", requests)
+	}
+}
+
+func TestGetLimitsResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, 100))
+	}))
+	defer server.Close()
+
+	c := newTestClient(dashboard_structs.ClientConfig{MaxResponseBytes: 10, Retry: dashboard_structs.RetryConfig{MaxAttempts: 1}})
+	if _, err := c.Get(context.Background(), server.URL); err == nil {
+		t.Error("Get accepted a body above max_response_bytes")
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	c := newTestClient(dashboard_structs.ClientConfig{Retry: dashboard_structs.RetryConfig{MaxAttempts: 1}})
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	_, err := c.Probe(context.Background(), url)
+	if class := errorClass(err); class != errorRefused {
+		t.Errorf("errorClass(%v) = %s, want %s", err, class, errorRefused)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Get(ctx, url)
+	if class := errorClass(err); class != errorCanceled {
+		t.Errorf("errorClass(%v) = %s, want %s", err, class, errorCanceled)
+	}
+	if retryable(nil, err) {
+		t.Error("a cancelled request is retryable")
+	}
+}
@@ -1,8 +1,70 @@
 package dashboard_structs
 
+import (
+	"shared/labels"
+	"shared/logging"
+	"shared/tracing"
+)
+
 type DashboardConfig struct {
-	AppName         string   `json:"app_name"`
-	DataHost        string   `json:"data_host"`
-	RequestInterval int64    `json:"request_interval"`
-	UniqueIds       []string `json:"unique_ids"`
+	AppName         string         `json:"app_name"`
+	DataHost        string         `json:"data_host"`
+	RequestInterval int64          `json:"request_interval"`
+	UniqueIds       []string       `json:"unique_ids"`
+	Metrics         MetricsConfig  `json:"metrics"`
+	Tracing         tracing.Config `json:"tracing"`
+	Logging         logging.Config `json:"logging"`
+	Admin           AdminConfig    `json:"admin"`
+	Health          HealthConfig   `json:"health"`
+	Client          ClientConfig   `json:"client"`
+}
+
+// ClientConfig tunes the http client of the data host, durations are in milliseconds and zero
+// values take the defaults. RequestTimeout bounds every attempt, from dialing to reading the body.
+type ClientConfig struct {
+	ConnectTimeout      int64         `json:"connect_timeout"`
+	RequestTimeout      int64         `json:"request_timeout"`
+	KeepAlive           int64         `json:"keep_alive"`
+	IdleConnTimeout     int64         `json:"idle_conn_timeout"`
+	MaxIdleConns        int           `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `json:"max_conns_per_host"`
+	MaxResponseBytes    int64         `json:"max_response_bytes"`
+	Retry               RetryConfig   `json:"retry"`
+	Breaker             BreakerConfig `json:"breaker"`
+}
+
+// RetryConfig makes at most MaxAttempts attempts per request, backing off exponentially with
+// jitter from InitialBackoff up to MaxBackoff.
+type RetryConfig struct {
+	MaxAttempts    int   `json:"max_attempts"`
+	InitialBackoff int64 `json:"initial_backoff"`
+	MaxBackoff     int64 `json:"max_backoff"`
+}
+
+// BreakerConfig opens the circuit of a host after FailureThreshold consecutive failed attempts,
+// rejecting requests for OpenDuration before a single probe may close it again.
+type BreakerConfig struct {
+	FailureThreshold int   `json:"failure_threshold"`
+	OpenDuration     int64 `json:"open_duration"`
+}
+
+// HealthConfig runs the health checks every Interval milliseconds, failing those that take longer
+// than Timeout. The dashboard isn't ready while the liveness endpoint of its data host fails.
+type HealthConfig struct {
+	Interval int64 `json:"interval"`
+	Timeout  int64 `json:"timeout"`
+}
+
+// AdminConfig protects the admin api, which is disabled while Token is empty.
+type AdminConfig struct {
+	Token string `json:"token"`
+}
+
+// MetricsConfig sets the buckets of the id api latency histogram in seconds. LegacySummaries
+// also exports the summary the histogram replaced. IdLabels bounds the values of id labels.
+type MetricsConfig struct {
+	LatencyBuckets  []float64     `json:"latency_buckets"`
+	LegacySummaries bool          `json:"legacy_summaries"`
+	IdLabels        labels.Config `json:"id_labels"`
 }
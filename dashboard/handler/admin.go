@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"shared/admin"
+	"shared/logging"
+)
+
+const (
+	// maxAdminRequestBytes limits admin request bodies
+	maxAdminRequestBytes = 1 << 16
+)
+
+// AdminChanges counts the runtime changes made through the admin api
+var AdminChanges = admin.NewChanges("dashboard", "admin")
+
+// AdminHandler changes the dashboard's log level at runtime.
+type AdminHandler struct {
+	Token string
+}
+
+// logLevel is the body of log level requests and responses.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// LogLevel reports the level of the dashboard's logger on GET and changes it on PUT or POST.
+func (h *AdminHandler) LogLevel(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodGet, http.MethodPut, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		admin.WriteResponse(w, http.StatusOK, "Success", "Log level fetched successfully.", logLevel{logging.Default().Level().String()})
+		return
+	}
+	var req logLevel
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestBytes)).Decode(&req)
+	if err != nil && err != io.EOF {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Invalid request body: "+err.Error(), nil)
+		return
+	}
+	level, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Field 'level' must be one of debug, info, warn or error", nil)
+		return
+	}
+	logging.Default().SetLevel(level)
+	AdminChanges.Record("log_level", fmt.Sprintf("level=%v", level))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Log level updated.", logLevel{level.String()})
+}
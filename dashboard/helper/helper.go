@@ -3,8 +3,8 @@ package helper
 import (
 	"dashboard/dashboard_structs"
 	"encoding/json"
-	"log"
 	"os"
+	"shared/logging"
 )
 
 func LoadDashboardConfiguration(file string) (dConfig dashboard_structs.DashboardConfig) {
@@ -12,17 +12,17 @@ func LoadDashboardConfiguration(file string) (dConfig dashboard_structs.Dashboar
 	defer func(configFile *os.File) {
 		err := configFile.Close()
 		if err != nil {
-			log.Printf("Error in closing dashboard config file. Error: [%v]", err)
+			logging.Error("Error in closing dashboard config file", logging.String("file", file), logging.Err(err))
 		}
 	}(configFile)
 	if err != nil {
-		log.Printf("Error in opening dashboard config file. Error: [%v]", err)
+		logging.Error("Error in opening dashboard config file", logging.String("file", file), logging.Err(err))
 		return
 	}
 	jsonParser := json.NewDecoder(configFile)
 	er := jsonParser.Decode(&dConfig)
 	if er != nil {
-		log.Printf("Error in json decoding dashboard config. Error: [%v]", er)
+		logging.Error("Error in json decoding dashboard config", logging.String("file", file), logging.Err(er))
 		return
 	}
 
@@ -2,27 +2,42 @@ package main
 
 import (
 	"context"
+	"dashboard/client"
 	"dashboard/dashboard_structs"
+	"dashboard/handler"
 	"dashboard/helper"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"io"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"math/rand"
 	"net/http"
 	"os"
+	"shared/health"
+	"shared/labels"
+	"shared/logging"
+	"shared/tracing"
 	"sync"
 	"time"
 )
 
 const (
 	GetRecordAPI = "getValueForId"
+	HealthAPI    = "healthz"
 )
 
 var (
 	dashboardConfig dashboard_structs.DashboardConfig
-	idApiSummary    = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+	idApiHistogram  *prometheus.HistogramVec
+	// clientDurationHistogram times the data host requests of dataClient
+	clientDurationHistogram *prometheus.HistogramVec
+	labelsDroppedCounter    = labels.NewDroppedCounter("dashboard")
+	idLabels                *labels.Policy
+	dataClient              *client.Client
+	tracer                  = tracing.Tracer("dashboard")
+	// idApiSummary is only observed with legacy summaries, for dashboards built on the old metric
+	idApiSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace: "dashboard",
 		Name:      "id_api_latency",
 		Help:      "Latency for " + GetRecordAPI + " api, initiating from dashboard_service",
@@ -30,30 +45,89 @@ var (
 )
 
 func registerPrometheusMetrics() {
-	prometheus.MustRegister(idApiSummary)
+	buckets := dashboardConfig.Metrics.LatencyBuckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	clientDurationHistogram = client.NewRequestDurationHistogram(buckets)
+	idApiHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dashboard",
+		Name:      "id_api_latency_seconds",
+		Help:      "Latency for " + GetRecordAPI + " api, initiating from dashboard_service",
+		Buckets:   buckets,
+	}, []string{"id"})
+	prometheus.MustRegister(idApiHistogram)
+	prometheus.MustRegister(clientDurationHistogram)
+	prometheus.MustRegister(client.RetryCounter)
+	prometheus.MustRegister(client.CircuitStateGauge)
+	prometheus.MustRegister(client.CircuitRejectedCounter)
+	prometheus.MustRegister(labelsDroppedCounter)
+	prometheus.MustRegister(logging.SampledCounter)
+	prometheus.MustRegister(handler.AdminChanges.Counter)
+	prometheus.MustRegister(handler.AdminChanges.LastChange)
+	// Summaries can't be aggregated across replicas, they are only kept for existing dashboards
+	if dashboardConfig.Metrics.LegacySummaries {
+		prometheus.MustRegister(idApiSummary)
+	}
 }
 
 func main() {
-	log.Println("Starting dashboard application...")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	dashboardConfig = helper.LoadDashboardConfiguration(os.Getenv("APP_HOME") + "/config/config.json")
-	log.Printf("Dashboard config: [%v]", dashboardConfig)
+	logger, err := logging.New(dashboardConfig.AppName, dashboardConfig.Logging)
+	if err != nil {
+		logging.Fatal("Error in creating logger", logging.Err(err))
+	}
+	logging.SetDefault(logger)
+	logging.Info("Starting dashboard application", logging.Any("config", dashboardConfig))
+
+	if idLabels, err = labels.New("id", dashboardConfig.Metrics.IdLabels, labelsDroppedCounter); err != nil {
+		logging.Fatal("Error in creating id label policy", logging.Err(err))
+	}
 
-	// Prometheus metric
-	http.Handle("/metrics", promhttp.Handler())
+	shutdownTracing, err := tracing.Init(ctx, dashboardConfig.AppName, dashboardConfig.Tracing)
+	if err != nil {
+		logging.Fatal("Error in initiating tracing", logging.Err(err))
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logging.Error("Error in flushing traces", logging.Err(err))
+		}
+	}()
+
+	// Prometheus metric, exemplars are only served in the OpenMetrics format
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+
+	// runtime log level, every request needs the admin token as bearer token
+	admin := &handler.AdminHandler{Token: adminToken(dashboardConfig)}
+	if admin.Token != "" {
+		http.HandleFunc("/admin/log-level", admin.LogLevel)
+	} else {
+		logging.Info("No admin token configured, the admin api is disabled")
+	}
+
+	// Register Prometheus custom metrics, the client observes its histogram from the first request
+	registerPrometheusMetrics()
+	idLabels.OnEvict(idApiHistogram, idApiSummary)
+	dataClient = client.New(dashboardConfig.Client, clientDurationHistogram)
+
+	// liveness and readiness with the results of the last health checks
+	checker := newHealthChecker()
+	checker.Register(http.DefaultServeMux)
 
 	// Start http server
-	fmt.Printf("Starting server at port 2121...\n")
+	logging.Info("Starting server", logging.Int("port", 2121))
 	go func() {
 		if err := http.ListenAndServe(":2121", nil); err != nil {
-			log.Fatal(err)
+			logging.Fatal("Error in serving http", logging.Err(err))
 		}
 	}()
 
-	// Register Prometheus custom metrics
-	registerPrometheusMetrics()
+	prometheus.MustRegister(checker.Collector())
+	go checker.Run(ctx)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -64,9 +138,9 @@ func main() {
 			case <-ctx.Done():
 				return
 			default:
-				if err := getRecord(); err != nil {
-					log.Printf("Dashboard. Error while getting record. Error: [%v]", err)
-					continue
+				// Failed requests wait too, an open circuit fails immediately
+				if err := getRecord(ctx); err != nil {
+					logging.Error("Error while getting record", logging.Err(err))
 				}
 				time.Sleep(time.Duration(dashboardConfig.RequestInterval) * time.Millisecond)
 			}
@@ -76,34 +150,63 @@ func main() {
 	wg.Wait()
 }
 
-func getRecord() error {
+// newHealthChecker checks for readiness that the data host answers its liveness endpoint.
+func newHealthChecker() *health.Checker {
+	healthConfig := dashboardConfig.Health
+	checker := health.NewChecker("dashboard", time.Duration(healthConfig.Interval)*time.Millisecond,
+		time.Duration(healthConfig.Timeout)*time.Millisecond)
+	checker.Ready("data_host", func(ctx context.Context) error {
+		// Probes bypass the breaker, so that readiness recovers as soon as the data host does
+		res, err := dataClient.Probe(ctx, dashboardConfig.DataHost+"/"+HealthAPI)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("data host %v answered %d", dashboardConfig.DataHost, res.StatusCode)
+		}
+		return nil
+	})
+	return checker
+}
+
+// getRecord fetches the value of a random id in a span covering all its attempts, each of which
+// propagates its trace context so that the consumer continues the trace.
+func getRecord(ctx context.Context) (err error) {
 	startTime := time.Now()
 
 	idValue := dashboardConfig.UniqueIds[rand.Intn(len(dashboardConfig.UniqueIds))]
 	queryParam := "id=" + idValue
 	requestURL := dashboardConfig.DataHost + "/" + GetRecordAPI + "?" + queryParam
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
-	if err != nil {
-		log.Printf("Dashboard. Error in creating API request object hit to data host: [%v], Error: [%v]", dashboardConfig.DataHost, err)
-		return err
-	}
-
-	res, er := http.DefaultClient.Do(req)
-	if er != nil {
-		log.Printf("Dashboard. Error while making API request to data host: [%v], Error: [%v]", dashboardConfig.DataHost, er)
-		return err
-	}
+	ctx, span := tracer.Start(ctx, "getRecord", trace.WithAttributes(attribute.String("message.id", idValue)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
 
-	resBody, err := io.ReadAll(res.Body)
+	res, err := dataClient.Get(ctx, requestURL)
 	if err != nil {
-		log.Printf("Dashboard: could not read response body. Error: [%v]", err)
-		return err
+		return fmt.Errorf("request for id %v to %v failed: %w", idValue, dashboardConfig.DataHost, err)
 	}
 
-	log.Printf("Dashboard. Response: [%v]", string(resBody))
-
+	// Every answer of the data host counts, failed attempts are in the client's request metrics
 	elapsedTime := time.Since(startTime).Seconds()
-	idApiSummary.WithLabelValues(idValue).Observe(elapsedTime)
+	label := idLabels.Value(idValue)
+	tracing.Observe(ctx, idApiHistogram.WithLabelValues(label), elapsedTime)
+	if dashboardConfig.Metrics.LegacySummaries {
+		idApiSummary.WithLabelValues(label).Observe(elapsedTime)
+	}
 
+	logging.WithContext(ctx).Debug("Received response", logging.String("id", idValue), logging.Int("status", res.StatusCode), logging.String("body", string(res.Body)))
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("data host %v answered %d for id %v", dashboardConfig.DataHost, res.StatusCode, idValue)
+	}
 	return nil
 }
+
+// adminToken returns the admin api token, DASHBOARD_ADMIN_TOKEN takes precedence over the config.
+func adminToken(config dashboard_structs.DashboardConfig) string {
+	if token := os.Getenv("DASHBOARD_ADMIN_TOKEN"); token != "" {
+		return token
+	}
+	return config.Admin.Token
+}
@@ -49,6 +49,7 @@ function createMetricsContainer() {
     sleep 0.5
     docker network connect $local_bridge prometheus
     docker network connect $local_bridge grafana
+    docker network connect $local_bridge jaeger
 }
 
 function removeApplicationContainers() {
@@ -68,6 +69,9 @@ function removeMetricsContainers() {
 
   # remove grafana
   docker rm -f grafana
+
+  # remove jaeger
+  docker rm -f jaeger
 }
 
 function removeContainers() {
@@ -0,0 +1,151 @@
+package chaos
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"math/rand"
+	"producer/producer_structs"
+	"shared/envelope"
+	"shared/serde"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FaultMalformedJSON = "malformed_json"
+	FaultMissingFields = "missing_fields"
+	FaultNaNInf        = "nan_inf"
+	FaultOversized     = "oversized"
+	FaultDuplicate     = "duplicate"
+	FaultOutOfOrder    = "out_of_order"
+
+	// FaultHeader tags every message carrying an injected fault with the fault type
+	FaultHeader = "x-injected-fault"
+
+	// DefaultOversizedBytes stays below sarama's default MaxMessageBytes so the message reaches kafka
+	DefaultOversizedBytes = 512 << 10
+	DefaultOutOfOrderSkew = 60 * time.Second
+)
+
+// faultTypes fixes the order faults are rolled in, so a seeded run injects the same faults.
+var faultTypes = []string{FaultMalformedJSON, FaultMissingFields, FaultNaNInf, FaultOversized, FaultDuplicate, FaultOutOfOrder}
+
+var InjectedFaultCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "producer",
+	Name:      "faults_injected",
+	Help:      "Counter for faults injected into the produced stream by type",
+}, []string{"type"})
+
+// Injector corrupts a configurable percentage of the produced messages.
+type Injector struct {
+	mu         sync.Mutex
+	rand       *rand.Rand
+	config     producer_structs.ChaosConfig
+	serializer serde.Serializer
+}
+
+// NewInjector re-encodes skewed envelopes with serializer, which has to be the one of the produced
+// messages.
+func NewInjector(config producer_structs.ChaosConfig, seed int64, serializer serde.Serializer) *Injector {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{rand: rand.New(rand.NewSource(seed)), config: config, serializer: serializer}
+}
+
+// Inject returns the messages to publish in place of msg, which encodes e. Without a fault that
+// is msg itself, otherwise a corrupted copy or, for duplicates, msg twice.
+func (i *Injector) Inject(msg *sarama.ProducerMessage, e envelope.Envelope) []*sarama.ProducerMessage {
+	if i == nil || !i.config.Enabled {
+		return []*sarama.ProducerMessage{msg}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	fault := i.roll()
+	if fault == "" {
+		return []*sarama.ProducerMessage{msg}
+	}
+	InjectedFaultCounter.WithLabelValues(fault).Inc()
+	message := e.Message
+
+	faulty := &sarama.ProducerMessage{Topic: msg.Topic, Key: msg.Key, Value: msg.Value, Timestamp: msg.Timestamp}
+	faulty.Headers = append(append([]sarama.RecordHeader{}, msg.Headers...), sarama.RecordHeader{Key: []byte(FaultHeader), Value: []byte(fault)})
+
+	switch fault {
+	case FaultMalformedJSON, FaultMissingFields, FaultNaNInf:
+		// These faults only exist as JSON text, labelled as such the consumer decodes them as JSON
+		// and runs its rules on them instead of failing them as undecodable binary
+		faulty.Headers = withEncoding(faulty.Headers, serde.JSON)
+	}
+	switch fault {
+	case FaultMalformedJSON:
+		faulty.Value = sarama.StringEncoder(fmt.Sprintf(`{"id": %q, "value": %v`, message.Id, message.Value))
+	case FaultMissingFields:
+		if i.rand.Intn(2) == 0 {
+			faulty.Value = sarama.StringEncoder(fmt.Sprintf(`{"value": %v}`, message.Value))
+		} else {
+			faulty.Value = sarama.StringEncoder(fmt.Sprintf(`{"id": %q}`, message.Id))
+		}
+	case FaultNaNInf:
+		// Not valid JSON numbers, which is exactly what a careless upstream would send
+		values := []string{"NaN", "Infinity", "-Infinity", "1e999"}
+		faulty.Value = sarama.StringEncoder(fmt.Sprintf(`{"id": %q, "value": %s}`, message.Id, values[i.rand.Intn(len(values))]))
+	case FaultOversized:
+		size := i.config.OversizedBytes
+		if size <= 0 {
+			size = DefaultOversizedBytes
+		}
+		// Padded through an attribute, so the message keeps the configured encoding
+		attributes := make(map[string]string, len(e.Attributes)+1)
+		for key, value := range e.Attributes {
+			attributes[key] = value
+		}
+		attributes["padding"] = strings.Repeat("x", size)
+		e.Attributes = attributes
+		if data, err := i.serializer.Encode(e); err == nil {
+			faulty.Value = sarama.ByteEncoder(data)
+		}
+	case FaultDuplicate:
+		return []*sarama.ProducerMessage{msg, faulty}
+	case FaultOutOfOrder:
+		skew := time.Duration(i.config.OutOfOrderSkew) * time.Millisecond
+		if skew <= 0 {
+			skew = DefaultOutOfOrderSkew
+		}
+		// Consumers order by the event time of the envelope, the kafka timestamp alone would
+		// go unnoticed
+		e.EventTime = e.EventTime.Add(-skew)
+		faulty.Timestamp = e.EventTime
+		if data, err := i.serializer.Encode(e); err == nil {
+			faulty.Value = sarama.ByteEncoder(data)
+		}
+	}
+	return []*sarama.ProducerMessage{faulty}
+}
+
+// withEncoding returns headers with the encoding header set to encoding.
+func withEncoding(headers []sarama.RecordHeader, encoding string) []sarama.RecordHeader {
+	for i, header := range headers {
+		if string(header.Key) == serde.EncodingHeader {
+			headers[i].Value = []byte(encoding)
+			return headers
+		}
+	}
+	return append(headers, sarama.RecordHeader{Key: []byte(serde.EncodingHeader), Value: []byte(encoding)})
+}
+
+// roll picks at most one fault based on the configured percentages.
+func (i *Injector) roll() string {
+	roll := i.rand.Float64() * 100
+	for _, fault := range faultTypes {
+		roll -= i.config.Faults[fault]
+		if roll < 0 {
+			return fault
+		}
+	}
+	return ""
+}
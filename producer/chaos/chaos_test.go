@@ -0,0 +1,174 @@
+package chaos
+
+import (
+	"github.com/Shopify/sarama"
+	"producer/encoder"
+	"producer/producer_structs"
+	"reflect"
+	"shared/envelope"
+	"shared/serde"
+	"testing"
+	"time"
+)
+
+func newTestInjector(t *testing.T, fault string, encoding string) (*Injector, *encoder.Encoder) {
+	t.Helper()
+	serializer, err := serde.New(encoding, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := producer_structs.ChaosConfig{
+		Enabled:        true,
+		Faults:         map[string]float64{fault: 100},
+		OversizedBytes: 1024,
+		OutOfOrderSkew: 5000,
+	}
+	return NewInjector(config, 42, serializer), encoder.New(serializer)
+}
+
+func testMessage(t *testing.T, enc *encoder.Encoder) (*sarama.ProducerMessage, envelope.Envelope) {
+	t.Helper()
+	e := envelope.New(producer_structs.Message{Id: "7", Value: 12.5}, "test")
+	e.Attributes = map[string]string{"region": "eu"}
+	msg, err := enc.Message("topic", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, e
+}
+
+func header(msg *sarama.ProducerMessage, key string) string {
+	for _, h := range msg.Headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func encoded(t *testing.T, msg *sarama.ProducerMessage) []byte {
+	t.Helper()
+	data, err := msg.Value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestJSONFaultsAreLabelledAsJSON(t *testing.T) {
+	for _, fault := range []string{FaultMalformedJSON, FaultMissingFields, FaultNaNInf} {
+		i, enc := newTestInjector(t, fault, serde.Protobuf)
+		msg, e := testMessage(t, enc)
+		out := i.Inject(msg, e)
+		if len(out) != 1 {
+			t.Fatalf("%s: got %d messages, want 1", fault, len(out))
+		}
+		if got := header(out[0], FaultHeader); got != fault {
+			t.Errorf("%s: fault header = %q", fault, got)
+		}
+		if got := header(out[0], serde.EncodingHeader); got != serde.JSON {
+			t.Errorf("%s: encoding header = %q, want %q", fault, got, serde.JSON)
+		}
+		if got := header(msg, serde.EncodingHeader); got != serde.Protobuf {
+			t.Errorf("%s: original encoding header changed to %q", fault, got)
+		}
+	}
+}
+
+func TestOversizedKeepsEncoding(t *testing.T) {
+	i, enc := newTestInjector(t, FaultOversized, serde.Protobuf)
+	msg, e := testMessage(t, enc)
+	out := i.Inject(msg, e)
+	if got := header(out[0], serde.EncodingHeader); got != serde.Protobuf {
+		t.Errorf("encoding header = %q, want %q", got, serde.Protobuf)
+	}
+
+	decoded, err := enc.Serializer.Decode(encoded(t, out[0]))
+	if err != nil {
+		t.Fatalf("oversized message doesn't decode: %v", err)
+	}
+	if len(decoded.Attributes["padding"]) != 1024 {
+		t.Errorf("padding is %d bytes, want 1024", len(decoded.Attributes["padding"]))
+	}
+	if decoded.Attributes["region"] != "eu" || decoded.Id != "7" {
+		t.Errorf("oversized message lost its content: %+v", decoded)
+	}
+	if _, ok := e.Attributes["padding"]; ok {
+		t.Error("padding leaked into the attributes of the original envelope")
+	}
+}
+
+func TestOutOfOrderSkewsEventTime(t *testing.T) {
+	i, enc := newTestInjector(t, FaultOutOfOrder, serde.JSON)
+	msg, e := testMessage(t, enc)
+	out := i.Inject(msg, e)
+
+	want := e.EventTime.Add(-5 * time.Second)
+	if !out[0].Timestamp.Equal(want) {
+		t.Errorf("timestamp = %v, want %v", out[0].Timestamp, want)
+	}
+	decoded, err := enc.Serializer.Decode(encoded(t, out[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.EventTime.Equal(want) {
+		t.Errorf("event time = %v, want %v", decoded.EventTime, want)
+	}
+}
+
+func TestDuplicateSendsTwice(t *testing.T) {
+	i, enc := newTestInjector(t, FaultDuplicate, serde.JSON)
+	msg, e := testMessage(t, enc)
+	out := i.Inject(msg, e)
+	if len(out) != 2 || out[0] != msg {
+		t.Fatalf("got %d messages, want the original and a copy", len(out))
+	}
+	if header(out[0], FaultHeader) != "" || header(out[1], FaultHeader) != FaultDuplicate {
+		t.Error("only the copy should carry the fault header")
+	}
+	if !reflect.DeepEqual(encoded(t, out[0]), encoded(t, out[1])) {
+		t.Error("duplicate differs from the original")
+	}
+}
+
+func TestDisabledPassesThrough(t *testing.T) {
+	i, enc := newTestInjector(t, FaultMalformedJSON, serde.JSON)
+	i.config.Enabled = false
+	msg, e := testMessage(t, enc)
+	if out := i.Inject(msg, e); len(out) != 1 || out[0] != msg {
+		t.Error("disabled injector changed the message")
+	}
+}
+
+func TestSeededRunsInjectSameFaults(t *testing.T) {
+	config := producer_structs.ChaosConfig{
+		Enabled: true,
+		Faults:  map[string]float64{FaultMalformedJSON: 10, FaultDuplicate: 10, FaultOutOfOrder: 10},
+	}
+	serializer, _ := serde.New(serde.JSON, nil, "")
+	enc := encoder.New(serializer)
+	run := func() []string {
+		i := NewInjector(config, 7, serializer)
+		var faults []string
+		for n := 0; n < 200; n++ {
+			msg, e := testMessage(t, enc)
+			out := i.Inject(msg, e)
+			faults = append(faults, header(out[len(out)-1], FaultHeader))
+		}
+		return faults
+	}
+	first := run()
+	if !reflect.DeepEqual(first, run()) {
+		t.Error("runs with the same seed injected different faults")
+	}
+	injected := 0
+	for _, fault := range first {
+		if fault != "" {
+			injected++
+		}
+	}
+	// 30% of 200, with plenty of slack for the draw
+	if injected < 30 || injected > 90 {
+		t.Errorf("injected %d faults in 200 messages, want about 60", injected)
+	}
+}
@@ -0,0 +1,172 @@
+package distribution
+
+import (
+	"math"
+	"math/rand"
+	"producer/producer_structs"
+	"shared/logging"
+	"sync"
+	"time"
+)
+
+const (
+	Uniform   = "uniform"
+	Normal    = "normal"
+	LogNormal = "lognormal"
+	Zipf      = "zipf"
+	HotKey    = "hotkey"
+
+	// maxResamples bounds rejection sampling before a value is clamped into range
+	maxResamples = 10
+)
+
+// Sampler draws message ids and values from the configured distributions. It is safe for
+// concurrent use and, given a non zero seed, produces the same sequence on every run.
+type Sampler struct {
+	mu     sync.Mutex
+	rand   *rand.Rand
+	ids    []string
+	min    float64
+	max    float64
+	idDist producer_structs.IdDistributionConfig
+	vDist  producer_structs.ValueDistributionConfig
+	zipf   *rand.Zipf
+}
+
+func NewSampler(config producer_structs.ProducerConfig) *Sampler {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	logging.Info("Sampling ids and values", logging.String("id_distribution", config.IdDistribution.Type), logging.String("value_distribution", config.ValueDistribution.Type), logging.Int64("seed", seed))
+
+	s := &Sampler{
+		rand:   rand.New(rand.NewSource(seed)),
+		idDist: config.IdDistribution,
+		vDist:  config.ValueDistribution,
+	}
+	s.ids = config.UniqueIds
+	s.setRange(config.ValuesMin, config.ValuesMax)
+	s.resetZipf()
+
+	return s
+}
+
+// Id returns the next message id, or an empty string when no ids are configured.
+func (s *Sampler) Id() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.ids) == 0 {
+		return ""
+	}
+
+	switch s.idDist.Type {
+	case Zipf:
+		return s.ids[s.zipf.Uint64()]
+	case HotKey:
+		hotKeys := s.idDist.HotKeys
+		if hotKeys < 1 {
+			hotKeys = 1
+		}
+		if hotKeys >= len(s.ids) {
+			return s.ids[s.rand.Intn(len(s.ids))]
+		}
+		hotFraction := s.idDist.HotFraction
+		if hotFraction <= 0 {
+			hotFraction = 0.8
+		}
+		if s.rand.Float64() < hotFraction {
+			return s.ids[s.rand.Intn(hotKeys)]
+		}
+		return s.ids[hotKeys+s.rand.Intn(len(s.ids)-hotKeys)]
+	default:
+		return s.ids[s.rand.Intn(len(s.ids))]
+	}
+}
+
+// Value returns the next message value rounded to two decimals and always within [min, max].
+func (s *Sampler) Value() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var value float64
+	for i := 0; i < maxResamples; i++ {
+		value = math.Round(s.sampleValue()*100) / 100
+		if value >= s.min && value <= s.max {
+			return value
+		}
+	}
+	return math.Min(math.Max(value, s.min), s.max)
+}
+
+func (s *Sampler) sampleValue() float64 {
+	span := s.max - s.min
+	switch s.vDist.Type {
+	case Normal:
+		mean, stdDev := s.vDist.Mean, s.vDist.StdDev
+		if mean == 0 && stdDev == 0 {
+			mean, stdDev = s.min+span/2, span/6
+		}
+		return mean + stdDev*s.rand.NormFloat64()
+	case LogNormal:
+		// Log-normal values are offset by min, so the long tail extends towards max
+		mu, sigma := s.vDist.Mu, s.vDist.Sigma
+		if mu == 0 && sigma == 0 {
+			mu, sigma = math.Log(span/4), 0.5
+		}
+		return s.min + math.Exp(mu+sigma*s.rand.NormFloat64())
+	default:
+		return s.min + s.rand.Float64()*span
+	}
+}
+
+// SetIds replaces the ids messages are generated for.
+func (s *Sampler) SetIds(ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids = ids
+	s.resetZipf()
+}
+
+func (s *Sampler) Ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ids...)
+}
+
+// SetRange replaces the range values are generated in.
+func (s *Sampler) SetRange(min, max float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRange(min, max)
+}
+
+func (s *Sampler) Range() (float64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.min, s.max
+}
+
+func (s *Sampler) setRange(min, max float64) {
+	if min > max {
+		logging.Warn("values_min is greater than values_max, swapping them", logging.Float64("values_min", min), logging.Float64("values_max", max))
+		min, max = max, min
+	}
+	s.min, s.max = min, max
+}
+
+func (s *Sampler) resetZipf() {
+	s.zipf = nil
+	if s.idDist.Type != Zipf || len(s.ids) == 0 {
+		return
+	}
+	exponent, offset := s.idDist.ZipfS, s.idDist.ZipfV
+	if exponent <= 1 {
+		exponent = 1.1
+	}
+	if offset < 1 {
+		offset = 1
+	}
+	s.zipf = rand.NewZipf(s.rand, exponent, offset, uint64(len(s.ids)-1))
+}
@@ -0,0 +1,119 @@
+package distribution
+
+import (
+	"math"
+	"producer/producer_structs"
+	"reflect"
+	"testing"
+)
+
+func newTestSampler(valueType string, min, max float64) *Sampler {
+	return NewSampler(producer_structs.ProducerConfig{
+		Seed:              42,
+		UniqueIds:         []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"},
+		ValuesMin:         min,
+		ValuesMax:         max,
+		ValueDistribution: producer_structs.ValueDistributionConfig{Type: valueType},
+	})
+}
+
+func TestValuesStayInRange(t *testing.T) {
+	for _, valueType := range []string{Uniform, Normal, LogNormal} {
+		s := newTestSampler(valueType, 10, 20)
+		for i := 0; i < 10000; i++ {
+			if value := s.Value(); value < 10 || value > 20 {
+				t.Fatalf("%s: value %v outside [10, 20]", valueType, value)
+			}
+		}
+	}
+}
+
+func TestValuesClampedWhenResamplingFails(t *testing.T) {
+	// A normal distribution far outside the range never lands in it
+	s := NewSampler(producer_structs.ProducerConfig{
+		Seed:              42,
+		ValuesMin:         0,
+		ValuesMax:         1,
+		ValueDistribution: producer_structs.ValueDistributionConfig{Type: Normal, Mean: 1000, StdDev: 1},
+	})
+	for i := 0; i < 100; i++ {
+		if value := s.Value(); value != 1 {
+			t.Fatalf("value = %v, want it clamped to the max of 1", value)
+		}
+	}
+
+	s.vDist.Mean = -1000
+	if value := s.Value(); value != 0 {
+		t.Errorf("value = %v, want it clamped to the min of 0", value)
+	}
+}
+
+func TestValuesRoundedToTwoDecimals(t *testing.T) {
+	s := newTestSampler(Uniform, 0, 100)
+	for i := 0; i < 1000; i++ {
+		value := s.Value()
+		if cents := value * 100; math.Abs(cents-math.Round(cents)) > 1e-6 {
+			t.Fatalf("value %v has more than two decimals", value)
+		}
+	}
+}
+
+func TestSetRangeSwapsInvertedBounds(t *testing.T) {
+	s := newTestSampler(Uniform, 0, 1)
+	s.SetRange(50, 5)
+	if min, max := s.Range(); min != 5 || max != 50 {
+		t.Errorf("Range = [%v, %v], want [5, 50]", min, max)
+	}
+	for i := 0; i < 1000; i++ {
+		if value := s.Value(); value < 5 || value > 50 {
+			t.Fatalf("value %v outside [5, 50]", value)
+		}
+	}
+
+	// An empty range always yields its only value
+	s.SetRange(7, 7)
+	if value := s.Value(); value != 7 {
+		t.Errorf("value = %v, want 7", value)
+	}
+}
+
+func TestSeedReproducesSequence(t *testing.T) {
+	a, b := newTestSampler(Normal, 0, 100), newTestSampler(Normal, 0, 100)
+	for i := 0; i < 100; i++ {
+		if a.Id() != b.Id() || a.Value() != b.Value() {
+			t.Fatalf("samplers with the same seed diverged at draw %d", i)
+		}
+	}
+}
+
+func TestIdsComeFromConfiguredIds(t *testing.T) {
+	for _, idType := range []string{Uniform, Zipf, HotKey} {
+		s := NewSampler(producer_structs.ProducerConfig{
+			Seed:           42,
+			UniqueIds:      []string{"a", "b", "c"},
+			IdDistribution: producer_structs.IdDistributionConfig{Type: idType, HotKeys: 1, HotFraction: 0.9},
+		})
+		seen := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			seen[s.Id()]++
+		}
+		for id := range seen {
+			if id != "a" && id != "b" && id != "c" {
+				t.Errorf("%s: unknown id %q", idType, id)
+			}
+		}
+		if idType == HotKey && seen["a"] < 800 {
+			t.Errorf("hotkey: hot id drawn %d times out of 1000, want about 900", seen["a"])
+		}
+	}
+
+	s := newTestSampler(Uniform, 0, 1)
+	s.SetIds(nil)
+	if id := s.Id(); id != "" {
+		t.Errorf("Id = %q without ids, want empty", id)
+	}
+	s.SetIds([]string{"x"})
+	if ids := s.Ids(); !reflect.DeepEqual(ids, []string{"x"}) {
+		t.Errorf("Ids = %v, want [x]", ids)
+	}
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"producer/distribution"
+	"producer/producer_structs"
+	"producer/workload"
+	"shared/admin"
+	"shared/logging"
+	"strings"
+)
+
+const (
+	// MaxBurstCount bounds a single burst request
+	MaxBurstCount = 100000
+)
+
+// ControlChanges counts the runtime changes made through the control api
+var ControlChanges = admin.NewChanges("producer", "control")
+
+// ControlHandler changes the producer's workload at runtime. Generator is nil when the producer
+// replays a file, in which case only the configuration can be read.
+type ControlHandler struct {
+	Token       string
+	Config      producer_structs.ProducerConfig
+	Generator   *workload.Generator
+	Sampler     *distribution.Sampler
+	StopProfile func()
+	Burst       func(count int)
+}
+
+func (h *ControlHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPost) || !h.requireGenerator(w) {
+		return
+	}
+	h.Generator.Pause()
+	ControlChanges.Record("pause", "")
+	admin.WriteResponse(w, http.StatusOK, "Success", "Producer paused.", h.runtimeConfig())
+}
+
+func (h *ControlHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPost) || !h.requireGenerator(w) {
+		return
+	}
+	h.Generator.Resume()
+	ControlChanges.Record("resume", "")
+	admin.WriteResponse(w, http.StatusOK, "Success", "Producer resumed.", h.runtimeConfig())
+}
+
+// SetRate overrides the target rate. A running load profile is stopped so that it doesn't
+// overwrite the new rate on its next tick.
+func (h *ControlHandler) SetRate(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPut, http.MethodPost) || !h.requireGenerator(w) {
+		return
+	}
+	req, ok := decodeControlRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.TargetRps == nil || *req.TargetRps < 0 {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Field 'target_rps' must be a non negative number", nil)
+		return
+	}
+
+	if h.StopProfile != nil {
+		h.StopProfile()
+	}
+	h.Generator.SetTargetRps(*req.TargetRps)
+	ControlChanges.Record("rate", fmt.Sprintf("target_rps=%v", *req.TargetRps))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Target rate updated.", h.runtimeConfig())
+}
+
+func (h *ControlHandler) SetIds(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPut, http.MethodPost) {
+		return
+	}
+	req, ok := decodeControlRequest(w, r)
+	if !ok {
+		return
+	}
+	for _, id := range req.UniqueIds {
+		if id == "" {
+			admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Field 'unique_ids' must not contain empty ids", nil)
+			return
+		}
+	}
+	if len(req.UniqueIds) == 0 {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Field 'unique_ids' must contain at least one id", nil)
+		return
+	}
+
+	h.Sampler.SetIds(req.UniqueIds)
+	ControlChanges.Record("ids", fmt.Sprintf("unique_ids=%v", strings.Join(req.UniqueIds, ",")))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Ids updated.", h.runtimeConfig())
+}
+
+func (h *ControlHandler) SetValues(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPut, http.MethodPost) {
+		return
+	}
+	req, ok := decodeControlRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.ValuesMin == nil || req.ValuesMax == nil || *req.ValuesMin > *req.ValuesMax {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Fields 'values_min' and 'values_max' are required and min must not exceed max", nil)
+		return
+	}
+
+	h.Sampler.SetRange(*req.ValuesMin, *req.ValuesMax)
+	ControlChanges.Record("values", fmt.Sprintf("values_min=%v values_max=%v", *req.ValuesMin, *req.ValuesMax))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Value range updated.", h.runtimeConfig())
+}
+
+// TriggerBurst publishes count messages right away, on top of the paced workload.
+func (h *ControlHandler) TriggerBurst(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPost) {
+		return
+	}
+	req, ok := decodeControlRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Count <= 0 || req.Count > MaxBurstCount {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", fmt.Sprintf("Field 'count' must be between 1 and %d", MaxBurstCount), nil)
+		return
+	}
+
+	go h.Burst(req.Count)
+	ControlChanges.Record("burst", fmt.Sprintf("count=%v", req.Count))
+	admin.WriteResponse(w, http.StatusAccepted, "Success", "Burst started.", h.runtimeConfig())
+}
+
+// SetLogLevel changes the level of the producer's logger.
+func (h *ControlHandler) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodPut, http.MethodPost) {
+		return
+	}
+	req, ok := decodeControlRequest(w, r)
+	if !ok {
+		return
+	}
+	level, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Field 'level' must be one of debug, info, warn or error", nil)
+		return
+	}
+
+	logging.Default().SetLevel(level)
+	ControlChanges.Record("log_level", fmt.Sprintf("level=%v", level))
+	admin.WriteResponse(w, http.StatusOK, "Success", "Log level updated.", h.runtimeConfig())
+}
+
+// GetConfig returns the loaded configuration together with the runtime overrides.
+func (h *ControlHandler) GetConfig(w http.ResponseWriter, r *http.Request) {
+	if !admin.Accept(w, r, h.Token, http.MethodGet) {
+		return
+	}
+	admin.WriteResponse(w, http.StatusOK, "Success", "Config fetched successfully.", h.runtimeConfig())
+}
+
+func (h *ControlHandler) requireGenerator(w http.ResponseWriter) bool {
+	if h.Generator == nil {
+		admin.WriteResponse(w, http.StatusConflict, "Failure", "Not available while replaying a file", nil)
+		return false
+	}
+	return true
+}
+
+func (h *ControlHandler) runtimeConfig() producer_structs.RuntimeConfig {
+	config := h.Config
+	config.Control.Token = ""
+
+	runtime := producer_structs.RuntimeConfig{Config: config}
+	runtime.UniqueIds = h.Sampler.Ids()
+	runtime.ValuesMin, runtime.ValuesMax = h.Sampler.Range()
+	runtime.LogLevel = logging.Default().Level().String()
+	if h.Generator != nil {
+		runtime.Paused = h.Generator.Paused()
+		runtime.TargetRps = h.Generator.TargetRps()
+	}
+	return runtime
+}
+
+func decodeControlRequest(w http.ResponseWriter, r *http.Request) (producer_structs.ControlRequest, bool) {
+	var req producer_structs.ControlRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, DefaultMaxRequestBytes)).Decode(&req); err != nil {
+		admin.WriteResponse(w, http.StatusBadRequest, "Failure", "Invalid request body: "+err.Error(), nil)
+		return req, false
+	}
+	return req, true
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"producer/distribution"
+	"producer/producer_structs"
+	"producer/workload"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret"
+
+func newTestControlHandler() (*ControlHandler, *bool) {
+	config := producer_structs.ProducerConfig{
+		Seed:      42,
+		UniqueIds: []string{"1", "2"},
+		ValuesMin: 0,
+		ValuesMax: 10,
+		Control:   producer_structs.ControlConfig{Token: testToken},
+	}
+	stopped := false
+	return &ControlHandler{
+		Token:       testToken,
+		Config:      config,
+		Generator:   workload.NewGenerator(10, 1, func() {}),
+		Sampler:     distribution.NewSampler(config),
+		StopProfile: func() { stopped = true },
+		Burst:       func(int) {},
+	}, &stopped
+}
+
+// control calls handle with an authorized request and returns the response code and the
+// runtime config it reports.
+func control(t *testing.T, handle http.HandlerFunc, method string, body string) (int, producer_structs.RuntimeConfig) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, "/control", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	handle(w, r)
+
+	var resp struct {
+		Data producer_structs.RuntimeConfig `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, resp.Data
+}
+
+func TestControlRequiresBearerToken(t *testing.T) {
+	h, _ := newTestControlHandler()
+	for _, header := range []string{"", testToken, "Bearer wrong"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/control/pause", nil)
+		r.Header.Set("Authorization", header)
+		h.Pause(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: code = %d, want %d", header, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if h.Generator.Paused() {
+		t.Error("an unauthorized request paused the producer")
+	}
+}
+
+func TestControlPauseAndResume(t *testing.T) {
+	h, _ := newTestControlHandler()
+	if code, config := control(t, h.Pause, http.MethodPost, ""); code != http.StatusOK || !config.Paused {
+		t.Errorf("pause: code = %d, paused = %v", code, config.Paused)
+	}
+	if code, _ := control(t, h.Pause, http.MethodGet, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET pause: code = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if code, config := control(t, h.Resume, http.MethodPost, ""); code != http.StatusOK || config.Paused {
+		t.Errorf("resume: code = %d, paused = %v", code, config.Paused)
+	}
+}
+
+func TestControlSetRateStopsProfile(t *testing.T) {
+	h, stopped := newTestControlHandler()
+	if code, _ := control(t, h.SetRate, http.MethodPut, `{"target_rps": -1}`); code != http.StatusBadRequest {
+		t.Errorf("negative rate: code = %d, want %d", code, http.StatusBadRequest)
+	}
+	if *stopped {
+		t.Error("a refused rate stopped the load profile")
+	}
+
+	code, config := control(t, h.SetRate, http.MethodPut, `{"target_rps": 50}`)
+	if code != http.StatusOK || config.TargetRps != 50 || h.Generator.TargetRps() != 50 {
+		t.Errorf("code = %d, target rps = %v", code, config.TargetRps)
+	}
+	if !*stopped {
+		t.Error("setting the rate didn't stop the load profile")
+	}
+}
+
+func TestControlSetIdsAndValues(t *testing.T) {
+	h, _ := newTestControlHandler()
+	if code, _ := control(t, h.SetIds, http.MethodPut, `{"unique_ids": ["1", ""]}`); code != http.StatusBadRequest {
+		t.Errorf("empty id: code = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, config := control(t, h.SetIds, http.MethodPut, `{"unique_ids": ["7", "8"]}`); code != http.StatusOK || !reflect.DeepEqual(config.UniqueIds, []string{"7", "8"}) {
+		t.Errorf("code = %d, ids = %v", code, config.UniqueIds)
+	}
+
+	if code, _ := control(t, h.SetValues, http.MethodPut, `{"values_min": 5, "values_max": 1}`); code != http.StatusBadRequest {
+		t.Errorf("min above max: code = %d, want %d", code, http.StatusBadRequest)
+	}
+	code, config := control(t, h.SetValues, http.MethodPut, `{"values_min": 1, "values_max": 5}`)
+	if code != http.StatusOK || config.ValuesMin != 1 || config.ValuesMax != 5 {
+		t.Errorf("code = %d, range = [%v, %v]", code, config.ValuesMin, config.ValuesMax)
+	}
+}
+
+func TestControlBurstBounds(t *testing.T) {
+	h, _ := newTestControlHandler()
+	burst := make(chan int, 1)
+	h.Burst = func(count int) { burst <- count }
+
+	if code, _ := control(t, h.TriggerBurst, http.MethodPost, `{"count": 0}`); code != http.StatusBadRequest {
+		t.Errorf("zero count: code = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := control(t, h.TriggerBurst, http.MethodPost, `{"count": 100001}`); code != http.StatusBadRequest {
+		t.Errorf("count above %d: code = %d, want %d", MaxBurstCount, code, http.StatusBadRequest)
+	}
+	if code, _ := control(t, h.TriggerBurst, http.MethodPost, `{"count": 10}`); code != http.StatusAccepted {
+		t.Errorf("code = %d, want %d", code, http.StatusAccepted)
+	}
+	if count := <-burst; count != 10 {
+		t.Errorf("burst of %d, want 10", count)
+	}
+}
+
+func TestControlConfigHidesToken(t *testing.T) {
+	h, _ := newTestControlHandler()
+	code, config := control(t, h.GetConfig, http.MethodGet, "")
+	if code != http.StatusOK || config.Config.Control.Token != "" {
+		t.Errorf("code = %d, token = %q, want it left out", code, config.Config.Control.Token)
+	}
+	if h.Config.Control.Token != testToken {
+		t.Error("GetConfig cleared the token of the handler's config")
+	}
+}
@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"net/http"
+	"producer/encoder"
+	"producer/producer_structs"
+	"producer/publisher"
+	"shared/admin"
+	"shared/envelope"
+	"shared/labels"
+	"shared/logging"
+	"shared/tracing"
+	"strconv"
+	"time"
+)
+
+const (
+	EndpointMessages       = "/messages"
+	EndpointMessagesNDJSON = "/messages/ndjson"
+
+	// DefaultMaxRequestBytes limits ingestion request bodies when no limit is configured
+	DefaultMaxRequestBytes = 1 << 20
+)
+
+var (
+	errNotPublished = errors.New("not published, other messages of the request are invalid")
+
+	tracer               = tracing.Tracer("producer/handler")
+	IngestRequestCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "ingest_requests",
+		Help:      "Counter for ingestion requests by endpoint and response code",
+	}, []string{"endpoint", "code"})
+	IngestMessageCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "ingest_messages",
+		Help:      "Counter for ingested messages by endpoint and result",
+	}, []string{"endpoint", "result"})
+	IngestLatencyHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "producer",
+		Name:      "ingest_request_duration_seconds",
+		Help:      "Latency of ingestion requests by endpoint",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+)
+
+// IngestHandler publishes messages posted by other tools through the producer's publisher.
+type IngestHandler struct {
+	Producer        publisher.Publisher
+	Encoder         *encoder.Encoder
+	IdLabels        *labels.Policy
+	Topic           string
+	Source          string
+	MaxRequestBytes int64
+}
+
+// ingestMessage uses pointers so that missing fields can be told apart from zero values. The
+// envelope fields are optional, messages without an event id get a new envelope.
+type ingestMessage struct {
+	Id         *string           `json:"id"`
+	Value      *float64          `json:"value"`
+	EventId    string            `json:"event_id"`
+	EventTime  time.Time         `json:"event_time"`
+	Source     string            `json:"source"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// PostMessages accepts a single message or a JSON array of messages. Every message is
+// validated before any of them is published.
+func (h *IngestHandler) PostMessages(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	code := http.StatusOK
+	defer func() {
+		observeRequest(EndpointMessages, code, startTime)
+	}()
+
+	w.Header().Set("content-type", "application/json")
+	if r.Method != http.MethodPost {
+		code = http.StatusMethodNotAllowed
+		admin.WriteResponse(w, code, "Failure", "Method not allowed", nil)
+		return
+	}
+
+	body, err := h.readBody(w, r)
+	if err != nil {
+		code = statusForBodyError(err)
+		admin.WriteResponse(w, code, "Failure", err.Error(), nil)
+		return
+	}
+
+	var raw []json.RawMessage
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			code = http.StatusBadRequest
+			admin.WriteResponse(w, code, "Failure", "Invalid JSON array: "+err.Error(), nil)
+			return
+		}
+	} else {
+		raw = []json.RawMessage{body}
+	}
+	if len(raw) == 0 {
+		code = http.StatusBadRequest
+		admin.WriteResponse(w, code, "Failure", "No messages in request", nil)
+		return
+	}
+
+	messages := make([]envelope.Envelope, len(raw))
+	results := make([]producer_structs.IngestResult, len(raw))
+	invalid := 0
+	for i, item := range raw {
+		message, err := h.decodeMessage(item)
+		if err != nil {
+			IngestMessageCounter.WithLabelValues(EndpointMessages, "invalid").Inc()
+			results[i] = producer_structs.IngestResult{Index: i, Error: err.Error()}
+			invalid++
+			continue
+		}
+		messages[i] = message
+	}
+	if invalid > 0 {
+		// The valid messages of the request aren't published either, they are counted apart
+		for i, message := range messages {
+			if results[i].Error == "" {
+				IngestMessageCounter.WithLabelValues(EndpointMessages, "rejected").Inc()
+				results[i] = producer_structs.IngestResult{Index: i, Id: message.Id, EventId: message.EventId, Error: errNotPublished.Error()}
+			}
+		}
+		code = http.StatusBadRequest
+		admin.WriteResponse(w, code, "Failure", fmt.Sprintf("%d of %d messages are invalid, none were published.", invalid, len(raw)), results)
+		return
+	}
+
+	for i, message := range messages {
+		results[i] = h.publish(tracing.ExtractHTTP(r), EndpointMessages, i, message)
+		if results[i].Error != "" {
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	if code != http.StatusOK {
+		admin.WriteResponse(w, code, "Failure", "Some messages could not be published.", results)
+		return
+	}
+	admin.WriteResponse(w, code, "Success", "Messages published successfully.", results)
+}
+
+// PostNDJSON streams newline delimited messages, publishing each line as it is read and
+// streaming back one result per line.
+func (h *IngestHandler) PostNDJSON(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	code := http.StatusOK
+	defer func() {
+		observeRequest(EndpointMessagesNDJSON, code, startTime)
+	}()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("content-type", "application/json")
+		code = http.StatusMethodNotAllowed
+		admin.WriteResponse(w, code, "Failure", "Method not allowed", nil)
+		return
+	}
+
+	ctx := tracing.ExtractHTTP(r)
+	w.Header().Set("content-type", "application/x-ndjson")
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxRequestBytes())
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(h.maxRequestBytes()))
+	index := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var result producer_structs.IngestResult
+		message, err := h.decodeMessage(line)
+		if err != nil {
+			IngestMessageCounter.WithLabelValues(EndpointMessagesNDJSON, "invalid").Inc()
+			result = producer_structs.IngestResult{Index: index, Error: err.Error()}
+		} else {
+			result = h.publish(ctx, EndpointMessagesNDJSON, index, message)
+		}
+
+		if er := encoder.Encode(result); er != nil {
+			logging.Error("Error in writing ndjson ingestion result", logging.Err(er))
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		index++
+	}
+
+	// Headers are already sent, so a failed read can only be reported as a trailing line
+	if err := scanner.Err(); err != nil {
+		code = statusForBodyError(err)
+		_ = encoder.Encode(producer_structs.IngestResult{Index: -1, Error: err.Error()})
+	}
+}
+
+// publish sends message in a span continuing the trace of the request in ctx, if any.
+func (h *IngestHandler) publish(ctx context.Context, endpoint string, index int, message envelope.Envelope) producer_structs.IngestResult {
+	result := producer_structs.IngestResult{Index: index, Id: message.Id, EventId: message.EventId}
+
+	producerMsg, err := h.Encoder.Message(h.Topic, message)
+	if err != nil {
+		IngestMessageCounter.WithLabelValues(endpoint, "invalid").Inc()
+		result.Error = err.Error()
+		return result
+	}
+
+	label := h.IdLabels.Value(message.Id)
+	_, span := tracing.StartPublishSpan(ctx, tracer, producerMsg, tracing.EnvelopeAttributes(message)...)
+	partition, offset, err := h.Producer.SendMessage(label, producerMsg)
+	tracing.RecordError(span, err)
+	span.End()
+	if err != nil {
+		IngestMessageCounter.WithLabelValues(endpoint, "failed").Inc()
+		result.Error = err.Error()
+		return result
+	}
+
+	IngestMessageCounter.WithLabelValues(endpoint, "published").Inc()
+	publisher.ProducedCounter.WithLabelValues(label).Inc()
+	result.Partition = partition
+	result.Offset = offset
+	return result
+}
+
+func (h *IngestHandler) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, h.maxRequestBytes()))
+	return buf.Bytes(), err
+}
+
+func (h *IngestHandler) maxRequestBytes() int64 {
+	if h.MaxRequestBytes > 0 {
+		return h.MaxRequestBytes
+	}
+	return DefaultMaxRequestBytes
+}
+
+func (h *IngestHandler) decodeMessage(data []byte) (envelope.Envelope, error) {
+	var msg ingestMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return envelope.Envelope{}, err
+	}
+	if msg.Id == nil || *msg.Id == "" {
+		return envelope.Envelope{}, errors.New("field 'id' is required")
+	}
+	if msg.Value == nil {
+		return envelope.Envelope{}, errors.New("field 'value' is required")
+	}
+	if math.IsNaN(*msg.Value) || math.IsInf(*msg.Value, 0) {
+		return envelope.Envelope{}, errors.New("field 'value' must be a finite number")
+	}
+
+	message := envelope.New(producer_structs.Message{Id: *msg.Id, Value: *msg.Value}, h.Source)
+	// Keep the identity of events that already carry one, so that retries can be deduped
+	if msg.EventId != "" {
+		message.EventId = msg.EventId
+		if !msg.EventTime.IsZero() {
+			message.EventTime = msg.EventTime
+		}
+		if msg.Source != "" {
+			message.Source = msg.Source
+		}
+	}
+	message.Attributes = msg.Attributes
+	return message, nil
+}
+
+func statusForBodyError(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, bufio.ErrTooLong) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func observeRequest(endpoint string, code int, startTime time.Time) {
+	IngestRequestCounter.WithLabelValues(endpoint, strconv.Itoa(code)).Inc()
+	IngestLatencyHistogram.WithLabelValues(endpoint).Observe(time.Since(startTime).Seconds())
+}
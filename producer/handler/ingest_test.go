@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/Shopify/sarama"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"producer/encoder"
+	"producer/producer_structs"
+	"shared/labels"
+	"shared/serde"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePublisher records the ids it is sent and acknowledges them at increasing offsets.
+type fakePublisher struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (f *fakePublisher) Publish(id string, msg *sarama.ProducerMessage) error {
+	_, _, err := f.SendMessage(id, msg)
+	return err
+}
+
+func (f *fakePublisher) SendMessage(id string, _ *sarama.ProducerMessage) (int32, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, id)
+	return 0, int64(len(f.sent) - 1), nil
+}
+
+func (f *fakePublisher) Close() error {
+	return nil
+}
+
+func newTestIngestHandler(t *testing.T) (*IngestHandler, *fakePublisher) {
+	t.Helper()
+	serializer, err := serde.New(serde.JSON, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idLabels, err := labels.New("id", labels.Config{Policy: labels.None}, labels.NewDroppedCounter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := &fakePublisher{}
+	return &IngestHandler{Producer: producer, Encoder: encoder.New(serializer), IdLabels: idLabels, Topic: "topic", Source: "test"}, producer
+}
+
+// postMessages posts body to PostMessages and returns the response code and results.
+func postMessages(t *testing.T, h *IngestHandler, body string) (int, []producer_structs.IngestResult) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.PostMessages(w, httptest.NewRequest(http.MethodPost, EndpointMessages, strings.NewReader(body)))
+
+	var resp struct {
+		Data []producer_structs.IngestResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, resp.Data
+}
+
+func ingestedMessages(t *testing.T, result string) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := IngestMessageCounter.WithLabelValues(EndpointMessages, result).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestPostMessagesPublishesEveryMessage(t *testing.T) {
+	h, producer := newTestIngestHandler(t)
+	published := ingestedMessages(t, "published")
+
+	code, results := postMessages(t, h, `[{"id": "1", "value": 1}, {"id": "2", "value": 2.5}]`)
+	if code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", code, http.StatusOK)
+	}
+	if len(results) != 2 || results[0].Id != "1" || results[1].Offset != 1 || results[1].Error != "" {
+		t.Errorf("results = %+v", results)
+	}
+	if len(producer.sent) != 2 {
+		t.Errorf("published %v, want both messages", producer.sent)
+	}
+	if got := ingestedMessages(t, "published") - published; got != 2 {
+		t.Errorf("published counter grew by %v, want 2", got)
+	}
+}
+
+func TestPostMessagesCountsOnlyInvalidMessagesAsInvalid(t *testing.T) {
+	h, producer := newTestIngestHandler(t)
+	invalid, rejected := ingestedMessages(t, "invalid"), ingestedMessages(t, "rejected")
+
+	code, results := postMessages(t, h, `[{"id": "1", "value": 1}, {"value": 2}, {"id": "3", "value": 3}, {"id": "4"}]`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("code = %d, want %d", code, http.StatusBadRequest)
+	}
+	if len(producer.sent) != 0 {
+		t.Errorf("published %v from a request with invalid messages", producer.sent)
+	}
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want one per message", len(results))
+	}
+	for i, want := range []string{errNotPublished.Error(), "field 'id' is required", errNotPublished.Error(), "field 'value' is required"} {
+		if results[i].Index != i || results[i].Error != want {
+			t.Errorf("result %d = %+v, want error %q", i, results[i], want)
+		}
+	}
+	if got := ingestedMessages(t, "invalid") - invalid; got != 2 {
+		t.Errorf("invalid counter grew by %v, want 2", got)
+	}
+	if got := ingestedMessages(t, "rejected") - rejected; got != 2 {
+		t.Errorf("rejected counter grew by %v, want 2", got)
+	}
+}
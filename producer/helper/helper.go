@@ -2,9 +2,9 @@ package helper
 
 import (
 	"encoding/json"
-	"log"
 	"os"
 	"producer/producer_structs"
+	"shared/logging"
 )
 
 func LoadProducerConfiguration(file string) (pConfig producer_structs.ProducerConfig) {
@@ -12,17 +12,17 @@ func LoadProducerConfiguration(file string) (pConfig producer_structs.ProducerCo
 	defer func(configFile *os.File) {
 		err := configFile.Close()
 		if err != nil {
-			log.Printf("Error in closing producer config file. Error: [%v]", err)
+			logging.Error("Error in closing producer config file", logging.Err(err))
 		}
 	}(configFile)
 	if err != nil {
-		log.Printf("Error in opening producer config file. Error: [%v]", err)
+		logging.Error("Error in opening producer config file", logging.String("file", file), logging.Err(err))
 		return
 	}
 	jsonParser := json.NewDecoder(configFile)
 	er := jsonParser.Decode(&pConfig)
 	if er != nil {
-		log.Printf("Error in json decoding producer config. Error: [%v]", er)
+		logging.Error("Error in json decoding producer config", logging.Err(er))
 		return
 	}
 
@@ -2,17 +2,29 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"log"
-	"math"
-	"math/rand"
 	"net/http"
 	"os"
+	"producer/chaos"
+	"producer/distribution"
+	"producer/encoder"
+	"producer/handler"
 	"producer/helper"
 	"producer/producer_structs"
+	"producer/publisher"
+	"producer/replay"
+	"producer/routes"
+	"producer/spool"
+	"producer/workload"
+	"shared/envelope"
+	"shared/health"
+	"shared/kafkametrics"
+	"shared/labels"
+	"shared/logging"
+	"shared/serde"
+	"shared/tracing"
 	"strings"
 	"sync"
 	"time"
@@ -21,22 +33,57 @@ import (
 )
 
 var (
-	brokers           = "broker_1:9092"
-	topic             = "user_details_1"
-	producerConfig    producer_structs.ProducerConfig
-	productionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Namespace: "producer",
-		Name:      "message_produced",
-		Help:      "Counter for message produced",
-	}, []string{"id"})
+	brokers              = "broker_1:9092"
+	topic                = "user_details_1"
+	producerConfig       producer_structs.ProducerConfig
+	sampler              *distribution.Sampler
+	injector             *chaos.Injector
+	msgEncoder           *encoder.Encoder
+	labelsDroppedCounter = labels.NewDroppedCounter("producer")
+	idLabels             *labels.Policy
+	tracer               = tracing.Tracer("producer")
+	source               string
 )
 
 const (
 	ProducerConfigFilename = "config.json"
+	SourceReplay           = "replay"
+
+	defaultMaxSendAge = 30 * time.Second
 )
 
 func registerPrometheusMetrics() {
-	prometheus.MustRegister(productionCounter)
+	prometheus.MustRegister(publisher.ProducedCounter)
+	prometheus.MustRegister(publisher.DeliveredCounter)
+	prometheus.MustRegister(publisher.FailedCounter)
+	prometheus.MustRegister(publisher.AckLatencyHistogram)
+	prometheus.MustRegister(publisher.TransactionCounter)
+	prometheus.MustRegister(publisher.ConnectedGauge)
+	prometheus.MustRegister(publisher.ReconnectCounter)
+	prometheus.MustRegister(publisher.SpoolDepthGauge)
+	prometheus.MustRegister(publisher.SpoolBytesGauge)
+	prometheus.MustRegister(publisher.SpoolAgeGauge)
+	prometheus.MustRegister(publisher.SpoolCounter)
+	prometheus.MustRegister(workload.TargetRpsGauge)
+	prometheus.MustRegister(workload.ActualRpsGauge)
+	prometheus.MustRegister(workload.ScheduleLagGauge)
+	prometheus.MustRegister(workload.LoadPhaseGauge)
+	prometheus.MustRegister(handler.IngestRequestCounter)
+	prometheus.MustRegister(handler.IngestMessageCounter)
+	prometheus.MustRegister(handler.IngestLatencyHistogram)
+	prometheus.MustRegister(replay.ReplayedCounter)
+	prometheus.MustRegister(replay.InvalidRecordCounter)
+	prometheus.MustRegister(replay.LoopCounter)
+	prometheus.MustRegister(replay.PositionGauge)
+	prometheus.MustRegister(replay.TotalRecordsGauge)
+	prometheus.MustRegister(replay.ProgressGauge)
+	prometheus.MustRegister(handler.ControlChanges.Counter)
+	prometheus.MustRegister(handler.ControlChanges.LastChange)
+	prometheus.MustRegister(chaos.InjectedFaultCounter)
+	prometheus.MustRegister(encoder.SerializedBytesHistogram)
+	prometheus.MustRegister(encoder.SerializeLatencyHistogram)
+	prometheus.MustRegister(labelsDroppedCounter)
+	prometheus.MustRegister(logging.SampledCounter)
 }
 
 func createConfig() *sarama.Config {
@@ -45,96 +92,292 @@ func createConfig() *sarama.Config {
 	config.Producer.Return.Successes = true
 	config.Producer.RequiredAcks = sarama.WaitForAll
 
+	if producerConfig.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(producerConfig.KafkaVersion)
+		if err != nil {
+			logging.Warn("Invalid kafka version, using sarama default", logging.String("kafka_version", producerConfig.KafkaVersion), logging.Err(err))
+		} else {
+			config.Version = version
+		}
+	}
+
+	if producerConfig.Compression != "" {
+		if err := config.Producer.Compression.UnmarshalText([]byte(producerConfig.Compression)); err != nil {
+			logging.Warn("Invalid compression codec, sending uncompressed", logging.Err(err))
+		}
+	}
+	if config.Producer.Compression == sarama.CompressionZSTD && !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+		config.Version = sarama.V2_1_0_0
+	}
+
+	// Transactions are built on top of the idempotent producer, which needs a single in-flight request
+	if producerConfig.Idempotent || producerConfig.Transaction.Id != "" {
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+	if producerConfig.Transaction.Id != "" {
+		config.Producer.Transaction.ID = producerConfig.Transaction.Id
+	}
+
+	// Batching only applies to the async producer, the sync producer flushes every message it sends
+	if producerConfig.Flush.Messages > 0 {
+		config.Producer.Flush.Messages = producerConfig.Flush.Messages
+	}
+	if producerConfig.Flush.Frequency > 0 {
+		config.Producer.Flush.Frequency = time.Duration(producerConfig.Flush.Frequency) * time.Millisecond
+	}
+	if producerConfig.Flush.Bytes > 0 {
+		config.Producer.Flush.Bytes = producerConfig.Flush.Bytes
+	}
+
 	return config
 }
 
 func main() {
 	producerConfig = helper.LoadProducerConfiguration(os.Getenv("APP_HOME") + "/config/" + ProducerConfigFilename)
-	log.Printf("Producer Config: [%v]", producerConfig)
+	logger, err := logging.New(producerConfig.AppName, producerConfig.Logging)
+	if err != nil {
+		logging.Fatal("Error in creating logger", logging.Err(err))
+	}
+	logging.SetDefault(logger)
+	logging.Info("Producer config loaded", logging.Any("config", producerConfig))
+
+	source = instanceName()
+	sampler = distribution.NewSampler(producerConfig)
+	msgEncoder = newEncoder()
+	injector = chaos.NewInjector(producerConfig.Chaos, producerConfig.Seed, msgEncoder.Serializer)
+	if idLabels, err = labels.New("id", producerConfig.Metrics.IdLabels, labelsDroppedCounter); err != nil {
+		logging.Fatal("Error in creating id label policy", logging.Err(err))
+	}
+	idLabels.OnEvict(publisher.ProducedCounter, publisher.DeliveredCounter, publisher.FailedCounter)
 
-	log.Println("Starting a new Sarama producer...")
+	logging.Info("Starting a new Sarama producer")
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Register Prometheus custom metrics
-	http.Handle("/metrics", promhttp.Handler())
+	shutdownTracing, err := tracing.Init(ctx, producerConfig.AppName, producerConfig.Tracing)
+	if err != nil {
+		logging.Fatal("Error in initiating tracing", logging.Err(err))
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logging.Error("Error in flushing traces", logging.Err(err))
+		}
+	}()
+
+	// Register Prometheus custom metrics, exemplars are only served in the OpenMetrics format
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	if buckets := producerConfig.Metrics.LatencyBuckets["send"]; len(buckets) > 0 {
+		publisher.AckLatencyHistogram = publisher.NewAckLatencyHistogram(buckets)
+	}
 	registerPrometheusMetrics()
 
 	// Start http server
-	fmt.Printf("Starting server at port 8181...\n")
+	logging.Info("Starting server", logging.Int("port", 8181))
 	go func() {
 		if err := http.ListenAndServe(":8181", nil); err != nil {
-			log.Fatal(err)
+			logging.Fatal("Error in serving http", logging.Err(err))
 		}
 	}()
 
 	config := createConfig()
-	producer, err := sarama.NewSyncProducer(strings.Split(brokers, ","), config)
-	if err != nil {
-		log.Printf("Producer. Error in creating producer. Error: [%v]", err)
-	}
+	prometheus.MustRegister(kafkametrics.NewCollector(config.MetricRegistry))
+	logging.Info("Starting producer", logging.String("mode", producerConfig.ProducerMode), logging.String("compression", config.Producer.Compression.String()))
+	producer := publisher.NewSpooledPublisher(func() (publisher.Publisher, error) {
+		p, err := publisher.New(producerConfig.ProducerMode, strings.Split(brokers, ","), config, producerConfig.Transaction.BatchSize,
+			time.Duration(producerConfig.Transaction.MaxAge)*time.Millisecond)
+		if err != nil {
+			logging.Error("Error in creating producer", logging.Err(err))
+		}
+		return p, err
+	}, openSpool(),
+		time.Duration(producerConfig.Reconnect.InitialBackoff)*time.Millisecond,
+		time.Duration(producerConfig.Reconnect.MaxBackoff)*time.Millisecond)
+
+	// The checker stops with ctx, it doesn't keep a finished replay from exiting
+	checker := newHealthChecker(producer)
+	prometheus.MustRegister(checker.Collector())
+	go checker.Run(ctx)
 
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
+	var generator *workload.Generator
+	profileCtx, stopProfile := context.WithCancel(ctx)
+	defer stopProfile()
+	if producerConfig.Source == SourceReplay {
+		replayer := replay.NewReplayer(producerConfig.Replay, func(record replay.Record) {
+			message := envelope.New(record.Message, source)
+			// Replayed events keep the time they originally happened at as event time
+			if !record.Timestamp.IsZero() {
+				message.EventTime = record.Timestamp.UTC()
+			}
+			publishRecord(producer, message)
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replayer.Run(ctx)
+		}()
+	} else {
+		generator = workload.NewGenerator(targetRps(), producerConfig.Senders, func() {
+			produceRecord(producer)
+		})
+		generatorCtx, stopGenerator := context.WithCancel(ctx)
+		defer stopGenerator()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			generator.Run(generatorCtx)
+		}()
+		go func() {
+			defer wg.Done()
+			workload.NewProfile(producerConfig.LoadProfile).Run(profileCtx, generator, stopGenerator)
+		}()
+	}
+
+	// Register http routes
+	routes.RegisterRoutes(&handler.IngestHandler{
+		Producer:        producer,
+		Encoder:         msgEncoder,
+		IdLabels:        idLabels,
+		Topic:           topic,
+		Source:          source,
+		MaxRequestBytes: producerConfig.Ingest.MaxRequestBytes,
+	}, &handler.ControlHandler{
+		Token:       controlToken(),
+		Config:      producerConfig,
+		Generator:   generator,
+		Sampler:     sampler,
+		StopProfile: stopProfile,
+		Burst: func(count int) {
+			for i := 0; i < count; i++ {
 				produceRecord(producer)
-				time.Sleep(time.Duration(producerConfig.MessageInterval) * time.Millisecond)
 			}
-			//break
-		}
-	}()
+		},
+	}, checker)
 
 	wg.Wait()
 	cancel()
+
+	if err := producer.Close(); err != nil {
+		logging.Error("Error in closing producer", logging.Err(err))
+	}
 }
 
-func getEncodedMessage() []byte {
-	// Randomly create a json object of type Message, convert and return in []byte
-	rand.Seed(time.Now().UnixNano())
-	return encodeMessage(producer_structs.Message{
-		Id:    producerConfig.UniqueIds[rand.Intn(len(producerConfig.UniqueIds))],
-		Value: math.Round(producerConfig.ValuesMin+rand.Float64()*(producerConfig.ValuesMax-producerConfig.ValuesMin)*100) / 100,
+// newHealthChecker checks for readiness that the producer is connected to kafka and that messages
+// are still being delivered.
+func newHealthChecker(producer *publisher.SpooledPublisher) *health.Checker {
+	healthConfig := producerConfig.Health
+	checker := health.NewChecker("producer", time.Duration(healthConfig.Interval)*time.Millisecond,
+		time.Duration(healthConfig.Timeout)*time.Millisecond)
+	checker.Ready("kafka_connected", func(context.Context) error {
+		if !producer.Connected() {
+			return publisher.ErrNotConnected
+		}
+		return nil
 	})
-	//return encodeMessage(structs.Message{
-	//	Id:    "1330",
-	//	Value: 100.5,
-	//})
+	maxSendAge := time.Duration(healthConfig.MaxSendAge) * time.Millisecond
+	if maxSendAge <= 0 {
+		maxSendAge = defaultMaxSendAge
+	}
+	checker.Ready("recent_send", func(context.Context) error {
+		// Without failures since the last delivery the producer is idle, not stuck
+		delivered, failed := publisher.LastDelivery()
+		if time.Since(delivered) <= maxSendAge || !failed.After(delivered) {
+			return nil
+		}
+		if delivered.IsZero() {
+			return fmt.Errorf("no message delivered yet, last failure at %v", failed.Format(time.RFC3339))
+		}
+		return fmt.Errorf("no message delivered since %v, last failure at %v", delivered.Format(time.RFC3339), failed.Format(time.RFC3339))
+	})
+	return checker
 }
 
-func encodeMessage(msg interface{}) []byte {
-	val, er := json.Marshal(msg)
-	if er != nil {
-		log.Printf("Error in converting struct to json. Error: [%v]", val)
+// openSpool opens the configured on-disk spool, returning nil when it is disabled or unusable.
+func openSpool() *spool.Spool {
+	if producerConfig.Spool.Dir == "" {
+		return nil
 	}
+	s, err := spool.Open(producerConfig.Spool.Dir, producerConfig.Spool.MaxBytes, producerConfig.Spool.SegmentBytes)
+	if err != nil {
+		logging.Error("Error in opening spool, messages will be dropped while kafka is down", logging.String("dir", producerConfig.Spool.Dir), logging.Err(err))
+		return nil
+	}
+	return s
+}
 
-	return val
+// instanceName identifies this producer in the envelope of every message it publishes.
+func instanceName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return producerConfig.AppName
+	}
+	return producerConfig.AppName + "/" + hostname
 }
 
-func getDecodedMessage(msg []byte) (producer_structs.Message, error) {
-	var value producer_structs.Message
-	if err := json.Unmarshal(msg, &value); err != nil {
-		return producer_structs.Message{}, err
+// controlToken returns the control api token, PRODUCER_CONTROL_TOKEN takes precedence over the config.
+func controlToken() string {
+	if token := os.Getenv("PRODUCER_CONTROL_TOKEN"); token != "" {
+		return token
 	}
-	return value, nil
+	return producerConfig.Control.Token
 }
 
-func produceRecord(producer sarama.SyncProducer) {
-	// Produce records
-	msgBytes := getEncodedMessage()
-	producerMsg := &sarama.ProducerMessage{Topic: topic, Key: nil, Value: sarama.StringEncoder(msgBytes)}
-	partition, offset, er := producer.SendMessage(producerMsg)
-	if er != nil {
-		log.Printf("Producer. Unable to Send Message to topic. Error: [%v]", er)
+// newEncoder creates the configured message encoding, exiting when it can't be set up.
+func newEncoder() *encoder.Encoder {
+	encoding := producerConfig.Encoding
+	subject := encoding.Subject
+	if subject == "" {
+		subject = topic + "-value"
+	}
+	serializer, err := serde.New(encoding.Type, serde.NewRegistry(encoding.SchemaRegistryUrl), subject)
+	if err != nil {
+		logging.Fatal("Error in creating serializer", logging.String("encoding", encoding.Type), logging.Err(err))
+	}
+	return encoder.New(serializer)
+}
+
+// targetRps returns the configured rate, falling back to the legacy message interval.
+func targetRps() float64 {
+	if producerConfig.TargetRps > 0 {
+		return producerConfig.TargetRps
+	}
+	if producerConfig.MessageInterval > 0 {
+		return 1000 / float64(producerConfig.MessageInterval)
+	}
+	return 0
+}
+
+func produceRecord(producer publisher.Publisher) {
+	// Randomly create a message and wrap it in an envelope
+	publishRecord(producer, envelope.New(producer_structs.Message{
+		Id:    sampler.Id(),
+		Value: sampler.Value(),
+	}, source))
+}
+
+func publishRecord(producer publisher.Publisher, message envelope.Envelope) {
+	producerMsg, err := msgEncoder.Message(topic, message)
+	if err != nil {
+		logging.Error("Error in serializing message", logging.String("id", message.Id), logging.Err(err))
 		return
 	}
-	log.Printf("Producer: message successfully published: produced message- [%v]. Partition: [%v]. Offset: [%v]", string(msgBytes), partition, offset)
+	ctx, span := tracing.StartPublishSpan(context.Background(), tracer, producerMsg, tracing.EnvelopeAttributes(message)...)
+	defer span.End()
+	logging.WithContext(ctx).Debug("Publishing message", logging.String("topic", topic), logging.String("id", message.Id), logging.String("event_id", message.EventId))
 
-	// Update production counter metric
-	decodedMessage, _ := getDecodedMessage(msgBytes)
-	productionCounter.WithLabelValues(decodedMessage.Id).Inc()
+	// With chaos enabled the message may be corrupted or duplicated
+	label := idLabels.Value(message.Id)
+	for _, msg := range injector.Inject(producerMsg, message) {
+		if er := producer.Publish(label, msg); er != nil {
+			tracing.RecordError(span, er)
+			continue
+		}
+
+		// Update production counter metric
+		publisher.ProducedCounter.WithLabelValues(label).Inc()
+	}
 }
@@ -1,14 +1,196 @@
 package producer_structs
 
+import (
+	"shared/envelope"
+	"shared/labels"
+	"shared/logging"
+	"shared/tracing"
+)
+
 type ProducerConfig struct {
-	AppName         string   `json:"app_name"`
-	MessageInterval int64    `json:"message_interval"`
-	UniqueIds       []string `json:"unique_ids"`
-	ValuesMin       float64  `json:"values_min"`
-	ValuesMax       float64  `json:"values_max"`
+	AppName           string                  `json:"app_name"`
+	MessageInterval   int64                   `json:"message_interval"` // legacy, superseded by target_rps
+	UniqueIds         []string                `json:"unique_ids"`
+	ValuesMin         float64                 `json:"values_min"`
+	ValuesMax         float64                 `json:"values_max"`
+	ProducerMode      string                  `json:"producer_mode"`
+	KafkaVersion      string                  `json:"kafka_version"`
+	Compression       string                  `json:"compression"`
+	Flush             FlushConfig             `json:"flush"`
+	Idempotent        bool                    `json:"idempotent"`
+	Transaction       TransactionConfig       `json:"transaction"`
+	TargetRps         float64                 `json:"target_rps"`
+	Senders           int                     `json:"senders"`
+	LoadProfile       LoadProfileConfig       `json:"load_profile"`
+	Seed              int64                   `json:"seed"`
+	IdDistribution    IdDistributionConfig    `json:"id_distribution"`
+	ValueDistribution ValueDistributionConfig `json:"value_distribution"`
+	Ingest            IngestConfig            `json:"ingest"`
+	Source            string                  `json:"source"`
+	Replay            ReplayConfig            `json:"replay"`
+	Spool             SpoolConfig             `json:"spool"`
+	Reconnect         ReconnectConfig         `json:"reconnect"`
+	Control           ControlConfig           `json:"control"`
+	Chaos             ChaosConfig             `json:"chaos"`
+	Encoding          EncodingConfig          `json:"encoding"`
+	Metrics           MetricsConfig           `json:"metrics"`
+	Tracing           tracing.Config          `json:"tracing"`
+	Logging           logging.Config          `json:"logging"`
+	Health            HealthConfig            `json:"health"`
+}
+
+// HealthConfig runs the health checks every Interval milliseconds, failing those that take longer
+// than Timeout. The producer isn't ready when messages failed and none was delivered for
+// MaxSendAge milliseconds, an idle producer stays ready.
+type HealthConfig struct {
+	Interval   int64 `json:"interval"`
+	Timeout    int64 `json:"timeout"`
+	MaxSendAge int64 `json:"max_send_age"`
+}
+
+// FlushConfig controls batching of the async producer, zero values keep sarama's defaults.
+type FlushConfig struct {
+	Messages  int   `json:"messages"`
+	Frequency int64 `json:"frequency"`
+	Bytes     int   `json:"bytes"`
+}
+
+// TransactionConfig enables kafka transactions when Id is set, BatchSize messages are committed together.
+// A partial batch is committed once its transaction is MaxAge milliseconds old.
+type TransactionConfig struct {
+	Id        string `json:"id"`
+	BatchSize int    `json:"batch_size"`
+	MaxAge    int64  `json:"max_age"`
+}
+
+// LoadProfileConfig describes phases that drive target_rps over time. OnComplete is one of
+// "loop", "stop" or "hold" and decides what happens after the last phase.
+type LoadProfileConfig struct {
+	Phases     []PhaseConfig `json:"phases"`
+	OnComplete string        `json:"on_complete"`
+}
+
+// PhaseConfig is a single load phase, durations are in milliseconds. Rps is the constant or
+// starting rate and ToRps the final, peak or upper rate depending on the shape.
+type PhaseConfig struct {
+	Name          string  `json:"name"`
+	Shape         string  `json:"shape"`
+	Duration      int64   `json:"duration"`
+	Rps           float64 `json:"rps"`
+	ToRps         float64 `json:"to_rps"`
+	Steps         int     `json:"steps"`
+	SpikeDuration int64   `json:"spike_duration"`
+	Period        int64   `json:"period"`
+}
+
+// IdDistributionConfig picks ids "uniform"ly, by "zipf" rank or with a "hotkey" skew where
+// HotFraction of the messages go to the first HotKeys ids.
+type IdDistributionConfig struct {
+	Type        string  `json:"type"`
+	ZipfS       float64 `json:"zipf_s"`
+	ZipfV       float64 `json:"zipf_v"`
+	HotKeys     int     `json:"hot_keys"`
+	HotFraction float64 `json:"hot_fraction"`
+}
+
+// ValueDistributionConfig draws values "uniform"ly, from a "normal" distribution with Mean and
+// StdDev or a "lognormal" one with Mu and Sigma. Values are always kept within the configured range.
+type ValueDistributionConfig struct {
+	Type   string  `json:"type"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"std_dev"`
+	Mu     float64 `json:"mu"`
+	Sigma  float64 `json:"sigma"`
+}
+
+type IngestConfig struct {
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+}
+
+// ReplayConfig is used when source is "replay". Format is "jsonl" or "csv", inferred from the
+// file extension when empty. Speed scales the original inter-arrival times, zero replays as fast
+// as possible.
+type ReplayConfig struct {
+	File   string  `json:"file"`
+	Format string  `json:"format"`
+	Speed  float64 `json:"speed"`
+	Loop   bool    `json:"loop"`
+}
+
+// SpoolConfig buffers messages on disk while kafka is unavailable, an empty Dir disables it.
+type SpoolConfig struct {
+	Dir          string `json:"dir"`
+	MaxBytes     int64  `json:"max_bytes"`
+	SegmentBytes int64  `json:"segment_bytes"`
+}
+
+// ReconnectConfig bounds the exponential backoff between connection attempts, in milliseconds.
+type ReconnectConfig struct {
+	InitialBackoff int64 `json:"initial_backoff"`
+	MaxBackoff     int64 `json:"max_backoff"`
+}
+
+// EncodingConfig selects the wire format of produced messages: json, protobuf or avro. Avro
+// registers its schema under Subject, "<topic>-value" by default, in the registry at
+// SchemaRegistryUrl or in memory when that is empty.
+type EncodingConfig struct {
+	Type              string `json:"type"`
+	SchemaRegistryUrl string `json:"schema_registry_url"`
+	Subject           string `json:"subject"`
+}
+
+// MetricsConfig overrides the buckets of latency histograms by name, in seconds. The producer
+// has a single one, send, for the time until kafka acknowledges a message. IdLabels bounds the
+// values of id labels.
+type MetricsConfig struct {
+	LatencyBuckets map[string][]float64 `json:"latency_buckets"`
+	IdLabels       labels.Config        `json:"id_labels"`
 }
 
-type Message struct {
-	Id    string  `json:"id"`
-	Value float64 `json:"value"`
+// ControlConfig protects the runtime control api, which is disabled while Token is empty.
+type ControlConfig struct {
+	Token string `json:"token"`
 }
+
+// ControlRequest is the body of the control api, each endpoint reads the fields it needs.
+type ControlRequest struct {
+	TargetRps *float64 `json:"target_rps"`
+	UniqueIds []string `json:"unique_ids"`
+	ValuesMin *float64 `json:"values_min"`
+	ValuesMax *float64 `json:"values_max"`
+	Count     int      `json:"count"`
+	Level     string   `json:"level"`
+}
+
+// RuntimeConfig is the effective configuration, i.e. the loaded one plus runtime changes.
+type RuntimeConfig struct {
+	Paused    bool           `json:"paused"`
+	TargetRps float64        `json:"target_rps"`
+	UniqueIds []string       `json:"unique_ids"`
+	ValuesMin float64        `json:"values_min"`
+	ValuesMax float64        `json:"values_max"`
+	LogLevel  string         `json:"log_level"`
+	Config    ProducerConfig `json:"config"`
+}
+
+// ChaosConfig injects faults into the produced stream. Faults maps a fault type to the
+// percentage of messages carrying it, OutOfOrderSkew is in milliseconds.
+type ChaosConfig struct {
+	Enabled        bool               `json:"enabled"`
+	Faults         map[string]float64 `json:"faults"`
+	OversizedBytes int                `json:"oversized_bytes"`
+	OutOfOrderSkew int64              `json:"out_of_order_skew"`
+}
+
+// IngestResult reports where an ingested message was written, or why it wasn't.
+type IngestResult struct {
+	Index     int    `json:"index"`
+	Id        string `json:"id,omitempty"`
+	EventId   string `json:"event_id,omitempty"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Message is the payload shared with the consumer, it is published wrapped in an envelope.
+type Message = envelope.Message
@@ -0,0 +1,93 @@
+package publisher
+
+import (
+	"github.com/Shopify/sarama"
+	"shared/logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type asyncPublisher struct {
+	producer  sarama.AsyncProducer
+	wg        sync.WaitGroup
+	onFailure atomic.Value
+	// transactional leaves counting deliveries to the transactional publisher
+	transactional bool
+	// spooled leaves retriable failures to the SpooledPublisher
+	spooled atomic.Bool
+}
+
+func newAsyncPublisher(brokers []string, config *sarama.Config) (*asyncPublisher, error) {
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &asyncPublisher{producer: producer}
+	p.wg.Add(2)
+	go p.trackSuccesses()
+	go p.trackErrors()
+
+	return p, nil
+}
+
+func (p *asyncPublisher) Publish(id string, msg *sarama.ProducerMessage) error {
+	msg.Metadata = delivery{id: id, startTime: time.Now()}
+	p.producer.Input() <- msg
+	return nil
+}
+
+func (p *asyncPublisher) SendMessage(id string, msg *sarama.ProducerMessage) (int32, int64, error) {
+	done := make(chan error, 1)
+	msg.Metadata = delivery{id: id, startTime: time.Now(), done: done}
+	p.producer.Input() <- msg
+	if err := <-done; err != nil {
+		return 0, 0, err
+	}
+	return msg.Partition, msg.Offset, nil
+}
+
+// Close flushes the buffered messages and waits until every one of them has been acknowledged.
+func (p *asyncPublisher) Close() error {
+	p.producer.AsyncClose()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *asyncPublisher) setSpooled(onFailure func(id string, msg *sarama.ProducerMessage, err error)) {
+	p.onFailure.Store(onFailure)
+	p.spooled.Store(true)
+}
+
+func (p *asyncPublisher) deliveryMode() string {
+	return ModeAsync
+}
+
+func (p *asyncPublisher) trackSuccesses() {
+	defer p.wg.Done()
+	for msg := range p.producer.Successes() {
+		d, _ := msg.Metadata.(delivery)
+		observeDelivery(ModeAsync, d.id, msg, d.startTime, nil, !p.transactional)
+		if d.done != nil {
+			d.done <- nil
+		}
+		if logging.Enabled(logging.DebugLevel) {
+			messageLogger(d.id, msg).Debug("Message published", logging.Int32("partition", msg.Partition), logging.Int64("offset", msg.Offset))
+		}
+	}
+}
+
+func (p *asyncPublisher) trackErrors() {
+	defer p.wg.Done()
+	for pErr := range p.producer.Errors() {
+		d, _ := pErr.Msg.Metadata.(delivery)
+		observeDelivery(ModeAsync, d.id, pErr.Msg, d.startTime, pErr.Err, countsDelivery(p.transactional, p.spooled.Load(), pErr.Err))
+		if d.done != nil {
+			d.done <- pErr.Err
+		} else if onFailure, ok := p.onFailure.Load().(func(string, *sarama.ProducerMessage, error)); ok {
+			onFailure(d.id, pErr.Msg, pErr.Err)
+		}
+		messageLogger(d.id, pErr.Msg).Error("Unable to send message", logging.Err(pErr.Err))
+	}
+}
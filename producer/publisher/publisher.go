@@ -0,0 +1,150 @@
+package publisher
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"shared/logging"
+	"shared/tracing"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ModeSync  = "sync"
+	ModeAsync = "async"
+)
+
+var (
+	// ProducedCounter counts messages handed to the publisher, by the generator, replay and ingestion
+	ProducedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "message_produced",
+		Help:      "Counter for message produced",
+	}, []string{"id"})
+	DeliveredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "message_delivered",
+		Help:      "Counter for messages acknowledged by kafka",
+	}, []string{"id", "mode"})
+	FailedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "message_failed",
+		Help:      "Counter for messages kafka failed to acknowledge",
+	}, []string{"id", "mode"})
+	AckLatencyHistogram = NewAckLatencyHistogram(prometheus.ExponentialBuckets(0.001, 2, 12))
+
+	// Unix nanoseconds of the last acknowledged and the last failed message, for health checks
+	lastDelivered atomic.Int64
+	lastFailed    atomic.Int64
+)
+
+// NewAckLatencyHistogram creates the send latency histogram with custom buckets, to replace
+// AckLatencyHistogram before it is registered.
+func NewAckLatencyHistogram(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "producer",
+		Name:      "produce_ack_latency_seconds",
+		Help:      "Latency between handing a message to the producer and kafka acknowledging it",
+		Buckets:   buckets,
+	}, []string{"mode"})
+}
+
+// Publisher hands messages to kafka and tracks their delivery.
+type Publisher interface {
+	// Publish sends msg, labelling its delivery metrics with id. A sync publisher returns the
+	// send error directly, an async publisher only reports it through its error channel.
+	Publish(id string, msg *sarama.ProducerMessage) error
+	// SendMessage publishes msg and waits until kafka has acknowledged it.
+	SendMessage(id string, msg *sarama.ProducerMessage) (partition int32, offset int64, err error)
+	Close() error
+}
+
+// spoolable is implemented by the publishers a SpooledPublisher connects to. Once spooled, they
+// don't count retriable failures as failed since the SpooledPublisher spools those messages, and
+// hand it the messages that fail after Publish has returned through onFailure.
+type spoolable interface {
+	setSpooled(onFailure func(id string, msg *sarama.ProducerMessage, err error))
+	deliveryMode() string
+}
+
+// delivery is attached to every async message as metadata so that the success and error
+// channels can attribute the acknowledgement, and notify done if somebody is waiting for it.
+type delivery struct {
+	id        string
+	startTime time.Time
+	done      chan error
+}
+
+// New creates a Publisher for the given mode, defaulting to sync. When config carries a
+// transactional id, messages are committed in transactions of txnBatchSize messages, or once
+// a transaction is txnMaxAge old.
+func New(mode string, brokers []string, config *sarama.Config, txnBatchSize int, txnMaxAge time.Duration) (Publisher, error) {
+	if mode == ModeAsync {
+		p, err := newAsyncPublisher(brokers, config)
+		if err != nil {
+			return nil, err
+		}
+		if p.producer.IsTransactional() {
+			p.transactional = true
+			return newTransactionalPublisher(p, p.producer, ModeAsync, txnBatchSize, txnMaxAge), nil
+		}
+		return p, nil
+	}
+
+	p, err := newSyncPublisher(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	if p.producer.IsTransactional() {
+		p.transactional = true
+		return newTransactionalPublisher(p, p.producer, ModeSync, txnBatchSize, txnMaxAge), nil
+	}
+	return p, nil
+}
+
+// messageLogger logs with the topic and id of msg and the trace it was published in.
+func messageLogger(id string, msg *sarama.ProducerMessage) *logging.Logger {
+	return logging.WithContext(tracing.Published(msg)).With(logging.String("topic", msg.Topic), logging.String("id", id))
+}
+
+// observeDelivery records the acknowledgement of msg, with the trace it was published in as exemplar,
+// and counts it unless counted is false.
+func observeDelivery(mode string, id string, msg *sarama.ProducerMessage, startTime time.Time, err error, counted bool) {
+	tracing.Observe(tracing.Published(msg), AckLatencyHistogram.WithLabelValues(mode), time.Since(startTime).Seconds())
+	if counted {
+		countDelivery(mode, id, err)
+	} else if err != nil {
+		lastFailed.Store(time.Now().UnixNano())
+	}
+}
+
+// countsDelivery reports whether a publisher counts a delivery with err itself. Messages of a
+// transaction are only counted once it ends, and a spooled publisher leaves retriable failures
+// to the spool, which sends the messages again.
+func countsDelivery(transactional bool, spooled bool, err error) bool {
+	return !transactional && (err == nil || !spooled || !retriable(err))
+}
+
+// countDelivery counts a message as delivered, or as failed when err is set.
+func countDelivery(mode string, id string, err error) {
+	if err != nil {
+		lastFailed.Store(time.Now().UnixNano())
+		FailedCounter.WithLabelValues(id, mode).Inc()
+		return
+	}
+	lastDelivered.Store(time.Now().UnixNano())
+	DeliveredCounter.WithLabelValues(id, mode).Inc()
+}
+
+// LastDelivery returns when kafka last acknowledged a message and when a message last failed,
+// zero times if none has yet.
+func LastDelivery() (delivered time.Time, failed time.Time) {
+	return unixTime(lastDelivered.Load()), unixTime(lastFailed.Load())
+}
+
+func unixTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,358 @@
+package publisher
+
+import (
+	"errors"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"producer/spool"
+	"shared/logging"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 30 * time.Second
+)
+
+var (
+	ErrNotConnected = errors.New("producer is not connected to kafka")
+
+	ConnectedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "kafka_connected",
+		Help:      "Set to 1 while the producer is connected to kafka and not draining the spool",
+	})
+	ReconnectCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "kafka_reconnect_attempts",
+		Help:      "Counter for attempts to (re)connect the producer to kafka by result",
+	}, []string{"result"})
+	SpoolDepthGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "spool_depth_messages",
+		Help:      "Number of messages waiting in the local spool",
+	})
+	SpoolBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "spool_bytes",
+		Help:      "Size of the local spool on disk",
+	})
+	SpoolAgeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "spool_oldest_message_age_seconds",
+		Help:      "Age of the oldest message waiting in the local spool",
+	})
+	SpoolCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "spool_messages",
+		Help:      "Counter for messages going through the local spool by action",
+	}, []string{"action"})
+)
+
+// SpooledPublisher connects to kafka in the background with exponential backoff. While kafka
+// is unreachable, messages are buffered in an on-disk spool and drained in order on recovery.
+type SpooledPublisher struct {
+	connect        func() (Publisher, error)
+	spool          *spool.Spool
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu       sync.RWMutex
+	inner    Publisher
+	mode     string
+	spooling bool
+
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSpooledPublisher starts connecting with connect right away. A nil spool drops, and counts,
+// the messages published while kafka is down.
+func NewSpooledPublisher(connect func() (Publisher, error), spool *spool.Spool, initialBackoff time.Duration, maxBackoff time.Duration) *SpooledPublisher {
+	if initialBackoff <= 0 {
+		initialBackoff = DefaultInitialBackoff
+	}
+	if maxBackoff < initialBackoff {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	p := &SpooledPublisher{
+		connect:        connect,
+		spool:          spool,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		spooling:       true,
+		wake:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+	}
+	p.wg.Add(2)
+	go p.run()
+	go p.reportSpool()
+
+	return p
+}
+
+// Publish sends msg directly when connected and the spool is empty, otherwise it is spooled
+// behind the pending messages to keep them in order. Messages kafka rejects are not spooled,
+// retrying them can't succeed.
+func (p *SpooledPublisher) Publish(id string, msg *sarama.ProducerMessage) error {
+	p.mu.RLock()
+	if p.spooling {
+		// Keep holding the lock until the message is in the spool, so that recover can't stop
+		// spooling in between and leave it stranded there
+		defer p.mu.RUnlock()
+		return p.spoolMessage(id, msg)
+	}
+	inner := p.inner
+	p.mu.RUnlock()
+
+	if err := inner.Publish(id, msg); err != nil {
+		if !retriable(err) {
+			return err
+		}
+		return p.spoolFailed(id, msg)
+	}
+	return nil
+}
+
+// SendMessage is not spooled since the caller waits for a partition and offset. Its failures
+// are counted here, the connected publisher leaves retriable ones to the spool.
+func (p *SpooledPublisher) SendMessage(id string, msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mu.RLock()
+	inner, mode, spooling := p.inner, p.mode, p.spooling
+	p.mu.RUnlock()
+
+	if inner == nil || spooling {
+		return 0, 0, ErrNotConnected
+	}
+	partition, offset, err := inner.SendMessage(id, msg)
+	if err != nil && retriable(err) {
+		countDelivery(mode, id, err)
+	}
+	return partition, offset, err
+}
+
+// Connected reports whether messages currently go straight to kafka.
+func (p *SpooledPublisher) Connected() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.inner != nil && !p.spooling
+}
+
+func (p *SpooledPublisher) Close() error {
+	close(p.stop)
+	p.wg.Wait()
+
+	var err error
+	if p.inner != nil {
+		err = p.inner.Close()
+	}
+	if p.spool != nil {
+		if er := p.spool.Close(); er != nil && err == nil {
+			err = er
+		}
+	}
+	return err
+}
+
+// onAsyncFailure spools messages the async producer gave up on after its own retries.
+func (p *SpooledPublisher) onAsyncFailure(id string, msg *sarama.ProducerMessage, err error) {
+	if !retriable(err) {
+		return
+	}
+	if err := p.spoolFailed(id, msg); err != nil {
+		logging.Error("Error in spooling failed message", logging.String("id", id), logging.Err(err))
+	}
+}
+
+// spoolFailed starts spooling and spools msg in one go, for the same reason as Publish.
+func (p *SpooledPublisher) spoolFailed(id string, msg *sarama.ProducerMessage) error {
+	p.mu.Lock()
+	if !p.spooling {
+		logging.Warn("Kafka unavailable, spooling messages until it recovers")
+		p.spooling = true
+		ConnectedGauge.Set(0)
+	}
+	err := p.spoolMessage(id, msg)
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+func (p *SpooledPublisher) spoolMessage(id string, msg *sarama.ProducerMessage) error {
+	if p.spool == nil {
+		SpoolCounter.WithLabelValues("dropped").Inc()
+		return ErrNotConnected
+	}
+
+	value, err := msg.Value.Encode()
+	if err != nil {
+		return err
+	}
+	entry := spool.Entry{Id: id, Topic: msg.Topic, Value: value, Timestamp: msg.Timestamp, SpooledAt: time.Now()}
+	for _, header := range msg.Headers {
+		entry.Headers = append(entry.Headers, spool.RecordHeader{Key: string(header.Key), Value: header.Value})
+	}
+	err = p.spool.Append(entry)
+	if err != nil {
+		logging.Error("Error in spooling message, dropping it", logging.String("id", id), logging.Err(err))
+		SpoolCounter.WithLabelValues("dropped").Inc()
+		return err
+	}
+	SpoolCounter.WithLabelValues("spooled").Inc()
+	return nil
+}
+
+// run connects to kafka and, whenever spooling, drains the spool until it is empty.
+func (p *SpooledPublisher) run() {
+	defer p.wg.Done()
+
+	backoff := p.initialBackoff
+	for {
+		if err := p.recover(); err == nil {
+			backoff = p.initialBackoff
+			select {
+			case <-p.stop:
+				return
+			case <-p.wake:
+				continue
+			}
+		} else {
+			logging.Warn("Kafka still unavailable", logging.Duration("retry_in", backoff), logging.Err(err))
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+// recover creates the producer if needed and drains the spool, returning nil once messages
+// can be published directly again.
+func (p *SpooledPublisher) recover() error {
+	p.mu.RLock()
+	inner := p.inner
+	p.mu.RUnlock()
+
+	if inner == nil {
+		var err error
+		if inner, err = p.connect(); err != nil {
+			ReconnectCounter.WithLabelValues("failed").Inc()
+			return err
+		}
+		ReconnectCounter.WithLabelValues("connected").Inc()
+		mode := ""
+		if spooled, ok := inner.(spoolable); ok {
+			spooled.setSpooled(p.onAsyncFailure)
+			mode = spooled.deliveryMode()
+		}
+		p.mu.Lock()
+		p.inner, p.mode = inner, mode
+		p.mu.Unlock()
+		logging.Info("Connected to kafka")
+	}
+
+	for {
+		if err := p.drainOne(inner); err != nil {
+			return err
+		}
+
+		// Only stop spooling once the spool is empty while holding the lock, so that no
+		// message can be spooled behind the drain's back
+		p.mu.Lock()
+		if p.spool == nil || p.spool.Depth() == 0 {
+			p.spooling = false
+			p.mu.Unlock()
+			ConnectedGauge.Set(1)
+			return nil
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.stop:
+			return ErrNotConnected
+		default:
+		}
+	}
+}
+
+func (p *SpooledPublisher) drainOne(inner Publisher) error {
+	if p.spool == nil {
+		return nil
+	}
+	entry, ok, err := p.spool.Peek()
+	if err != nil || !ok {
+		return err
+	}
+
+	msg := &sarama.ProducerMessage{Topic: entry.Topic, Value: sarama.ByteEncoder(entry.Value), Timestamp: entry.Timestamp}
+	for _, header := range entry.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(header.Key), Value: header.Value})
+	}
+	if _, _, err := inner.SendMessage(entry.Id, msg); err != nil {
+		if retriable(err) {
+			return err
+		}
+		// A message kafka rejects would block the spool forever
+		logging.Error("Dropping spooled message rejected by kafka", logging.String("id", entry.Id), logging.Err(err))
+		SpoolCounter.WithLabelValues("dropped").Inc()
+		return p.spool.Ack()
+	}
+	SpoolCounter.WithLabelValues("drained").Inc()
+	return p.spool.Ack()
+}
+
+// retriable reports whether err may go away once kafka is reachable again. Errors about the
+// message itself, like exceeding the maximum message size, fail again on every retry.
+func retriable(err error) bool {
+	var configErr sarama.ConfigurationError
+	var encodingErr sarama.PacketEncodingError
+	if errors.As(err, &configErr) || errors.As(err, &encodingErr) {
+		return false
+	}
+	var kafkaErr sarama.KError
+	if errors.As(err, &kafkaErr) {
+		switch kafkaErr {
+		case sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidMessageSize, sarama.ErrInvalidRecord,
+			sarama.ErrInvalidTimestamp, sarama.ErrInvalidTopic, sarama.ErrUnsupportedCompressionType:
+			return false
+		}
+	}
+	return true
+}
+
+func (p *SpooledPublisher) reportSpool() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		if p.spool == nil {
+			continue
+		}
+
+		SpoolDepthGauge.Set(float64(p.spool.Depth()))
+		SpoolBytesGauge.Set(float64(p.spool.Bytes()))
+		if entry, ok, _ := p.spool.Peek(); ok {
+			SpoolAgeGauge.Set(time.Since(entry.SpooledAt).Seconds())
+		} else {
+			SpoolAgeGauge.Set(0)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package publisher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"producer/spool"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePublisher fails the sends of ids in fail with their error and records the others. It
+// counts deliveries like the sync publisher.
+type fakePublisher struct {
+	mu      sync.Mutex
+	fail    map[string]error
+	sent    []string
+	msgs    []*sarama.ProducerMessage
+	spooled bool
+}
+
+func (f *fakePublisher) Publish(id string, msg *sarama.ProducerMessage) error {
+	_, _, err := f.SendMessage(id, msg)
+	return err
+}
+
+func (f *fakePublisher) SendMessage(id string, msg *sarama.ProducerMessage) (int32, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail[id]; err != nil {
+		if countsDelivery(false, f.spooled, err) {
+			countDelivery(ModeSync, id, err)
+		}
+		return 0, 0, err
+	}
+	countDelivery(ModeSync, id, nil)
+	f.sent = append(f.sent, id)
+	f.msgs = append(f.msgs, msg)
+	return 0, int64(len(f.sent)), nil
+}
+
+func (f *fakePublisher) setSpooled(func(id string, msg *sarama.ProducerMessage, err error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.spooled = true
+}
+
+func (f *fakePublisher) deliveryMode() string {
+	return ModeSync
+}
+
+func (f *fakePublisher) Close() error {
+	return nil
+}
+
+func (f *fakePublisher) sentIds() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.sent...)
+}
+
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{sarama.ErrOutOfBrokers, true},
+		{sarama.ErrNotLeaderForPartition, true},
+		{sarama.ErrRequestTimedOut, true},
+		{io.EOF, true},
+		{ErrNotConnected, true},
+		{sarama.ErrMessageSizeTooLarge, false},
+		{sarama.ErrInvalidMessageSize, false},
+		{sarama.ConfigurationError("bad"), false},
+		{sarama.PacketEncodingError{Info: "bad"}, false},
+		// The async producer wraps errors with the failed message
+		{&sarama.ProducerError{Err: sarama.ErrMessageSizeTooLarge}, false},
+		{fmt.Errorf("sending: %w", sarama.ErrOutOfBrokers), true},
+	}
+	for _, tt := range tests {
+		if got := retriable(tt.err); got != tt.want {
+			t.Errorf("retriable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDrainDropsRejectedMessages(t *testing.T) {
+	s, err := spool.Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "oversized", "2"} {
+		if err := s.Append(spool.Entry{Id: id, Topic: "user_details_1", Value: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inner := &fakePublisher{fail: map[string]error{"oversized": sarama.ErrMessageSizeTooLarge}}
+	p := NewSpooledPublisher(func() (Publisher, error) { return inner, nil }, s, time.Millisecond, time.Millisecond)
+	defer p.Close()
+
+	waitFor(t, p.Connected)
+	if sent := inner.sentIds(); fmt.Sprint(sent) != "[1 2]" {
+		t.Errorf("drained %v, want [1 2]", sent)
+	}
+	if s.Depth() != 0 {
+		t.Errorf("Depth = %d after draining, want 0", s.Depth())
+	}
+}
+
+func TestPublishSpoolsOnlyRetriableErrors(t *testing.T) {
+	s, err := spool.Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &fakePublisher{fail: map[string]error{"oversized": sarama.ErrMessageSizeTooLarge}}
+	p := NewSpooledPublisher(func() (Publisher, error) { return inner, nil }, s, time.Millisecond, time.Millisecond)
+	defer p.Close()
+	waitFor(t, p.Connected)
+
+	msg := &sarama.ProducerMessage{Topic: "user_details_1", Value: sarama.StringEncoder("x")}
+	if err := p.Publish("oversized", msg); !errors.Is(err, sarama.ErrMessageSizeTooLarge) {
+		t.Errorf("Publish = %v, want the send error", err)
+	}
+	if !p.Connected() || s.Depth() != 0 {
+		t.Errorf("a rejected message started spooling, depth %d", s.Depth())
+	}
+
+	inner.mu.Lock()
+	inner.fail["down"] = sarama.ErrOutOfBrokers
+	inner.mu.Unlock()
+	if err := p.Publish("down", msg); err != nil {
+		t.Errorf("Publish = %v, want the message spooled", err)
+	}
+	// The spooled message keeps failing until the broker comes back
+	inner.mu.Lock()
+	delete(inner.fail, "down")
+	inner.mu.Unlock()
+	waitFor(t, p.Connected)
+	if sent := inner.sentIds(); fmt.Sprint(sent) != "[down]" {
+		t.Errorf("sent %v, want [down]", sent)
+	}
+}
+
+func TestSpooledMessagesKeepHeaders(t *testing.T) {
+	s, err := spool.Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &fakePublisher{fail: map[string]error{"down": sarama.ErrOutOfBrokers}}
+	p := NewSpooledPublisher(func() (Publisher, error) { return inner, nil }, s, time.Millisecond, time.Millisecond)
+	defer p.Close()
+	waitFor(t, p.Connected)
+
+	headers := []sarama.RecordHeader{
+		{Key: []byte("x-injected-fault"), Value: []byte("duplicate")},
+		{Key: []byte("traceparent"), Value: []byte("00-1")},
+		{Key: []byte("x-injected-fault"), Value: []byte("out_of_order")},
+	}
+	if err := p.Publish("down", &sarama.ProducerMessage{Topic: "user_details_1", Value: sarama.StringEncoder("x"), Headers: headers}); err != nil {
+		t.Fatal(err)
+	}
+	inner.mu.Lock()
+	delete(inner.fail, "down")
+	inner.mu.Unlock()
+	waitFor(t, p.Connected)
+
+	inner.mu.Lock()
+	defer inner.mu.Unlock()
+	if len(inner.msgs) != 1 || fmt.Sprint(inner.msgs[0].Headers) != fmt.Sprint(headers) {
+		t.Errorf("drained %d messages with headers %v, want %v", len(inner.msgs), inner.msgs, headers)
+	}
+}
+
+func TestSpooledMessagesAreNotCountedAsFailed(t *testing.T) {
+	s, err := spool.Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &fakePublisher{fail: map[string]error{
+		"spooled":  sarama.ErrOutOfBrokers,
+		"ingested": sarama.ErrOutOfBrokers,
+		"rejected": sarama.ErrMessageSizeTooLarge,
+	}}
+	p := NewSpooledPublisher(func() (Publisher, error) { return inner, nil }, s, time.Millisecond, time.Millisecond)
+	defer p.Close()
+	waitFor(t, p.Connected)
+
+	msg := &sarama.ProducerMessage{Topic: "user_details_1", Value: sarama.StringEncoder("x")}
+	_ = p.Publish("spooled", msg)
+	_ = p.Publish("rejected", msg)
+	inner.mu.Lock()
+	delete(inner.fail, "spooled")
+	inner.mu.Unlock()
+	waitFor(t, p.Connected)
+	// Callers waiting for the acknowledgement get the error, so the message counts as failed
+	if _, _, err := p.SendMessage("ingested", msg); err == nil {
+		t.Fatal("SendMessage succeeded")
+	}
+
+	for _, tt := range []struct {
+		id                string
+		delivered, failed float64
+	}{
+		{"spooled", 1, 0},
+		{"rejected", 0, 1},
+		{"ingested", 0, 1},
+	} {
+		delivered := counterValue(t, DeliveredCounter.WithLabelValues(tt.id, ModeSync))
+		failed := counterValue(t, FailedCounter.WithLabelValues(tt.id, ModeSync))
+		if delivered != tt.delivered || failed != tt.failed {
+			t.Errorf("%s: %v delivered and %v failed, want %v and %v", tt.id, delivered, failed, tt.delivered, tt.failed)
+		}
+	}
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := counter.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,56 @@
+package publisher
+
+import (
+	"github.com/Shopify/sarama"
+	"shared/logging"
+	"time"
+)
+
+type syncPublisher struct {
+	producer sarama.SyncProducer
+	// transactional leaves counting deliveries to the transactional publisher
+	transactional bool
+	// spooled leaves retriable failures to the SpooledPublisher
+	spooled bool
+}
+
+func newSyncPublisher(brokers []string, config *sarama.Config) (*syncPublisher, error) {
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return &syncPublisher{producer: producer}, nil
+}
+
+func (p *syncPublisher) Publish(id string, msg *sarama.ProducerMessage) error {
+	_, _, err := p.SendMessage(id, msg)
+	return err
+}
+
+func (p *syncPublisher) SendMessage(id string, msg *sarama.ProducerMessage) (int32, int64, error) {
+	startTime := time.Now()
+	partition, offset, err := p.producer.SendMessage(msg)
+	observeDelivery(ModeSync, id, msg, startTime, err, countsDelivery(p.transactional, p.spooled, err))
+	if err != nil {
+		messageLogger(id, msg).Error("Unable to send message", logging.Err(err))
+		return 0, 0, err
+	}
+	if logging.Enabled(logging.DebugLevel) {
+		messageLogger(id, msg).Debug("Message published", logging.Int32("partition", partition), logging.Int64("offset", offset))
+	}
+
+	return partition, offset, nil
+}
+
+// setSpooled doesn't need onFailure, every failure is returned by Publish.
+func (p *syncPublisher) setSpooled(func(id string, msg *sarama.ProducerMessage, err error)) {
+	p.spooled = true
+}
+
+func (p *syncPublisher) deliveryMode() string {
+	return ModeSync
+}
+
+func (p *syncPublisher) Close() error {
+	return p.producer.Close()
+}
@@ -0,0 +1,254 @@
+package publisher
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"shared/logging"
+	"sync"
+	"time"
+)
+
+// DefaultTransactionMaxAge commits partial batches well before kafka's transaction timeout
+const DefaultTransactionMaxAge = time.Second
+
+var TransactionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "producer",
+	Name:      "transactions",
+	Help:      "Counter for kafka transactions by outcome",
+}, []string{"result"})
+
+// txnProducer is the transactional surface shared by sarama's sync and async producers.
+type txnProducer interface {
+	TxnStatus() sarama.ProducerTxnStatusFlag
+	BeginTxn() error
+	CommitTxn() error
+	AbortTxn() error
+}
+
+// pendingMessage is a message acknowledged within the open transaction, kept until it commits.
+type pendingMessage struct {
+	id  string
+	msg *sarama.ProducerMessage
+}
+
+// transactionalPublisher wraps a Publisher so that every batchSize messages are committed
+// to kafka atomically, consumers reading with read_committed never see aborted batches. Every
+// message is sent with SendMessage, so that a failed send aborts its batch before the commit,
+// and the messages of a batch are only counted as delivered once it is committed. A partial
+// batch is committed once its transaction is maxAge old, so that it doesn't outlive kafka's
+// transaction timeout while messages come in slowly or the generator is paused.
+type transactionalPublisher struct {
+	Publisher
+	txn       txnProducer
+	mode      string
+	batchSize int
+	maxAge    time.Duration
+	// onFailure is set once spooled, retriable failures are then left to the SpooledPublisher
+	onFailure func(id string, msg *sarama.ProducerMessage, err error)
+
+	mu    sync.Mutex
+	batch []pendingMessage
+	timer *time.Timer
+	// generation tells the timer of an ended transaction apart from the open one
+	generation int
+}
+
+func newTransactionalPublisher(p Publisher, txn txnProducer, mode string, batchSize int, maxAge time.Duration) *transactionalPublisher {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultTransactionMaxAge
+	}
+	return &transactionalPublisher{Publisher: p, txn: txn, mode: mode, batchSize: batchSize, maxAge: maxAge}
+}
+
+// Publish waits for the acknowledgement of msg even in async mode, a transaction can't be
+// committed over messages that may still fail.
+func (t *transactionalPublisher) Publish(id string, msg *sarama.ProducerMessage) error {
+	_, _, err := t.SendMessage(id, msg)
+	return err
+}
+
+// SendMessage sends msg within the open transaction, starting a new one if needed, and commits
+// once batchSize messages have been acknowledged. A failed send aborts the transaction, the
+// other messages of the batch are sent again in a new one and the error of msg is returned.
+func (t *transactionalPublisher) SendMessage(id string, msg *sarama.ProducerMessage) (int32, int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.begin(); err != nil {
+		logging.Error("Error in beginning transaction", logging.Err(err))
+		t.countFailure(id, err)
+		return 0, 0, err
+	}
+
+	partition, offset, err := t.Publisher.SendMessage(id, msg)
+	if err != nil {
+		t.countFailure(id, err)
+		t.abort()
+		return 0, 0, err
+	}
+
+	t.batch = append(t.batch, pendingMessage{id: id, msg: msg})
+	if len(t.batch) >= t.batchSize {
+		return partition, offset, t.commit()
+	}
+	return partition, offset, nil
+}
+
+// Close commits the open transaction, if any, before closing the underlying producer.
+func (t *transactionalPublisher) Close() error {
+	t.mu.Lock()
+	if len(t.batch) > 0 {
+		_ = t.commit()
+	}
+	t.mu.Unlock()
+
+	return t.Publisher.Close()
+}
+
+// setSpooled hands onFailure the messages that are lost when a transaction can't be committed
+// or its batch can't be sent again after an abort.
+func (t *transactionalPublisher) setSpooled(onFailure func(id string, msg *sarama.ProducerMessage, err error)) {
+	t.mu.Lock()
+	t.onFailure = onFailure
+	t.mu.Unlock()
+	if inner, ok := t.Publisher.(spoolable); ok {
+		inner.setSpooled(onFailure)
+	}
+}
+
+func (t *transactionalPublisher) deliveryMode() string {
+	return t.mode
+}
+
+// begin starts a transaction unless one is open, along with the timer that commits it.
+func (t *transactionalPublisher) begin() error {
+	if t.txn.TxnStatus()&sarama.ProducerTxnFlagInTransaction != 0 {
+		return nil
+	}
+	if err := t.txn.BeginTxn(); err != nil {
+		return err
+	}
+
+	t.generation++
+	generation := t.generation
+	t.timer = time.AfterFunc(t.maxAge, func() {
+		t.expire(generation)
+	})
+	return nil
+}
+
+// expire commits the partial batch of the transaction started as generation, if still open.
+func (t *transactionalPublisher) expire(generation int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if generation == t.generation && len(t.batch) > 0 {
+		_ = t.commit()
+	}
+}
+
+func (t *transactionalPublisher) commit() error {
+	t.stopTimer()
+	if err := t.txn.CommitTxn(); err != nil {
+		logging.Error("Error in committing transaction", logging.Err(err))
+		if t.txn.TxnStatus()&sarama.ProducerTxnFlagAbortableError != 0 {
+			t.abort()
+		} else {
+			TransactionCounter.WithLabelValues("failed").Inc()
+			t.fail(t.takeBatch(), err)
+		}
+		return err
+	}
+	TransactionCounter.WithLabelValues("committed").Inc()
+	for _, pending := range t.takeBatch() {
+		countDelivery(t.mode, pending.id, nil)
+	}
+	return nil
+}
+
+// abort rolls back the open transaction. Kafka had acknowledged the messages of its batch, so
+// they are sent again in a new transaction rather than lost with it.
+func (t *transactionalPublisher) abort() {
+	t.stopTimer()
+	if err := t.txn.AbortTxn(); err != nil {
+		logging.Error("Error in aborting transaction", logging.Err(err))
+		TransactionCounter.WithLabelValues("failed").Inc()
+	} else {
+		TransactionCounter.WithLabelValues("aborted").Inc()
+	}
+	t.resend(t.takeBatch())
+}
+
+// resend sends the messages of an aborted batch in a new transaction. Should that fail too,
+// the transaction is aborted for good and the messages are handed to fail.
+func (t *transactionalPublisher) resend(batch []pendingMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := t.begin()
+	for _, pending := range batch {
+		if err != nil {
+			break
+		}
+		// A fresh copy, sarama keeps the sequence number of the first attempt in the message
+		msg := &sarama.ProducerMessage{Topic: pending.msg.Topic, Key: pending.msg.Key, Value: pending.msg.Value,
+			Headers: pending.msg.Headers, Timestamp: pending.msg.Timestamp}
+		if _, _, err = t.Publisher.SendMessage(pending.id, msg); err == nil {
+			t.batch = append(t.batch, pendingMessage{id: pending.id, msg: msg})
+		}
+	}
+	if err == nil {
+		if len(t.batch) >= t.batchSize {
+			_ = t.commit()
+		}
+		return
+	}
+
+	logging.Error("Error in sending aborted batch again", logging.Int("messages", len(batch)), logging.Err(err))
+	t.stopTimer()
+	if t.txn.TxnStatus()&sarama.ProducerTxnFlagInTransaction != 0 {
+		if er := t.txn.AbortTxn(); er != nil {
+			TransactionCounter.WithLabelValues("failed").Inc()
+		} else {
+			TransactionCounter.WithLabelValues("aborted").Inc()
+		}
+	}
+	t.batch = t.batch[:0]
+	t.fail(batch, err)
+}
+
+// fail hands the messages of a lost batch to onFailure, if set and they may still succeed,
+// otherwise they are counted as failed.
+func (t *transactionalPublisher) fail(batch []pendingMessage, err error) {
+	for _, pending := range batch {
+		if t.onFailure != nil && retriable(err) {
+			t.onFailure(pending.id, pending.msg, err)
+		} else {
+			countDelivery(t.mode, pending.id, err)
+		}
+	}
+}
+
+// countFailure counts the message whose send failed with err, unless the spool retries it.
+func (t *transactionalPublisher) countFailure(id string, err error) {
+	if countsDelivery(false, t.onFailure != nil, err) {
+		countDelivery(t.mode, id, err)
+	}
+}
+
+// takeBatch returns the messages of the ended transaction and starts an empty batch.
+func (t *transactionalPublisher) takeBatch() []pendingMessage {
+	batch := t.batch
+	t.batch = nil
+	return batch
+}
+
+func (t *transactionalPublisher) stopTimer() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
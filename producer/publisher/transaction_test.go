@@ -0,0 +1,152 @@
+package publisher
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTxn tracks the transaction state of a producer and counts commits and aborts.
+type fakeTxn struct {
+	mu      sync.Mutex
+	open    bool
+	commits int
+	aborts  int
+}
+
+func (f *fakeTxn) TxnStatus() sarama.ProducerTxnStatusFlag {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open {
+		return sarama.ProducerTxnFlagInTransaction
+	}
+	return sarama.ProducerTxnFlagReady
+}
+
+func (f *fakeTxn) BeginTxn() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.open = true
+	return nil
+}
+
+func (f *fakeTxn) CommitTxn() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.open = false
+	f.commits++
+	return nil
+}
+
+func (f *fakeTxn) AbortTxn() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.open = false
+	f.aborts++
+	return nil
+}
+
+func (f *fakeTxn) counts() (commits int, aborts int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commits, f.aborts
+}
+
+func newTestTransaction(batchSize int, maxAge time.Duration) (*transactionalPublisher, *fakePublisher, *fakeTxn) {
+	inner := &fakePublisher{fail: make(map[string]error)}
+	txn := &fakeTxn{}
+	return newTransactionalPublisher(inner, txn, ModeSync, batchSize, maxAge), inner, txn
+}
+
+func publish(t *testing.T, p Publisher, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := p.Publish(id, &sarama.ProducerMessage{Topic: "user_details_1", Value: sarama.StringEncoder(id)}); err != nil {
+			t.Fatalf("Publish(%s) = %v", id, err)
+		}
+	}
+}
+
+func TestTransactionCommitsAtBatchSize(t *testing.T) {
+	p, inner, txn := newTestTransaction(2, time.Hour)
+	publish(t, p, "1", "2", "3")
+
+	if commits, aborts := txn.counts(); commits != 1 || aborts != 0 {
+		t.Errorf("%d commits and %d aborts, want a single commit", commits, aborts)
+	}
+	if len(p.batch) != 1 || !txn.open {
+		t.Errorf("%d messages in the open batch, want the third one", len(p.batch))
+	}
+	if sent := inner.sentIds(); fmt.Sprint(sent) != "[1 2 3]" {
+		t.Errorf("sent %v, want [1 2 3]", sent)
+	}
+
+	// Close commits the partial batch
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if commits, _ := txn.counts(); commits != 2 {
+		t.Errorf("%d commits after Close, want 2", commits)
+	}
+}
+
+func TestTransactionAbortSendsBatchAgain(t *testing.T) {
+	p, inner, txn := newTestTransaction(3, time.Hour)
+	publish(t, p, "1", "2")
+
+	inner.fail["down"] = sarama.ErrNotLeaderForPartition
+	msg := &sarama.ProducerMessage{Topic: "user_details_1", Value: sarama.StringEncoder("down")}
+	if err := p.Publish("down", msg); err != sarama.ErrNotLeaderForPartition {
+		t.Errorf("Publish = %v, want the send error", err)
+	}
+
+	// The acknowledged messages of the aborted transaction go out again in the next one
+	if commits, aborts := txn.counts(); commits != 0 || aborts != 1 {
+		t.Errorf("%d commits and %d aborts, want a single abort", commits, aborts)
+	}
+	if sent := inner.sentIds(); fmt.Sprint(sent) != "[1 2 1 2]" {
+		t.Errorf("sent %v, want [1 2 1 2]", sent)
+	}
+	publish(t, p, "3")
+	if commits, _ := txn.counts(); commits != 1 {
+		t.Errorf("%d commits, want the resent batch committed", commits)
+	}
+}
+
+func TestTransactionHandsLostBatchToOnFailure(t *testing.T) {
+	p, inner, txn := newTestTransaction(3, time.Hour)
+	var failed []string
+	p.setSpooled(func(id string, msg *sarama.ProducerMessage, err error) {
+		failed = append(failed, id)
+	})
+	publish(t, p, "1", "2")
+
+	// The broker stays down, so sending the aborted batch again fails as well
+	inner.fail["1"] = sarama.ErrOutOfBrokers
+	inner.fail["down"] = sarama.ErrOutOfBrokers
+	_ = p.Publish("down", &sarama.ProducerMessage{Topic: "user_details_1", Value: sarama.StringEncoder("down")})
+
+	if fmt.Sprint(failed) != "[1 2]" {
+		t.Errorf("onFailure got %v, want [1 2]", failed)
+	}
+	if _, aborts := txn.counts(); aborts != 2 || txn.open || len(p.batch) != 0 {
+		t.Errorf("%d aborts, open %v with %d messages, want both transactions aborted", aborts, txn.open, len(p.batch))
+	}
+}
+
+func TestTransactionCommitsAfterMaxAge(t *testing.T) {
+	p, _, txn := newTestTransaction(100, 10*time.Millisecond)
+	publish(t, p, "1")
+
+	waitFor(t, func() bool {
+		commits, _ := txn.counts()
+		return commits == 1
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.batch) != 0 {
+		t.Errorf("%d messages left in the batch, want it committed", len(p.batch))
+	}
+}
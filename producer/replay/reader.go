@@ -0,0 +1,225 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"producer/producer_structs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+
+	// maxLineBytes bounds the JSONL lines held in memory, longer lines are skipped as invalid
+	maxLineBytes = 1 << 20
+)
+
+// Record is a single captured message and the time it was originally produced at, which is
+// zero when the capture has no timestamp.
+type Record struct {
+	Message   producer_structs.Message
+	Timestamp time.Time
+}
+
+var (
+	errMissingId    = errors.New("record has no id")
+	errMissingValue = errors.New("record has no value")
+	errLineTooLong  = fmt.Errorf("line is longer than %d bytes", maxLineBytes)
+)
+
+// invalidRecordError is returned for a record that can't be parsed, reading can carry on with
+// the next record. Any other error means the capture can't be read any further.
+type invalidRecordError struct {
+	err error
+}
+
+func (e invalidRecordError) Error() string {
+	return e.err.Error()
+}
+
+// recordReader yields records one at a time so that captures don't have to fit in memory.
+type recordReader interface {
+	// Next returns io.EOF once the capture is exhausted.
+	Next() (Record, error)
+	Close() error
+}
+
+// jsonRecord accepts the timestamp as unix milliseconds or as an RFC3339 string.
+type jsonRecord struct {
+	Id        string          `json:"id"`
+	Value     *float64        `json:"value"`
+	Timestamp json.RawMessage `json:"timestamp"`
+}
+
+type jsonlReader struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+type csvReader struct {
+	file    *os.File
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+// openReader opens file in the given format, inferring it from the extension when empty.
+func openReader(file string, format string) (recordReader, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatCSV:
+		reader := csv.NewReader(f)
+		reader.TrimLeadingSpace = true
+		header, err := reader.Read()
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("reading csv header: %w", err)
+		}
+		columns := make(map[string]int)
+		for i, name := range header {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		for _, required := range []string{"id", "value"} {
+			if _, ok := columns[required]; !ok {
+				_ = f.Close()
+				return nil, fmt.Errorf("csv header is missing column %q", required)
+			}
+		}
+		return &csvReader{file: f, reader: reader, columns: columns}, nil
+	case FormatJSONL, "json", "ndjson":
+		return &jsonlReader{file: f, reader: bufio.NewReaderSize(f, 64*1024)}, nil
+	default:
+		_ = f.Close()
+		return nil, fmt.Errorf("unsupported replay format %q", format)
+	}
+}
+
+func (r *jsonlReader) Next() (Record, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return Record{}, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var raw jsonRecord
+		if err := json.Unmarshal(line, &raw); err != nil {
+			return Record{}, invalidRecordError{err}
+		}
+		if raw.Value == nil {
+			return Record{}, invalidRecordError{errMissingValue}
+		}
+		timestamp, err := parseTimestamp(strings.Trim(string(raw.Timestamp), `"`))
+		if err != nil {
+			return Record{}, invalidRecordError{err}
+		}
+		return newRecord(raw.Id, *raw.Value, timestamp)
+	}
+}
+
+// readLine returns the next line. A line longer than maxLineBytes is read to its end without
+// being kept and reported as an invalid record, so the rest of the capture can still be read.
+func (r *jsonlReader) readLine() ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > maxLineBytes {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && (len(line) > 0 || tooLong) {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tooLong {
+			return nil, invalidRecordError{errLineTooLong}
+		}
+		return line, nil
+	}
+}
+
+func (r *jsonlReader) Close() error {
+	return r.file.Close()
+}
+
+func (r *csvReader) Next() (Record, error) {
+	row, err := r.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return Record{}, invalidRecordError{err}
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	value, err := strconv.ParseFloat(r.column(row, "value"), 64)
+	if err != nil {
+		return Record{}, invalidRecordError{err}
+	}
+	timestamp, err := parseTimestamp(r.column(row, "timestamp"))
+	if err != nil {
+		return Record{}, invalidRecordError{err}
+	}
+	return newRecord(r.column(row, "id"), value, timestamp)
+}
+
+func (r *csvReader) Close() error {
+	return r.file.Close()
+}
+
+func (r *csvReader) column(row []string, name string) string {
+	i, ok := r.columns[name]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// newRecord rejects records without an id, they can't be told apart downstream.
+func newRecord(id string, value float64, timestamp time.Time) (Record, error) {
+	if id == "" {
+		return Record{}, invalidRecordError{errMissingId}
+	}
+	return Record{Message: producer_structs.Message{Id: id, Value: value}, Timestamp: timestamp}, nil
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	if value == "" || value == "null" {
+		return time.Time{}, nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestamp, nil
+	}
+	return time.Time{}, errors.New("timestamp must be unix milliseconds or RFC3339: " + value)
+}
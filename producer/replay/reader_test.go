@@ -0,0 +1,168 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"producer/producer_structs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeCapture(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readAll returns the records of a capture and the positions, starting at 1, of invalid ones.
+func readAll(t *testing.T, path string, format string) ([]Record, []int) {
+	t.Helper()
+	reader, err := openReader(path, format)
+	if err != nil {
+		t.Fatalf("openReader: %v", err)
+	}
+	defer reader.Close()
+
+	var records []Record
+	var invalid []int
+	for position := 1; ; position++ {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, invalid
+		}
+		var invalidErr invalidRecordError
+		if errors.As(err, &invalidErr) {
+			invalid = append(invalid, position)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		records = append(records, record)
+	}
+}
+
+func TestJSONLReader(t *testing.T) {
+	path := writeCapture(t, "capture.jsonl", `{"id": "1", "value": 42.5, "timestamp": 1672905600000}
+{"id": "2", "value": -1, "timestamp": "2023-01-05T08:00:01.5Z"}
+
+{"id": "3", "value": 7}
+{"id": "4", "value":
+{"value": 5, "timestamp": 1672905602000}
+{"id": "5", "value": 1, "timestamp": "yesterday"}
+{"id": "6", "value": 2, "timestamp": null}
+{"id": "7", "timestamp": 1672905603000}
+`)
+	records, invalid := readAll(t, path, "")
+
+	want := []Record{
+		{Message: producer_structs.Message{Id: "1", Value: 42.5}, Timestamp: time.UnixMilli(1672905600000)},
+		{Message: producer_structs.Message{Id: "2", Value: -1}, Timestamp: time.Date(2023, 1, 5, 8, 0, 1, 500000000, time.UTC)},
+		{Message: producer_structs.Message{Id: "3", Value: 7}},
+		{Message: producer_structs.Message{Id: "6", Value: 2}},
+	}
+	checkRecords(t, records, want)
+	// Blank lines are skipped without taking a position
+	if len(invalid) != 4 {
+		t.Errorf("invalid records at %v, want the unparseable one, the ones without id or value and the bad timestamp", invalid)
+	}
+}
+
+func TestJSONLReaderSkipsLongLines(t *testing.T) {
+	long := `{"id": "2", "value": 1, "padding": "` + strings.Repeat("x", maxLineBytes) + `"}`
+	path := writeCapture(t, "capture.jsonl", `{"id": "1", "value": 1}
+`+long+`
+{"id": "3", "value": 3}
+`+long)
+	records, invalid := readAll(t, path, "")
+
+	checkRecords(t, records, []Record{
+		{Message: producer_structs.Message{Id: "1", Value: 1}},
+		{Message: producer_structs.Message{Id: "3", Value: 3}},
+	})
+	if !reflect.DeepEqual(invalid, []int{2, 4}) {
+		t.Errorf("invalid records at %v, want the long lines at 2 and 4", invalid)
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	path := writeCapture(t, "capture.csv", `Timestamp, ID, Value
+1672905600000, 1, 42.5
+2023-01-05T08:00:01Z, 2, -1
+, 3, 7
+1672905602000, 4, not a number
+1672905603000, , 5
+1672905604000, 6
+`)
+	records, invalid := readAll(t, path, "")
+
+	want := []Record{
+		{Message: producer_structs.Message{Id: "1", Value: 42.5}, Timestamp: time.UnixMilli(1672905600000)},
+		{Message: producer_structs.Message{Id: "2", Value: -1}, Timestamp: time.Date(2023, 1, 5, 8, 0, 1, 0, time.UTC)},
+		{Message: producer_structs.Message{Id: "3", Value: 7}},
+	}
+	checkRecords(t, records, want)
+	if len(invalid) != 3 {
+		t.Errorf("invalid records at %v, want the bad value, the missing id and the short row", invalid)
+	}
+}
+
+func TestCSVReaderWithoutTimestampColumn(t *testing.T) {
+	path := writeCapture(t, "capture.txt", "id,value\n1,2\n")
+	records, _ := readAll(t, path, FormatCSV)
+	checkRecords(t, records, []Record{{Message: producer_structs.Message{Id: "1", Value: 2}}})
+}
+
+func TestOpenReaderErrors(t *testing.T) {
+	if _, err := openReader(writeCapture(t, "capture.csv", "id,timestamp\n1,2\n"), ""); err == nil {
+		t.Error("accepted a csv header without value column")
+	}
+	if _, err := openReader(writeCapture(t, "capture.xml", "<id>1</id>"), ""); err == nil {
+		t.Error("accepted an unknown format")
+	}
+	if _, err := openReader(filepath.Join(t.TempDir(), "missing.jsonl"), ""); err == nil {
+		t.Error("opened a missing file")
+	}
+}
+
+func TestReplayerPublishesRecordsWithTimestamps(t *testing.T) {
+	path := writeCapture(t, "capture.jsonl", `{"id": "1", "value": 1, "timestamp": 1672905600000}
+{"id": "", "value": 2, "timestamp": 1672905600010}
+{"id": "3", "value": 3, "timestamp": 1672905600020}
+`)
+	var published []Record
+	replayer := NewReplayer(producer_structs.ReplayConfig{File: path, Speed: 1}, func(record Record) {
+		published = append(published, record)
+	})
+
+	start := time.Now()
+	replayer.Run(context.Background())
+	checkRecords(t, published, []Record{
+		{Message: producer_structs.Message{Id: "1", Value: 1}, Timestamp: time.UnixMilli(1672905600000)},
+		{Message: producer_structs.Message{Id: "3", Value: 3}, Timestamp: time.UnixMilli(1672905600020)},
+	})
+	// The original spacing is kept at speed 1
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("replay took %v, want at least the 20ms the capture spans", elapsed)
+	}
+}
+
+func checkRecords(t *testing.T, got []Record, want []Record) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d records %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i].Message != want[i].Message || !got[i].Timestamp.Equal(want[i].Timestamp) {
+			t.Errorf("record %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
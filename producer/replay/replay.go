@@ -0,0 +1,165 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"producer/producer_structs"
+	"shared/logging"
+	"time"
+)
+
+var (
+	ReplayedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "replay_messages",
+		Help:      "Counter for messages replayed from the capture file",
+	})
+	InvalidRecordCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "replay_invalid_records",
+		Help:      "Counter for capture records that could not be parsed and were skipped",
+	})
+	LoopCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "producer",
+		Name:      "replay_loops",
+		Help:      "Counter for completed passes over the capture file",
+	})
+	PositionGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "replay_position",
+		Help:      "Number of records read in the current pass over the capture file",
+	})
+	TotalRecordsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "replay_records_total",
+		Help:      "Number of records in the capture file",
+	})
+	ProgressGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "replay_progress_ratio",
+		Help:      "Fraction of the capture file replayed in the current pass",
+	})
+)
+
+// Replayer publishes the records of a capture file, optionally preserving their original
+// inter-arrival times scaled by Speed. Records are handed to publish with their original
+// timestamp, which is zero when the capture has none.
+type Replayer struct {
+	config  producer_structs.ReplayConfig
+	publish func(Record)
+}
+
+func NewReplayer(config producer_structs.ReplayConfig, publish func(Record)) *Replayer {
+	return &Replayer{config: config, publish: publish}
+}
+
+// Run replays the capture until ctx is cancelled or, unless looping, the file is exhausted.
+func (r *Replayer) Run(ctx context.Context) {
+	total, err := r.countRecords()
+	if err != nil {
+		logging.Error("Error in reading replay file", logging.String("file", r.config.File), logging.Err(err))
+		return
+	}
+	TotalRecordsGauge.Set(float64(total))
+	logging.Info("Replaying file", logging.String("file", r.config.File), logging.Int("records", total), logging.Float64("speed", r.config.Speed), logging.Bool("loop", r.config.Loop))
+
+	for {
+		if err := r.replayOnce(ctx, total); err != nil {
+			if ctx.Err() == nil {
+				logging.Error("Error in replaying file", logging.String("file", r.config.File), logging.Err(err))
+			}
+			return
+		}
+		LoopCounter.Inc()
+		if !r.config.Loop {
+			logging.Info("Replay completed", logging.String("file", r.config.File))
+			return
+		}
+	}
+}
+
+func (r *Replayer) replayOnce(ctx context.Context, total int) error {
+	reader, err := openReader(r.config.File, r.config.Format)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			logging.Error("Error in closing replay file", logging.Err(err))
+		}
+	}()
+
+	var firstRecordTime, startTime time.Time
+	for position := 1; ; position++ {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		var invalidErr invalidRecordError
+		if err != nil && !errors.As(err, &invalidErr) {
+			return err
+		}
+		PositionGauge.Set(float64(position))
+		if total > 0 {
+			ProgressGauge.Set(float64(position) / float64(total))
+		}
+		if err != nil {
+			logging.Warn("Skipping invalid replay record", logging.Int("position", position), logging.Err(err))
+			InvalidRecordCounter.Inc()
+			continue
+		}
+
+		// Keep the original spacing relative to the first record of the pass
+		if r.config.Speed > 0 && !record.Timestamp.IsZero() {
+			if firstRecordTime.IsZero() {
+				firstRecordTime, startTime = record.Timestamp, time.Now()
+			}
+			offset := time.Duration(float64(record.Timestamp.Sub(firstRecordTime)) / r.config.Speed)
+			if err := sleepUntil(ctx, startTime.Add(offset)); err != nil {
+				return err
+			}
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r.publish(record)
+		ReplayedCounter.Inc()
+	}
+}
+
+func (r *Replayer) countRecords() (int, error) {
+	reader, err := openReader(r.config.File, r.config.Format)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	count := 0
+	for {
+		_, err := reader.Next()
+		var invalidErr invalidRecordError
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil && !errors.As(err, &invalidErr) {
+			return count, err
+		}
+		count++
+	}
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
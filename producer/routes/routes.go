@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"net/http"
+	"producer/handler"
+	"shared/health"
+	"shared/logging"
+)
+
+func RegisterRoutes(ingest *handler.IngestHandler, control *handler.ControlHandler, checker *health.Checker) {
+	// accepts one or more messages and publishes them to the kafka topic
+	http.HandleFunc(handler.EndpointMessages, ingest.PostMessages)
+	// accepts newline delimited messages and streams back a result per message
+	http.HandleFunc(handler.EndpointMessagesNDJSON, ingest.PostNDJSON)
+
+	// liveness and readiness with the results of the last health checks
+	checker.Register(http.DefaultServeMux)
+
+	if control.Token == "" {
+		logging.Info("No control token configured, the control api is disabled")
+		return
+	}
+	// runtime control of the workload, every request needs the control token as bearer token
+	http.HandleFunc("/config", control.GetConfig)
+	http.HandleFunc("/control/pause", control.Pause)
+	http.HandleFunc("/control/resume", control.Resume)
+	http.HandleFunc("/control/rate", control.SetRate)
+	http.HandleFunc("/control/ids", control.SetIds)
+	http.HandleFunc("/control/values", control.SetValues)
+	http.HandleFunc("/control/burst", control.TriggerBurst)
+	http.HandleFunc("/control/log-level", control.SetLogLevel)
+}
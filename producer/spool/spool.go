@@ -0,0 +1,386 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"shared/logging"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix  = ".seg"
+	headOffsetFile = "head.offset"
+	// lengthPrefix is the size of the big endian length written before every entry
+	lengthPrefix = 4
+
+	DefaultSegmentBytes = 4 << 20
+	DefaultMaxBytes     = 256 << 20
+)
+
+var ErrFull = errors.New("spool is full")
+
+// Entry is a message waiting to be published to kafka.
+type Entry struct {
+	Id        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Value     []byte    `json:"value"`
+	Headers   Headers   `json:"headers,omitempty"`
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	SpooledAt time.Time `json:"spooled_at"`
+}
+
+// RecordHeader is a kafka header of a spooled message.
+type RecordHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Headers keeps the headers of a message in order, including repeated keys.
+type Headers []RecordHeader
+
+// UnmarshalJSON also reads the object of unique keys earlier versions spooled headers as, so
+// that their entries can still be drained.
+func (h *Headers) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '{' {
+		var headers []RecordHeader
+		if err := json.Unmarshal(data, &headers); err != nil {
+			return err
+		}
+		*h = headers
+		return nil
+	}
+
+	var legacy map[string][]byte
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	headers := make(Headers, 0, len(legacy))
+	for key, value := range legacy {
+		headers = append(headers, RecordHeader{Key: key, Value: value})
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Key < headers[j].Key
+	})
+	*h = headers
+	return nil
+}
+
+type segment struct {
+	seq   int64
+	size  int64
+	count int
+}
+
+// Spool is a bounded FIFO queue of entries persisted in segment files under a directory.
+// Entries survive restarts, a fully drained segment is deleted and the read position within
+// the head segment is checkpointed so that drained entries aren't published again.
+type Spool struct {
+	mu           sync.Mutex
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	segments     []*segment
+	tail         *os.File
+	headOffset   int64
+	depth        int
+	bytes        int64
+}
+
+// Open opens, or creates, the spool in dir and recovers any entries left by a previous run.
+func Open(dir string, maxBytes int64, segmentBytes int64) (*Spool, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if segmentBytes <= 0 {
+		segmentBytes = DefaultSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	logging.Info("Opened spool", logging.String("dir", dir), logging.Int("pending", s.depth))
+
+	return s, nil
+}
+
+// Append adds entry to the end of the spool, it returns ErrFull once maxBytes would be exceeded.
+func (s *Spool) Append(entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	size := int64(lengthPrefix + len(data))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bytes+size > s.maxBytes {
+		return ErrFull
+	}
+
+	last := s.lastSegment()
+	if last == nil || last.size+size > s.segmentBytes && last.size > 0 {
+		if last, err = s.newSegment(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[lengthPrefix:], data)
+	if _, err := s.tail.Write(buf); err != nil {
+		return err
+	}
+	if err := s.tail.Sync(); err != nil {
+		return err
+	}
+
+	last.size += size
+	last.count++
+	s.depth++
+	s.bytes += size
+	return nil
+}
+
+// Peek returns the oldest entry without removing it, ok is false when the spool is empty.
+func (s *Spool) Peek() (entry Entry, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.depth == 0 {
+		return Entry{}, false, nil
+	}
+	entry, _, err = s.readAt(s.segments[0], s.headOffset)
+	return entry, err == nil, err
+}
+
+// Ack removes the oldest entry, deleting its segment once it has been fully drained.
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.depth == 0 {
+		return nil
+	}
+	head := s.segments[0]
+	_, size, err := s.readAt(head, s.headOffset)
+	if err != nil {
+		return err
+	}
+
+	s.headOffset += size
+	s.depth--
+	s.bytes -= size
+
+	if s.headOffset >= head.size {
+		if len(s.segments) == 1 {
+			// The tail segment is drained, start a fresh one with the next append
+			if err := s.tail.Close(); err != nil {
+				logging.Error("Error in closing spool segment", logging.Err(err))
+			}
+			s.tail = nil
+		}
+		if err := os.Remove(s.segmentPath(head.seq)); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+		s.headOffset = 0
+	}
+	return s.writeHeadOffset()
+}
+
+// Depth returns the number of pending entries.
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+// Bytes returns the size of the pending entries on disk.
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tail == nil {
+		return nil
+	}
+	err := s.tail.Close()
+	s.tail = nil
+	return err
+}
+
+func (s *Spool) lastSegment() *segment {
+	if len(s.segments) == 0 || s.tail == nil {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) newSegment() (*segment, error) {
+	var seq int64 = 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	file, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if s.tail != nil {
+		if err := s.tail.Close(); err != nil {
+			logging.Error("Error in closing spool segment", logging.Err(err))
+		}
+	}
+	s.tail = file
+
+	seg := &segment{seq: seq}
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+// readAt reads the entry at offset in seg, returning it together with its size on disk.
+func (s *Spool) readAt(seg *segment, offset int64) (Entry, int64, error) {
+	file, err := os.Open(s.segmentPath(seg.seq))
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	defer file.Close()
+
+	return readEntry(file, offset)
+}
+
+func readEntry(file io.ReaderAt, offset int64) (Entry, int64, error) {
+	var prefix [lengthPrefix]byte
+	if _, err := file.ReadAt(prefix[:], offset); err != nil {
+		return Entry{}, 0, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(prefix[:]))
+	if _, err := file.ReadAt(data, offset+lengthPrefix); err != nil {
+		return Entry{}, 0, err
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return Entry{}, 0, err
+	}
+	return entry, int64(lengthPrefix + len(data)), nil
+}
+
+// recover rebuilds the segment index from disk, truncating a partially written last entry.
+func (s *Spool) recover() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{seq: seq})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	headSeq, headOffset := s.readHeadOffset()
+	for _, seg := range s.segments {
+		start := int64(0)
+		if seg.seq == headSeq {
+			start, s.headOffset = headOffset, headOffset
+		}
+		if err := s.scanSegment(seg, start); err != nil {
+			return err
+		}
+	}
+
+	// Drop segments drained before the last checkpoint
+	for len(s.segments) > 0 && s.segments[0].seq < headSeq {
+		if err := os.Remove(s.segmentPath(s.segments[0].seq)); err != nil {
+			return err
+		}
+		s.depth -= s.segments[0].count
+		s.bytes -= s.segments[0].size
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 || s.segments[0].seq != headSeq {
+		s.headOffset = 0
+	}
+
+	if len(s.segments) > 0 {
+		last := s.segments[len(s.segments)-1]
+		s.tail, err = os.OpenFile(s.segmentPath(last.seq), os.O_WRONLY|os.O_APPEND, 0o644)
+		return err
+	}
+	return nil
+}
+
+// scanSegment counts the entries of seg from start and truncates a torn trailing write.
+func (s *Spool) scanSegment(seg *segment, start int64) error {
+	path := s.segmentPath(seg.seq)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset := int64(0)
+	for {
+		_, size, err := readEntry(file, offset)
+		if err != nil {
+			break
+		}
+		if offset >= start {
+			seg.count++
+			s.depth++
+			s.bytes += size
+		}
+		offset += size
+	}
+
+	seg.size = offset
+	if info, err := file.Stat(); err == nil && info.Size() > offset {
+		logging.Warn("Truncating partially written spool segment", logging.String("path", path), logging.Int64("bytes", offset))
+		return os.Truncate(path, offset)
+	}
+	return nil
+}
+
+func (s *Spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+func (s *Spool) readHeadOffset() (int64, int64) {
+	data, err := os.ReadFile(filepath.Join(s.dir, headOffsetFile))
+	if err != nil {
+		return 0, 0
+	}
+	var seq, offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return 0, 0
+	}
+	return seq, offset
+}
+
+func (s *Spool) writeHeadOffset() error {
+	var seq int64
+	if len(s.segments) > 0 {
+		seq = s.segments[0].seq
+	}
+	return os.WriteFile(filepath.Join(s.dir, headOffsetFile), []byte(fmt.Sprintf("%d %d", seq, s.headOffset)), 0o644)
+}
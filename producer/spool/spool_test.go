@@ -0,0 +1,226 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openSpool(t *testing.T, dir string, maxBytes int64, segmentBytes int64) *Spool {
+	t.Helper()
+	s, err := Open(dir, maxBytes, segmentBytes)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func appendEntries(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		entry := Entry{Id: strconv.Itoa(i), Topic: "user_details_1", Value: []byte(`{"id":"` + strconv.Itoa(i) + `"}`), SpooledAt: time.Now()}
+		if err := s.Append(entry); err != nil {
+			t.Fatalf("Append(%d): %v", i, err)
+		}
+	}
+}
+
+// drain acks n entries, checking that they come out in order starting at id first.
+func drain(t *testing.T, s *Spool, first, n int) {
+	t.Helper()
+	for i := first; i < first+n; i++ {
+		entry, ok, err := s.Peek()
+		if err != nil || !ok {
+			t.Fatalf("Peek: ok %v, err %v", ok, err)
+		}
+		if entry.Id != strconv.Itoa(i) {
+			t.Fatalf("Peek = %s, want %d", entry.Id, i)
+		}
+		if err := s.Ack(); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFIFOAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, 0, 200)
+	appendEntries(t, s, 0, 10)
+	if s.Depth() != 10 {
+		t.Fatalf("Depth = %d, want 10", s.Depth())
+	}
+	if files := segmentFiles(t, dir); len(files) < 2 {
+		t.Fatalf("%d segments, want the entries spread over several", len(files))
+	}
+
+	drain(t, s, 0, 10)
+	if s.Depth() != 0 || s.Bytes() != 0 {
+		t.Errorf("Depth = %d, Bytes = %d after draining, want 0", s.Depth(), s.Bytes())
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Errorf("drained segments left behind: %v", files)
+	}
+	if _, ok, _ := s.Peek(); ok {
+		t.Error("Peek returned an entry from an empty spool")
+	}
+
+	// A drained spool starts a new segment
+	appendEntries(t, s, 10, 11)
+	drain(t, s, 10, 1)
+}
+
+func TestReopenResumesAtHeadOffset(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, 0, 1<<20)
+	appendEntries(t, s, 0, 5)
+	drain(t, s, 0, 2)
+	bytes := s.Bytes()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, headOffsetFile))
+	if err != nil {
+		t.Fatalf("reading checkpoint: %v", err)
+	}
+	if string(data[:2]) != "1 " {
+		t.Errorf("checkpoint = %q, want it in segment 1", data)
+	}
+
+	s = openSpool(t, dir, 0, 1<<20)
+	if s.Depth() != 3 || s.Bytes() != bytes {
+		t.Errorf("reopened Depth = %d, Bytes = %d, want 3 and %d", s.Depth(), s.Bytes(), bytes)
+	}
+	drain(t, s, 2, 3)
+}
+
+func TestReopenTruncatesTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, 0, 1<<20)
+	appendEntries(t, s, 0, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of an append leaves a length prefix without its entry
+	path := segmentFiles(t, dir)[0]
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{0, 0, 0, 50, '{', '"'}); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	s = openSpool(t, dir, 0, 1<<20)
+	if s.Depth() != 2 {
+		t.Errorf("Depth = %d, want 2", s.Depth())
+	}
+	if truncated, err := os.Stat(path); err != nil || truncated.Size() != info.Size() {
+		t.Errorf("segment not truncated back to %d bytes: %v, %v", info.Size(), truncated, err)
+	}
+
+	// Appends go after the last complete entry
+	appendEntries(t, s, 2, 3)
+	drain(t, s, 0, 3)
+}
+
+func TestReopenDropsSegmentsBeforeCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, 0, 200)
+	appendEntries(t, s, 0, 10)
+	files := segmentFiles(t, dir)
+	first, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain the first segment, then put it back as if its removal was lost in a crash
+	for {
+		drain(t, s, 10-s.Depth(), 1)
+		if _, err := os.Stat(files[0]); os.IsNotExist(err) {
+			break
+		}
+	}
+	depth := s.Depth()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(files[0], first, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSpool(t, dir, 0, 200)
+	if s.Depth() != depth {
+		t.Errorf("Depth = %d, want %d", s.Depth(), depth)
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Error("segment drained before the checkpoint was not removed")
+	}
+	drain(t, s, 10-depth, depth)
+}
+
+func TestAppendFull(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 300, 1<<20)
+	appendEntries(t, s, 0, 1)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = s.Append(Entry{Id: "x", Topic: "user_details_1", Value: []byte("payload")})
+	}
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("Append = %v, want ErrFull", err)
+	}
+	if s.Bytes() > 300 {
+		t.Errorf("Bytes = %d, above the limit of 300", s.Bytes())
+	}
+
+	// Draining makes room again
+	drain(t, s, 0, 1)
+	if err := s.Append(Entry{Id: "y"}); err != nil {
+		t.Errorf("Append after draining: %v", err)
+	}
+}
+
+func TestHeadersKeepOrderAndDuplicates(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 0, 0)
+	headers := Headers{{Key: "b", Value: []byte("1")}, {Key: "a", Value: []byte("2")}, {Key: "b", Value: []byte("3")}}
+	if err := s.Append(Entry{Id: "1", Headers: headers}); err != nil {
+		t.Fatal(err)
+	}
+	entry, _, err := s.Peek()
+	if err != nil || !reflect.DeepEqual(entry.Headers, headers) {
+		t.Errorf("Peek = %v, %v, want headers %v", entry.Headers, err, headers)
+	}
+}
+
+func TestLegacyHeaders(t *testing.T) {
+	// Entries spooled by earlier versions hold their headers in an object
+	var entry Entry
+	if err := json.Unmarshal([]byte(`{"id": "1", "headers": {"x-encoding": "anNvbg==", "traceparent": "MDA="}}`), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := Headers{{Key: "traceparent", Value: []byte("00")}, {Key: "x-encoding", Value: []byte("json")}}
+	if !reflect.DeepEqual(entry.Headers, want) {
+		t.Errorf("Headers = %v, want %v", entry.Headers, want)
+	}
+}
@@ -0,0 +1,132 @@
+package workload
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	TargetRpsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "target_rps",
+		Help:      "Target messages per second of the workload generator",
+	})
+	ActualRpsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "actual_rps",
+		Help:      "Messages per second actually sent by the workload generator",
+	})
+	ScheduleLagGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "producer",
+		Name:      "schedule_lag_seconds",
+		Help:      "How far behind its schedule the last message was sent, non zero when sending is the bottleneck",
+	})
+)
+
+// Generator runs a number of concurrent senders paced by a shared token bucket.
+type Generator struct {
+	limiter *TokenBucket
+	senders int
+	send    func()
+	sent    int64
+
+	mu        sync.Mutex
+	targetRps float64
+	paused    bool
+}
+
+// NewGenerator creates a Generator calling send targetRps times per second across the given
+// number of senders.
+func NewGenerator(targetRps float64, senders int, send func()) *Generator {
+	if senders < 1 {
+		senders = 1
+	}
+	TargetRpsGauge.Set(targetRps)
+	return &Generator{
+		limiter:   NewTokenBucket(targetRps, senders),
+		senders:   senders,
+		send:      send,
+		targetRps: targetRps,
+	}
+}
+
+// SetTargetRps changes the target rate, while paused it only takes effect on Resume.
+func (g *Generator) SetTargetRps(rps float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.targetRps = rps
+	TargetRpsGauge.Set(rps)
+	if !g.paused {
+		g.limiter.SetRate(rps)
+	}
+}
+
+func (g *Generator) TargetRps() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.targetRps
+}
+
+// Pause stops the senders without losing the target rate.
+func (g *Generator) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+	g.limiter.SetRate(0)
+}
+
+func (g *Generator) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+	g.limiter.SetRate(g.targetRps)
+}
+
+func (g *Generator) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// Run blocks until ctx is cancelled and all senders have returned.
+func (g *Generator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < g.senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				lag, err := g.limiter.Wait(ctx)
+				if err != nil {
+					return
+				}
+				ScheduleLagGauge.Set(lag.Seconds())
+				g.send()
+				atomic.AddInt64(&g.sent, 1)
+			}
+		}()
+	}
+
+	g.reportActualRps(ctx)
+	wg.Wait()
+}
+
+func (g *Generator) reportActualRps(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sent := atomic.SwapInt64(&g.sent, 0)
+			ActualRpsGauge.Set(float64(sent) / now.Sub(last).Seconds())
+			last = now
+		}
+	}
+}
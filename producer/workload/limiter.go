@@ -0,0 +1,99 @@
+package workload
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// idlePoll is how often a paused (zero rate) bucket checks for a new rate.
+const idlePoll = 100 * time.Millisecond
+
+// TokenBucket paces callers to a target rate, allowing up to burst tokens to be taken at once.
+// It is implemented as a theoretical-arrival-time scheduler so the rate can change at any time.
+type TokenBucket struct {
+	mu    sync.Mutex
+	rate  float64
+	burst int
+	tat   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: burst, tat: time.Now()}
+}
+
+// SetRate changes the rate in tokens per second, a rate of zero or less pauses the bucket.
+func (b *TokenBucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Resuming from a pause starts a fresh schedule instead of reporting the pause as lag
+	if b.rate <= 0 {
+		b.tat = time.Now()
+	}
+	b.rate = rate
+}
+
+func (b *TokenBucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// Wait blocks until the next token is due. It returns the schedule lag, i.e. how long after its
+// scheduled time the token was requested, which grows when callers can't keep up with the rate.
+func (b *TokenBucket) Wait(ctx context.Context) (time.Duration, error) {
+	for {
+		slot, lag, ok := b.reserve()
+		if !ok {
+			if err := sleep(ctx, idlePoll); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := sleep(ctx, time.Until(slot)); err != nil {
+			return 0, err
+		}
+		return lag, nil
+	}
+}
+
+func (b *TokenBucket) reserve() (time.Time, time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return time.Time{}, 0, false
+	}
+	now := time.Now()
+	interval := time.Duration(float64(time.Second) / b.rate)
+
+	var lag time.Duration
+	if now.After(b.tat) {
+		lag = now.Sub(b.tat)
+	}
+	// Unused tokens accumulate up to burst, anything older than that is dropped
+	if earliest := now.Add(-time.Duration(b.burst-1) * interval); b.tat.Before(earliest) {
+		b.tat = earliest
+	}
+	slot := b.tat
+	b.tat = b.tat.Add(interval)
+
+	return slot, lag, true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
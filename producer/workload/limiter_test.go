@@ -0,0 +1,89 @@
+package workload
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketSpacesSlots(t *testing.T) {
+	b := NewTokenBucket(100, 1)
+	first, _, ok := b.reserve()
+	if !ok {
+		t.Fatal("reserve failed at a positive rate")
+	}
+	for i := 1; i <= 5; i++ {
+		slot, _, _ := b.reserve()
+		if got, want := slot.Sub(first), time.Duration(i)*10*time.Millisecond; got != want {
+			t.Errorf("slot %d is %v after the first, want %v", i, got, want)
+		}
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	b := NewTokenBucket(10, 5)
+	// An idle second accumulates at most burst tokens
+	b.tat = time.Now().Add(-time.Second)
+	var slots []time.Time
+	for i := 0; i < 6; i++ {
+		slot, _, _ := b.reserve()
+		slots = append(slots, slot)
+	}
+	now := time.Now()
+	for i, slot := range slots[:5] {
+		if slot.After(now) {
+			t.Errorf("token %d is due in %v, want it available right away", i, slot.Sub(now))
+		}
+	}
+	if wait := slots[5].Sub(now); wait < 50*time.Millisecond {
+		t.Errorf("token past the burst is due in %v, want about one interval", wait)
+	}
+}
+
+func TestTokenBucketReportsLag(t *testing.T) {
+	b := NewTokenBucket(1, 1000)
+	b.tat = time.Now().Add(-50 * time.Millisecond)
+	_, lag, _ := b.reserve()
+	if lag < 50*time.Millisecond || lag > time.Second {
+		t.Errorf("lag = %v, want about 50ms", lag)
+	}
+
+	b = NewTokenBucket(1, 1)
+	b.tat = time.Now().Add(time.Second)
+	if _, lag, _ = b.reserve(); lag != 0 {
+		t.Errorf("lag = %v ahead of schedule, want 0", lag)
+	}
+}
+
+func TestTokenBucketPause(t *testing.T) {
+	b := NewTokenBucket(0, 1)
+	if _, _, ok := b.reserve(); ok {
+		t.Error("reserve succeeded at rate 0")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.Wait(ctx); err == nil {
+		t.Error("Wait returned a token while paused")
+	}
+
+	// Resuming doesn't count the pause as lag
+	b.tat = time.Now().Add(-time.Hour)
+	b.SetRate(10)
+	if _, lag, _ := b.reserve(); lag > time.Second {
+		t.Errorf("lag = %v after resuming, want none", lag)
+	}
+}
+
+func TestTokenBucketWaitPaces(t *testing.T) {
+	b := NewTokenBucket(1000, 1)
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		if _, err := b.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 50 tokens at 1000/s take 49 intervals
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Errorf("50 tokens took %v, want at least 49ms", elapsed)
+	}
+}
@@ -0,0 +1,149 @@
+package workload
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"producer/producer_structs"
+	"shared/logging"
+	"time"
+)
+
+const (
+	ShapeConstant = "constant"
+	ShapeRamp     = "ramp"
+	ShapeStep     = "step"
+	ShapeSpike    = "spike"
+	ShapeSine     = "sine"
+
+	OnCompleteLoop = "loop"
+	OnCompleteStop = "stop"
+	OnCompleteHold = "hold"
+
+	// profileTick is how often the profile re-evaluates the target rate
+	profileTick = 100 * time.Millisecond
+)
+
+var LoadPhaseGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "producer",
+	Name:      "load_phase",
+	Help:      "Set to 1 for the load profile phase currently driving the target rate",
+}, []string{"phase", "shape"})
+
+// Profile drives a Generator's target rate through a sequence of phases.
+type Profile struct {
+	phases     []producer_structs.PhaseConfig
+	onComplete string
+}
+
+// NewProfile creates the profile of config. Phases without a positive duration are skipped, they
+// would never be entered and a profile of only such phases would loop without waiting.
+func NewProfile(config producer_structs.LoadProfileConfig) *Profile {
+	var phases []producer_structs.PhaseConfig
+	for _, phase := range config.Phases {
+		switch phase.Shape {
+		case ShapeConstant, ShapeRamp, ShapeStep, ShapeSpike, ShapeSine:
+		default:
+			logging.Warn("Unknown load phase shape, treating it as constant", logging.String("phase", phase.Name), logging.String("shape", phase.Shape))
+			phase.Shape = ShapeConstant
+		}
+		if phase.Name == "" {
+			phase.Name = phase.Shape
+		}
+		if phase.Duration <= 0 {
+			logging.Warn("Load phase has no positive duration, skipping it", logging.String("phase", phase.Name), logging.Int64("duration", phase.Duration))
+			continue
+		}
+		phases = append(phases, phase)
+	}
+	return &Profile{phases: phases, onComplete: config.OnComplete}
+}
+
+// Run walks through the phases until ctx is cancelled or, unless looping, the last phase ends.
+// Completing with "stop" calls stop, which ends the generator and so lets the producer exit.
+func (p *Profile) Run(ctx context.Context, g *Generator, stop func()) {
+	if len(p.phases) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(profileTick)
+	defer ticker.Stop()
+
+	for {
+		for _, phase := range p.phases {
+			logging.Info("Entering load phase", logging.String("phase", phase.Name), logging.String("shape", phase.Shape))
+			LoadPhaseGauge.Reset()
+			LoadPhaseGauge.WithLabelValues(phase.Name, phase.Shape).Set(1)
+
+			duration := time.Duration(phase.Duration) * time.Millisecond
+			start := time.Now()
+			for elapsed := time.Duration(0); elapsed < duration; elapsed = time.Since(start) {
+				if rps := PhaseRate(phase, elapsed); rps != g.TargetRps() {
+					g.SetTargetRps(rps)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}
+
+		switch p.onComplete {
+		case OnCompleteLoop:
+			continue
+		case OnCompleteHold:
+			logging.Info("Load profile completed, holding the last rate")
+		default:
+			logging.Info("Load profile completed, stopping the generator")
+			g.SetTargetRps(0)
+			stop()
+		}
+		LoadPhaseGauge.Reset()
+		return
+	}
+}
+
+// PhaseRate returns the target rate of phase at elapsed time since the phase started.
+func PhaseRate(phase producer_structs.PhaseConfig, elapsed time.Duration) float64 {
+	duration := time.Duration(phase.Duration) * time.Millisecond
+	progress := 0.0
+	if duration > 0 {
+		progress = math.Min(float64(elapsed)/float64(duration), 1)
+	}
+
+	switch phase.Shape {
+	case ShapeRamp:
+		return phase.Rps + (phase.ToRps-phase.Rps)*progress
+	case ShapeStep:
+		steps := phase.Steps
+		if steps <= 1 {
+			return phase.ToRps
+		}
+		// The first step runs at rps and the last one at to_rps
+		step := math.Min(math.Floor(progress*float64(steps)), float64(steps-1))
+		return phase.Rps + (phase.ToRps-phase.Rps)*step/float64(steps-1)
+	case ShapeSpike:
+		// The spike is centered in the phase with the base rate on either side
+		spike := time.Duration(phase.SpikeDuration) * time.Millisecond
+		spikeStart := (duration - spike) / 2
+		if elapsed >= spikeStart && elapsed < spikeStart+spike {
+			return phase.ToRps
+		}
+		return phase.Rps
+	case ShapeSine:
+		period := time.Duration(phase.Period) * time.Millisecond
+		if period <= 0 {
+			period = duration
+		}
+		if period <= 0 {
+			return phase.Rps
+		}
+		// Oscillate between rps and to_rps, starting from the midpoint
+		mid := (phase.Rps + phase.ToRps) / 2
+		amplitude := (phase.ToRps - phase.Rps) / 2
+		return mid + amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(period))
+	default:
+		return phase.Rps
+	}
+}
@@ -0,0 +1,112 @@
+package workload
+
+import (
+	"context"
+	"math"
+	"producer/producer_structs"
+	"testing"
+	"time"
+)
+
+func TestPhaseRate(t *testing.T) {
+	second := time.Second
+	tests := []struct {
+		name    string
+		phase   producer_structs.PhaseConfig
+		elapsed time.Duration
+		want    float64
+	}{
+		{"constant", producer_structs.PhaseConfig{Shape: ShapeConstant, Duration: 10000, Rps: 50}, 3 * second, 50},
+		{"unknown shape", producer_structs.PhaseConfig{Shape: "", Duration: 10000, Rps: 50, ToRps: 80}, 3 * second, 50},
+		{"ramp start", producer_structs.PhaseConfig{Shape: ShapeRamp, Duration: 10000, Rps: 100, ToRps: 200}, 0, 100},
+		{"ramp middle", producer_structs.PhaseConfig{Shape: ShapeRamp, Duration: 10000, Rps: 100, ToRps: 200}, 5 * second, 150},
+		{"ramp down", producer_structs.PhaseConfig{Shape: ShapeRamp, Duration: 10000, Rps: 200, ToRps: 100}, 5 * second, 150},
+		{"ramp past the end", producer_structs.PhaseConfig{Shape: ShapeRamp, Duration: 10000, Rps: 100, ToRps: 200}, 20 * second, 200},
+		{"ramp without duration", producer_structs.PhaseConfig{Shape: ShapeRamp, Rps: 100, ToRps: 200}, second, 100},
+		{"first step", producer_structs.PhaseConfig{Shape: ShapeStep, Duration: 8000, Rps: 100, ToRps: 400, Steps: 4}, second, 100},
+		{"second step", producer_structs.PhaseConfig{Shape: ShapeStep, Duration: 8000, Rps: 100, ToRps: 400, Steps: 4}, 2 * second, 200},
+		{"last step", producer_structs.PhaseConfig{Shape: ShapeStep, Duration: 8000, Rps: 100, ToRps: 400, Steps: 4}, 7 * second, 400},
+		{"step at the end", producer_structs.PhaseConfig{Shape: ShapeStep, Duration: 8000, Rps: 100, ToRps: 400, Steps: 4}, 8 * second, 400},
+		{"single step", producer_structs.PhaseConfig{Shape: ShapeStep, Duration: 8000, Rps: 100, ToRps: 400, Steps: 1}, 0, 400},
+		{"before the spike", producer_structs.PhaseConfig{Shape: ShapeSpike, Duration: 10000, Rps: 10, ToRps: 1000, SpikeDuration: 2000}, 3999 * time.Millisecond, 10},
+		{"spike", producer_structs.PhaseConfig{Shape: ShapeSpike, Duration: 10000, Rps: 10, ToRps: 1000, SpikeDuration: 2000}, 4 * second, 1000},
+		{"after the spike", producer_structs.PhaseConfig{Shape: ShapeSpike, Duration: 10000, Rps: 10, ToRps: 1000, SpikeDuration: 2000}, 6 * second, 10},
+		{"sine start", producer_structs.PhaseConfig{Shape: ShapeSine, Duration: 10000, Rps: 100, ToRps: 300, Period: 4000}, 0, 200},
+		{"sine peak", producer_structs.PhaseConfig{Shape: ShapeSine, Duration: 10000, Rps: 100, ToRps: 300, Period: 4000}, second, 300},
+		{"sine trough", producer_structs.PhaseConfig{Shape: ShapeSine, Duration: 10000, Rps: 100, ToRps: 300, Period: 4000}, 3 * second, 100},
+		{"sine over the phase", producer_structs.PhaseConfig{Shape: ShapeSine, Duration: 4000, Rps: 100, ToRps: 300}, second, 300},
+		{"sine without period", producer_structs.PhaseConfig{Shape: ShapeSine, Rps: 100, ToRps: 300}, second, 100},
+	}
+	for _, tt := range tests {
+		if got := PhaseRate(tt.phase, tt.elapsed); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: PhaseRate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProfileStopEndsGenerator(t *testing.T) {
+	g := NewGenerator(0, 1, func() {})
+	profile := NewProfile(producer_structs.LoadProfileConfig{
+		Phases:     []producer_structs.PhaseConfig{{Shape: ShapeConstant, Duration: 1, Rps: 100}},
+		OnComplete: OnCompleteStop,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	generatorCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		g.Run(generatorCtx)
+		close(done)
+	}()
+	profile.Run(ctx, g, stop)
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("the generator kept running after the profile stopped")
+	}
+	if g.TargetRps() != 0 {
+		t.Errorf("TargetRps = %v after stopping, want 0", g.TargetRps())
+	}
+}
+
+func TestProfileHoldKeepsLastRate(t *testing.T) {
+	g := NewGenerator(0, 1, func() {})
+	profile := NewProfile(producer_structs.LoadProfileConfig{
+		Phases:     []producer_structs.PhaseConfig{{Shape: ShapeConstant, Duration: 1, Rps: 100}},
+		OnComplete: OnCompleteHold,
+	})
+	stopped := false
+	profile.Run(context.Background(), g, func() { stopped = true })
+	if stopped || g.TargetRps() != 100 {
+		t.Errorf("stopped %v with TargetRps %v, want the generator held at 100", stopped, g.TargetRps())
+	}
+}
+
+func TestProfileSkipsPhasesWithoutDuration(t *testing.T) {
+	profile := NewProfile(producer_structs.LoadProfileConfig{
+		Phases: []producer_structs.PhaseConfig{
+			{Name: "empty", Shape: ShapeConstant, Rps: 10},
+			{Name: "negative", Shape: ShapeRamp, Duration: -1, Rps: 20},
+			{Shape: "square", Duration: 1000, Rps: 30},
+		},
+		OnComplete: OnCompleteLoop,
+	})
+	if len(profile.phases) != 1 || profile.phases[0].Name != ShapeConstant {
+		t.Fatalf("phases = %+v, want only the constant phase left", profile.phases)
+	}
+
+	// A looping profile of phases without duration must not spin, it has nothing to run
+	profile = NewProfile(producer_structs.LoadProfileConfig{
+		Phases:     []producer_structs.PhaseConfig{{Shape: ShapeConstant, Rps: 10}},
+		OnComplete: OnCompleteLoop,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	g := NewGenerator(0, 1, func() {})
+	profile.Run(ctx, g, func() {})
+	if ctx.Err() != nil || g.TargetRps() != 0 {
+		t.Errorf("Run kept going until the deadline with TargetRps %v", g.TargetRps())
+	}
+}
@@ -0,0 +1,92 @@
+// Package admin holds what the runtime apis of the services share: bearer token checks, the
+// accounting of the changes made through them and their JSON responses.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"shared/logging"
+	"strings"
+	"time"
+)
+
+const bearerPrefix = "Bearer "
+
+// Response is the body of every api response.
+type Response struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+// Changes logs and counts the runtime changes made through an api by action.
+type Changes struct {
+	api        string
+	Counter    *prometheus.CounterVec
+	LastChange *prometheus.GaugeVec
+}
+
+// NewChanges creates the <namespace>_<api>_changes and <namespace>_<api>_last_change_timestamp_seconds
+// metrics of api, the caller registers them.
+func NewChanges(namespace string, api string) *Changes {
+	return &Changes{
+		api: api,
+		Counter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      api + "_changes",
+			Help:      "Counter for runtime changes made through the " + api + " api by action",
+		}, []string{"action"}),
+		LastChange: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      api + "_last_change_timestamp_seconds",
+			Help:      "Unix time of the last runtime change made through the " + api + " api by action",
+		}, []string{"action"}),
+	}
+}
+
+// Record logs action with its detail and counts it.
+func (c *Changes) Record(action string, detail string) {
+	logging.Info("Runtime change", logging.String("api", c.api), logging.String("action", action), logging.String("detail", detail))
+	c.Counter.WithLabelValues(action).Inc()
+	c.LastChange.WithLabelValues(action).Set(float64(time.Now().Unix()))
+}
+
+// Authorized reports whether r carries token in a bearer authorization header. An empty token
+// authorizes nothing, so the api stays closed until one is configured.
+func Authorized(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, bearerPrefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header[len(bearerPrefix):]), []byte(token)) == 1
+}
+
+// Accept checks the bearer token and method, writing the error response if either is wrong.
+func Accept(w http.ResponseWriter, r *http.Request, token string, methods ...string) bool {
+	w.Header().Set("content-type", "application/json")
+
+	if !Authorized(r, token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		WriteResponse(w, http.StatusUnauthorized, "Failure", "Unauthorized", nil)
+		return false
+	}
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	WriteResponse(w, http.StatusMethodNotAllowed, "Failure", "Method not allowed", nil)
+	return false
+}
+
+func WriteResponse(w http.ResponseWriter, code int, status string, message string, data interface{}) {
+	respByte, _ := json.Marshal(Response{
+		Status:  status,
+		Message: message,
+		Data:    data,
+	})
+	w.WriteHeader(code)
+	_, _ = w.Write(respByte)
+}
@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		token  string
+		want   bool
+	}{
+		{"bearer token", "Bearer secret", "secret", true},
+		{"bare token", "secret", "secret", false},
+		{"other scheme", "Basic secret", "secret", false},
+		{"wrong token", "Bearer secrets", "secret", false},
+		{"empty bearer", "Bearer ", "secret", false},
+		{"no header", "", "secret", false},
+		{"no token configured", "Bearer ", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := Authorized(r, test.token); got != test.want {
+			t.Errorf("%s: Authorized = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header string
+		want   int
+	}{
+		{"allowed", http.MethodPost, "Bearer secret", http.StatusOK},
+		{"unauthorized", http.MethodPost, "secret", http.StatusUnauthorized},
+		{"method not allowed", http.MethodDelete, "Bearer secret", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, "/", nil)
+		r.Header.Set("Authorization", test.header)
+		if Accept(w, r, "secret", http.MethodGet, http.MethodPost) {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != test.want {
+			t.Errorf("%s: code = %d, want %d", test.name, w.Code, test.want)
+		}
+		if test.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: missing WWW-Authenticate challenge", test.name)
+		}
+		if test.want != http.StatusOK {
+			var resp Response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != "Failure" {
+				t.Errorf("%s: body %q is not a failure response", test.name, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestChangesRecord(t *testing.T) {
+	changes := NewChanges("test", "admin")
+	changes.Record("pause", "")
+	changes.Record("pause", "")
+	changes.Record("seek", "offset=1")
+
+	if got := testutil.ToFloat64(changes.Counter.WithLabelValues("pause")); got != 2 {
+		t.Errorf("pause changes = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(changes.LastChange.WithLabelValues("seek")); got == 0 {
+		t.Error("last seek change isn't set")
+	}
+	if got := testutil.CollectAndCount(changes.Counter, "test_admin_changes"); got != 2 {
+		t.Errorf("got %d change series, want one per action", got)
+	}
+}
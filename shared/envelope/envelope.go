@@ -0,0 +1,75 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the envelope version written by this code. Messages without a version are
+// the legacy {id, value} shape and are still accepted.
+const SchemaVersion = 1
+
+// Message is the payload shared by the producer and the consumer.
+type Message struct {
+	Id    string  `json:"id"`
+	Value float64 `json:"value"`
+}
+
+// Envelope wraps a Message with the metadata needed to dedupe and time events. The payload is
+// embedded so that an envelope is a superset of the legacy shape.
+type Envelope struct {
+	SchemaVersion int       `json:"schema_version"`
+	EventId       string    `json:"event_id"`
+	EventTime     time.Time `json:"event_time"`
+	Source        string    `json:"source"`
+	Message
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// New wraps message in an envelope with a fresh event id, stamped now by source.
+func New(message Message, source string) Envelope {
+	return Envelope{
+		SchemaVersion: SchemaVersion,
+		EventId:       NewEventId(),
+		EventTime:     time.Now().UTC(),
+		Source:        source,
+		Message:       message,
+	}
+}
+
+// IsLegacy reports whether the envelope was decoded from a legacy message without metadata.
+func (e Envelope) IsLegacy() bool {
+	return e.SchemaVersion == 0
+}
+
+// Encode writes the envelope as JSON.
+func Encode(e Envelope) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode reads either an envelope or a legacy message. Legacy messages come back with a zero
+// SchemaVersion and no event id or time.
+func Decode(data []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Envelope{}, err
+	}
+	if e.SchemaVersion > SchemaVersion {
+		return Envelope{}, fmt.Errorf("unsupported envelope schema version %d", e.SchemaVersion)
+	}
+	return e, nil
+}
+
+// NewEventId returns a random RFC 4122 version 4 UUID.
+func NewEventId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand doesn't fail on supported platforms, fall back to a time based id anyway
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
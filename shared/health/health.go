@@ -0,0 +1,237 @@
+// Package health runs the liveness and readiness checks of a service in the background and serves
+// their last results on /healthz and /readyz, and as <namespace>_health_check_status metrics.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"shared/logging"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = 10 * time.Second
+	defaultTimeout  = 2 * time.Second
+
+	StatusUp      = "up"
+	StatusDown    = "down"
+	StatusPending = "pending"
+)
+
+// errPending is the result of checks that haven't run yet, so that a service isn't ready before
+// its first round of checks.
+var errPending = errors.New("not checked yet")
+
+// Func checks a dependency, returning an error when it is unhealthy. ctx is cancelled after the
+// check timeout.
+type Func func(ctx context.Context) error
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Duration  float64   `json:"duration_seconds"`
+}
+
+// Report is the body of /healthz and /readyz.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type check struct {
+	name string
+	// live checks fail both endpoints, the others only readiness
+	live bool
+	fn   Func
+}
+
+// Checker runs its checks every interval. Liveness checks tell whether the process has to be
+// restarted, readiness checks whether it currently does its work. Checks are added before Run.
+type Checker struct {
+	interval time.Duration
+	timeout  time.Duration
+	status   *prometheus.GaugeVec
+
+	mu      sync.Mutex
+	checks  []check
+	results map[string]Result
+}
+
+// NewChecker exports the check results as <namespace>_health_check_status.
+func NewChecker(namespace string, interval time.Duration, timeout time.Duration) *Checker {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Checker{
+		interval: interval,
+		timeout:  timeout,
+		status: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "health_check_status",
+			Help:      "Result of the last health check by check and kind, 1 when it passed",
+		}, []string{"check", "kind"}),
+		results: make(map[string]Result),
+	}
+}
+
+// Live adds a liveness check, which also gates readiness.
+func (c *Checker) Live(name string, fn Func) {
+	c.add(check{name: name, live: true, fn: fn})
+}
+
+// Ready adds a readiness check.
+func (c *Checker) Ready(name string, fn Func) {
+	c.add(check{name: name, fn: fn})
+}
+
+func (c *Checker) add(ch check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, ch)
+	c.results[ch.name] = Result{Status: StatusPending, Error: errPending.Error()}
+	c.status.WithLabelValues(ch.name, kind(ch.live)).Set(0)
+}
+
+// Collector returns the status gauge, to be registered by the service.
+func (c *Checker) Collector() prometheus.Collector {
+	return c.status
+}
+
+// Run checks every interval until ctx is done.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.runChecks(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runChecks runs the checks concurrently, so that a slow dependency doesn't delay the other results.
+func (c *Checker) runChecks(ctx context.Context) {
+	c.mu.Lock()
+	checks := append([]check{}, c.checks...)
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ch := range checks {
+		wg.Add(1)
+		go func(ch check) {
+			defer wg.Done()
+			c.record(ch, c.runCheck(ctx, ch))
+		}(ch)
+	}
+	wg.Wait()
+}
+
+func (c *Checker) runCheck(ctx context.Context, ch check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	startTime := time.Now()
+	// A hung dependency must fail the check, not hang it, so the result doesn't wait past the timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.fn(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", c.timeout)
+	}
+	result := Result{Status: StatusUp, CheckedAt: startTime, Duration: time.Since(startTime).Seconds()}
+	if err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (c *Checker) record(ch check, result Result) {
+	c.mu.Lock()
+	previous := c.results[ch.name]
+	c.results[ch.name] = result
+	c.mu.Unlock()
+
+	value := 0.0
+	if result.Status == StatusUp {
+		value = 1
+	}
+	c.status.WithLabelValues(ch.name, kind(ch.live)).Set(value)
+	// Only changes are logged, checks run far too often to log every result
+	if previous.Status != result.Status {
+		logger := logging.With(logging.String("check", ch.name), logging.String("status", result.Status))
+		if result.Status == StatusUp {
+			logger.Info("Health check passed")
+		} else {
+			logger.Warn("Health check failed", logging.String("error", result.Error))
+		}
+	}
+}
+
+// Report returns the last results of the liveness checks, or of all checks for readiness.
+func (c *Checker) Report(readiness bool) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := Report{Status: StatusUp, Checks: make(map[string]Result)}
+	for _, ch := range c.checks {
+		if !ch.live && !readiness {
+			continue
+		}
+		result := c.results[ch.name]
+		report.Checks[ch.name] = result
+		if result.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// Healthz serves the liveness checks, 503 when any of them failed.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Report(false))
+}
+
+// Readyz serves all checks, 503 when any of them failed.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Report(true))
+}
+
+// Register adds /healthz and /readyz to mux.
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", c.Healthz)
+	mux.HandleFunc("/readyz", c.Readyz)
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	code := http.StatusOK
+	if report.Status != StatusUp {
+		code = http.StatusServiceUnavailable
+	}
+	respByte, _ := json.Marshal(report)
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(code)
+	_, _ = w.Write(respByte)
+}
+
+func kind(live bool) string {
+	if live {
+		return "liveness"
+	}
+	return "readiness"
+}
@@ -0,0 +1,113 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve calls handle and returns the response code and report.
+func serve(t *testing.T, handle http.HandlerFunc) (int, Report) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handle(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var report Report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("report %q: %v", w.Body.String(), err)
+	}
+	return w.Code, report
+}
+
+func TestPendingChecksAreNotReady(t *testing.T) {
+	c := NewChecker("test", time.Hour, time.Second)
+	c.Live("process", func(context.Context) error { return nil })
+
+	code, report := serve(t, c.Readyz)
+	if code != http.StatusServiceUnavailable || report.Checks["process"].Status != StatusPending {
+		t.Errorf("code = %d, report = %+v, want unavailable until checked", code, report)
+	}
+	c.runChecks(context.Background())
+	if code, _ := serve(t, c.Readyz); code != http.StatusOK {
+		t.Errorf("code = %d after a passing check, want %d", code, http.StatusOK)
+	}
+}
+
+func TestReadinessChecksDontFailLiveness(t *testing.T) {
+	c := NewChecker("test", time.Hour, time.Second)
+	c.Live("process", func(context.Context) error { return nil })
+	c.Ready("kafka", func(context.Context) error { return errors.New("no brokers") })
+	c.runChecks(context.Background())
+
+	code, report := serve(t, c.Healthz)
+	if code != http.StatusOK || len(report.Checks) != 1 {
+		t.Errorf("healthz: code = %d, report = %+v, want only the passing liveness check", code, report)
+	}
+	code, report = serve(t, c.Readyz)
+	if code != http.StatusServiceUnavailable || report.Checks["kafka"].Error != "no brokers" {
+		t.Errorf("readyz: code = %d, report = %+v, want the failing kafka check", code, report)
+	}
+
+	if got := testutil.ToFloat64(c.status.WithLabelValues("process", "liveness")); got != 1 {
+		t.Errorf("process status = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(c.status.WithLabelValues("kafka", "readiness")); got != 0 {
+		t.Errorf("kafka status = %v, want 0", got)
+	}
+}
+
+func TestHungCheckTimesOut(t *testing.T) {
+	c := NewChecker("test", time.Hour, 50*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	// Ignores its context, like a client without deadlines
+	c.Ready("hung", func(context.Context) error {
+		<-release
+		return nil
+	})
+
+	startTime := time.Now()
+	c.runChecks(context.Background())
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("checks took %v, want them cut off at the 50ms timeout", elapsed)
+	}
+	result := c.Report(true).Checks["hung"]
+	if result.Status != StatusDown || !strings.Contains(result.Error, "timed out") {
+		t.Errorf("result = %+v, want a timeout", result)
+	}
+}
+
+func TestRunRechecks(t *testing.T) {
+	c := NewChecker("test", 10*time.Millisecond, time.Second)
+	failing := make(chan bool, 1)
+	failing <- true
+	c.Live("flapping", func(context.Context) error {
+		select {
+		case <-failing:
+			return errors.New("down")
+		default:
+			return nil
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Report(false).Status != StatusUp {
+		if time.Now().After(deadline) {
+			t.Fatal("the check didn't recover on a later run")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
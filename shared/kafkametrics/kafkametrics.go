@@ -0,0 +1,123 @@
+// Package kafkametrics exports the metrics sarama records in its go-metrics registry to Prometheus.
+//
+// Names follow sarama's with dashes replaced by underscores and a sarama_ prefix. Metrics sarama
+// keeps per broker or per topic ("request-latency-in-ms-for-broker-1", "batch-size-for-topic-t")
+// become sarama_broker_* and sarama_topic_* families with a broker or topic label, so that every
+// family has a single label set. Meters are exported as counters with a _total suffix, histograms
+// and timers as summaries. Gauges and go-metrics counters, which also count down as with
+// requests-in-flight, are exported as gauges.
+package kafkametrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"strings"
+	"sync"
+)
+
+const (
+	namespace = "sarama"
+
+	brokerSuffix = "-for-broker-"
+	topicSuffix  = "-for-topic-"
+)
+
+var quantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// Collector walks a go-metrics registry on every scrape. The metrics sarama creates depend on the
+// brokers and topics in use, so the collector is unchecked and describes nothing up front.
+type Collector struct {
+	registry metrics.Registry
+
+	mu    sync.Mutex
+	descs map[string]*prometheus.Desc
+}
+
+// NewCollector exports the metrics of registry, usually a sarama config's MetricRegistry.
+func NewCollector(registry metrics.Registry) *Collector {
+	return &Collector{registry: registry, descs: make(map[string]*prometheus.Desc)}
+}
+
+func (c *Collector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.registry.Each(func(name string, metric interface{}) {
+		family, labelName, labelValue := parseName(name)
+		var labels []string
+		var labelValues []string
+		if labelName != "" {
+			labels, labelValues = []string{labelName}, []string{labelValue}
+		}
+
+		switch m := metric.(type) {
+		case metrics.Meter:
+			desc := c.desc(family+"_total", name, labels)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(m.Snapshot().Count()), labelValues...)
+		case metrics.Counter:
+			desc := c.desc(family, name, labels)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(m.Snapshot().Count()), labelValues...)
+		case metrics.Gauge:
+			desc := c.desc(family, name, labels)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(m.Snapshot().Value()), labelValues...)
+		case metrics.GaugeFloat64:
+			desc := c.desc(family, name, labels)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.Snapshot().Value(), labelValues...)
+		case metrics.Histogram:
+			snapshot := m.Snapshot()
+			desc := c.desc(family, name, labels)
+			ch <- prometheus.MustNewConstSummary(desc, uint64(snapshot.Count()), float64(snapshot.Sum()),
+				summaryQuantiles(snapshot.Percentiles(quantiles)), labelValues...)
+		case metrics.Timer:
+			snapshot := m.Snapshot()
+			desc := c.desc(family, name, labels)
+			ch <- prometheus.MustNewConstSummary(desc, uint64(snapshot.Count()), float64(snapshot.Sum()),
+				summaryQuantiles(snapshot.Percentiles(quantiles)), labelValues...)
+		}
+	})
+}
+
+// desc caches descriptors by family, the first sarama name seen for a family documents it.
+func (c *Collector) desc(family string, name string, labels []string) *prometheus.Desc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if desc, ok := c.descs[family]; ok {
+		return desc
+	}
+	desc := prometheus.NewDesc(family, "Sarama client metric "+strings.TrimSuffix(name, "-"), labels, nil)
+	c.descs[family] = desc
+	return desc
+}
+
+// parseName splits a sarama metric name into a Prometheus family and an optional broker or topic label.
+func parseName(name string) (family string, labelName string, labelValue string) {
+	prefix := namespace + "_"
+	if i := strings.LastIndex(name, brokerSuffix); i >= 0 {
+		prefix, labelName, labelValue = namespace+"_broker_", "broker", name[i+len(brokerSuffix):]
+		name = name[:i]
+	} else if i := strings.Index(name, topicSuffix); i >= 0 {
+		// Topic names may contain dashes themselves, so the first occurrence is the separator
+		prefix, labelName, labelValue = namespace+"_topic_", "topic", name[i+len(topicSuffix):]
+		name = name[:i]
+	}
+	return prefix + sanitize(name), labelName, labelValue
+}
+
+// sanitize maps a sarama name onto the characters allowed in Prometheus metric names.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+func summaryQuantiles(values []float64) map[float64]float64 {
+	result := make(map[float64]float64, len(quantiles))
+	for i, q := range quantiles {
+		result[q] = values[i]
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+package kafkametrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rcrowley/go-metrics"
+	"strings"
+	"testing"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name       string
+		family     string
+		labelName  string
+		labelValue string
+	}{
+		{"incoming-byte-rate", "sarama_incoming_byte_rate", "", ""},
+		{"request-latency-in-ms-for-broker-1", "sarama_broker_request_latency_in_ms", "broker", "1"},
+		{"batch-size-for-topic-user-details", "sarama_topic_batch_size", "topic", "user-details"},
+		// The first separator splits, the topic keeps whatever follows it
+		{"record-send-rate-for-topic-a-for-topic-b", "sarama_topic_record_send_rate", "topic", "a-for-topic-b"},
+	}
+	for _, test := range tests {
+		family, labelName, labelValue := parseName(test.name)
+		if family != test.family || labelName != test.labelName || labelValue != test.labelValue {
+			t.Errorf("parseName(%q) = %q, %q, %q, want %q, %q, %q", test.name, family, labelName, labelValue, test.family, test.labelName, test.labelValue)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterMeter("request-rate-for-broker-1", registry).Mark(3)
+	metrics.GetOrRegisterCounter("requests-in-flight", registry).Inc(2)
+	metrics.GetOrRegisterGauge("queue-depth", registry).Update(7)
+	histogram := metrics.GetOrRegisterHistogram("batch-size-for-topic-t", registry, metrics.NewUniformSample(100))
+	for _, value := range []int64{10, 20, 30, 40} {
+		histogram.Update(value)
+	}
+
+	collector := NewCollector(registry)
+	expected := `
+# HELP sarama_broker_request_rate_total Sarama client metric request-rate-for-broker-1
+# TYPE sarama_broker_request_rate_total counter
+sarama_broker_request_rate_total{broker="1"} 3
+# HELP sarama_requests_in_flight Sarama client metric requests-in-flight
+# TYPE sarama_requests_in_flight gauge
+sarama_requests_in_flight 2
+# HELP sarama_queue_depth Sarama client metric queue-depth
+# TYPE sarama_queue_depth gauge
+sarama_queue_depth 7
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "sarama_requests_in_flight", "sarama_queue_depth", "sarama_broker_request_rate_total"); err != nil {
+		t.Error(err)
+	}
+
+	// Brokers connected later join the family of the first one
+	metrics.GetOrRegisterMeter("request-rate-for-broker-2", registry).Mark(5)
+	if got := testutil.CollectAndCount(collector, "sarama_broker_request_rate_total"); got != 2 {
+		t.Errorf("got %d broker request rate series, want 2", got)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "sarama_topic_batch_size" {
+			continue
+		}
+		summary := family.GetMetric()[0].GetSummary()
+		if summary.GetSampleCount() != 4 || summary.GetSampleSum() != 100 {
+			t.Errorf("batch size summary has %d samples summing to %v, want 4 and 100", summary.GetSampleCount(), summary.GetSampleSum())
+		}
+		if label := family.GetMetric()[0].GetLabel()[0]; label.GetName() != "topic" || label.GetValue() != "t" {
+			t.Errorf("batch size summary labelled %v, want topic t", label)
+		}
+		return
+	}
+	t.Error("no sarama_topic_batch_size summary collected")
+}
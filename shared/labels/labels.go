@@ -0,0 +1,251 @@
+// Package labels bounds the values of metric labels fed with user data, such as message ids, so
+// that a stream of new values can't create an unbounded number of Prometheus series.
+package labels
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"hash/fnv"
+	"sync"
+)
+
+// Policies
+const (
+	// Limit keeps the first MaxValues distinct values and maps later ones to Other
+	Limit = "limit"
+	// Allowlist keeps the values in Allowlist and maps all others to Other
+	Allowlist = "allowlist"
+	// TopK keeps the MaxValues most frequent values seen so far and maps others to Other, see
+	// OnEvict for the series of values it stops keeping
+	TopK = "topk"
+	// Hash maps every value to one of HashBuckets buckets
+	Hash = "hash"
+	// None keeps every value, only for labels fed from config
+	None = "none"
+
+	// Other is the overflow value of dropped label values
+	Other = "other"
+
+	defaultMaxValues   = 100
+	defaultHashBuckets = 32
+	// topKTracked bounds the values TopK counts, as a multiple of MaxValues
+	topKTracked = 10
+)
+
+// NewDroppedCounter creates <namespace>_metric_label_values_dropped, to be registered by the
+// service and shared by its policies.
+func NewDroppedCounter(namespace string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "metric_label_values_dropped",
+		Help:      "Counter for label values replaced by the label policy, by label",
+	}, []string{"label"})
+}
+
+// Config selects the policy of a label. The zero value limits the label to 100 values.
+type Config struct {
+	Policy      string   `json:"policy"`
+	MaxValues   int      `json:"max_values"`
+	Allowlist   []string `json:"allowlist"`
+	HashBuckets int      `json:"hash_buckets"`
+}
+
+// Vec is a metric vector whose series can be deleted by label value, such as *prometheus.CounterVec.
+type Vec interface {
+	DeletePartialMatch(labels prometheus.Labels) int
+}
+
+// Policy maps raw label values to bounded ones. It is safe for concurrent use.
+type Policy struct {
+	label   string
+	policy  string
+	max     int
+	hashes  int
+	dropped prometheus.Counter
+	evictIn []Vec
+
+	mu      sync.Mutex
+	allowed map[string]bool
+	// tracked holds the values TopK counts, the heaps order them by count for eviction and admission
+	tracked  map[string]*topKEntry
+	counted  countHeap
+	admitted countHeap
+}
+
+// New creates the policy of label from config, counting the values it replaces in dropped.
+func New(label string, config Config, dropped *prometheus.CounterVec) (*Policy, error) {
+	p := &Policy{
+		label:   label,
+		policy:  config.Policy,
+		max:     config.MaxValues,
+		hashes:  config.HashBuckets,
+		dropped: dropped.WithLabelValues(label),
+		allowed: make(map[string]bool),
+	}
+	if p.policy == "" {
+		p.policy = Limit
+	}
+	if p.max <= 0 {
+		p.max = defaultMaxValues
+	}
+	if p.hashes <= 0 {
+		p.hashes = defaultHashBuckets
+	}
+
+	switch p.policy {
+	case Limit, Hash, None:
+	case Allowlist:
+		for _, value := range config.Allowlist {
+			p.allowed[value] = true
+		}
+	case TopK:
+		p.tracked = make(map[string]*topKEntry)
+		p.counted = countHeap{heap: countedHeap}
+		p.admitted = countHeap{heap: admittedHeap}
+	default:
+		return nil, fmt.Errorf("unknown label policy %q for label %q", config.Policy, label)
+	}
+	return p, nil
+}
+
+// OnEvict deletes the series of vecs whose label carries a value TopK stops admitting, otherwise
+// every value admitted once would keep its series and churning values would grow them without
+// bound. Later observations of an evicted value count towards Other until it is admitted again.
+// The other policies never evict a value. OnEvict is meant to be called before the policy is used.
+func (p *Policy) OnEvict(vecs ...Vec) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evictIn = append(p.evictIn, vecs...)
+}
+
+// Value returns the label value to use for value.
+func (p *Policy) Value(value string) string {
+	switch p.policy {
+	case None:
+		return value
+	case Hash:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(value))
+		return fmt.Sprintf("bucket_%02d", h.Sum32()%uint32(p.hashes))
+	}
+
+	p.mu.Lock()
+	var keep bool
+	var evicted *topKEntry
+	switch p.policy {
+	case Allowlist:
+		keep = p.allowed[value]
+	case Limit:
+		keep = p.allowed[value]
+		if !keep && len(p.allowed) < p.max {
+			p.allowed[value] = true
+			keep = true
+		}
+	case TopK:
+		keep, evicted = p.observeTopK(value)
+	}
+	p.mu.Unlock()
+
+	if evicted != nil {
+		for _, vec := range p.evictIn {
+			vec.DeletePartialMatch(prometheus.Labels{p.label: evicted.value})
+		}
+	}
+	if !keep {
+		p.dropped.Inc()
+		return Other
+	}
+	return value
+}
+
+// observeTopK counts value and reports whether it is among the most frequent values, along with
+// the admitted value it pushed out, if any. Counts are kept for a bounded number of values with
+// the space-saving algorithm: a new value replaces the least frequent one and inherits its count.
+// A value overtaking the least frequent admitted one takes its place. Both lookups are heap tops,
+// so a value costs O(log n) whatever the number of tracked values.
+func (p *Policy) observeTopK(value string) (bool, *topKEntry) {
+	var evicted *topKEntry
+	entry, ok := p.tracked[value]
+	if !ok {
+		var count uint64
+		if p.counted.Len() >= p.max*topKTracked {
+			forgotten := heap.Pop(&p.counted).(*topKEntry)
+			delete(p.tracked, forgotten.value)
+			if forgotten.index[admittedHeap] >= 0 {
+				heap.Remove(&p.admitted, forgotten.index[admittedHeap])
+				evicted = forgotten
+			}
+			count = forgotten.count
+		}
+		entry = &topKEntry{value: value, count: count, index: [2]int{-1, -1}}
+		p.tracked[value] = entry
+		heap.Push(&p.counted, entry)
+	}
+	entry.count++
+	heap.Fix(&p.counted, entry.index[countedHeap])
+
+	if entry.index[admittedHeap] >= 0 {
+		heap.Fix(&p.admitted, entry.index[admittedHeap])
+		return true, evicted
+	}
+	if p.admitted.Len() < p.max {
+		heap.Push(&p.admitted, entry)
+		return true, evicted
+	}
+	// The admitted heap is only full when nothing was forgotten above
+	if least := p.admitted.entries[0]; entry.count > least.count {
+		evicted = heap.Pop(&p.admitted).(*topKEntry)
+		heap.Push(&p.admitted, entry)
+		return true, evicted
+	}
+	return false, evicted
+}
+
+// Heaps a TopK entry can be in
+const (
+	countedHeap  = 0
+	admittedHeap = 1
+)
+
+type topKEntry struct {
+	value string
+	count uint64
+	// index is the position in the counted and admitted heaps, -1 when not in one
+	index [2]int
+}
+
+// countHeap is a min-heap of entries by count, keeping each entry's position in it up to date.
+type countHeap struct {
+	heap    int
+	entries []*topKEntry
+}
+
+func (h countHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h countHeap) Less(i, j int) bool {
+	return h.entries[i].count < h.entries[j].count
+}
+
+func (h countHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index[h.heap] = i
+	h.entries[j].index[h.heap] = j
+}
+
+func (h *countHeap) Push(x interface{}) {
+	entry := x.(*topKEntry)
+	entry.index[h.heap] = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *countHeap) Pop() interface{} {
+	last := len(h.entries) - 1
+	entry := h.entries[last]
+	h.entries[last] = nil
+	h.entries = h.entries[:last]
+	entry.index[h.heap] = -1
+	return entry
+}
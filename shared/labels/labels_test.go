@@ -0,0 +1,163 @@
+package labels
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newPolicy(t *testing.T, config Config) (*Policy, *prometheus.CounterVec) {
+	t.Helper()
+	dropped := NewDroppedCounter("test")
+	p, err := New("id", config, dropped)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p, dropped
+}
+
+func TestLimit(t *testing.T) {
+	p, dropped := newPolicy(t, Config{MaxValues: 2})
+	for _, tt := range []struct{ value, want string }{
+		{"a", "a"}, {"b", "b"}, {"c", Other}, {"a", "a"}, {"d", Other},
+	} {
+		if got := p.Value(tt.value); got != tt.want {
+			t.Errorf("Value(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+	if got := testutil.ToFloat64(dropped.WithLabelValues("id")); got != 2 {
+		t.Errorf("dropped = %v, want 2", got)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	p, _ := newPolicy(t, Config{Policy: Allowlist, Allowlist: []string{"a", "b"}})
+	for _, tt := range []struct{ value, want string }{
+		{"a", "a"}, {"c", Other}, {"b", "b"},
+	} {
+		if got := p.Value(tt.value); got != tt.want {
+			t.Errorf("Value(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	p, dropped := newPolicy(t, Config{Policy: Hash, HashBuckets: 4})
+	buckets := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		value := p.Value(strconv.Itoa(i))
+		if !strings.HasPrefix(value, "bucket_") {
+			t.Fatalf("Value = %q, want a bucket", value)
+		}
+		buckets[value] = true
+	}
+	if len(buckets) != 4 {
+		t.Errorf("%d buckets used, want 4", len(buckets))
+	}
+	if p.Value("42") != p.Value("42") {
+		t.Error("a value moved between buckets")
+	}
+	if got := testutil.ToFloat64(dropped.WithLabelValues("id")); got != 0 {
+		t.Errorf("dropped = %v, hashing doesn't drop values", got)
+	}
+}
+
+func TestNoneAndUnknownPolicy(t *testing.T) {
+	p, _ := newPolicy(t, Config{Policy: None, MaxValues: 1})
+	for i := 0; i < 10; i++ {
+		if value := strconv.Itoa(i); p.Value(value) != value {
+			t.Fatalf("Value(%q) was replaced", value)
+		}
+	}
+	if _, err := New("id", Config{Policy: "random"}, NewDroppedCounter("test")); err == nil {
+		t.Error("New accepted an unknown policy")
+	}
+}
+
+func TestTopKAdmitsFrequentValues(t *testing.T) {
+	p, _ := newPolicy(t, Config{Policy: TopK, MaxValues: 2})
+	// The first values are admitted while there is room
+	p.Value("rare")
+	p.Value("hot")
+	if got := p.Value("warm"); got != Other {
+		t.Errorf("Value(warm) = %q with no room, want %q", got, Other)
+	}
+	// Overtaking the least frequent admitted value takes its place
+	for i := 0; i < 3; i++ {
+		p.Value("hot")
+		p.Value("warm")
+	}
+	if got := p.Value("warm"); got != "warm" {
+		t.Errorf("Value(warm) = %q after overtaking rare, want it admitted", got)
+	}
+	if got := p.Value("rare"); got != Other {
+		t.Errorf("Value(rare) = %q after being overtaken, want %q", got, Other)
+	}
+	if got := p.Value("hot"); got != "hot" {
+		t.Errorf("Value(hot) = %q, want it kept", got)
+	}
+}
+
+func TestTopKBoundsTrackedValues(t *testing.T) {
+	p, _ := newPolicy(t, Config{Policy: TopK, MaxValues: 3})
+	for i := 0; i < 100; i++ {
+		p.Value("hot")
+	}
+	// Space-saving keeps a value whose count stays above the evicted counts, about 1000/30 here
+	for i := 0; i < 1000; i++ {
+		p.Value("cold_" + strconv.Itoa(i))
+	}
+
+	if len(p.tracked) > 3*topKTracked || p.counted.Len() != len(p.tracked) {
+		t.Errorf("%d values tracked, %d in the heap, want at most %d", len(p.tracked), p.counted.Len(), 3*topKTracked)
+	}
+	if p.admitted.Len() > 3 {
+		t.Errorf("%d values admitted, want at most 3", p.admitted.Len())
+	}
+	if got := p.Value("hot"); got != "hot" {
+		t.Errorf("Value(hot) = %q, want the most frequent value kept", got)
+	}
+	checkHeap(t, "counted", p.counted)
+	checkHeap(t, "admitted", p.admitted)
+}
+
+// checkHeap verifies the heap order and that every entry knows its position.
+func checkHeap(t *testing.T, name string, h countHeap) {
+	t.Helper()
+	for i, entry := range h.entries {
+		if entry.index[h.heap] != i {
+			t.Errorf("%s: entry %q at %d thinks it is at %d", name, entry.value, i, entry.index[h.heap])
+		}
+		if parent := (i - 1) / 2; i > 0 && h.entries[parent].count > entry.count {
+			t.Errorf("%s: entry %q with count %d is below a count of %d", name, entry.value, entry.count, h.entries[parent].count)
+		}
+	}
+}
+
+func TestTopKDeletesEvictedSeries(t *testing.T) {
+	p, _ := newPolicy(t, Config{Policy: TopK, MaxValues: 2})
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_messages"}, []string{"mode", "id"})
+	p.OnEvict(counter)
+	count := func(value string) {
+		counter.WithLabelValues("sync", p.Value(value)).Inc()
+	}
+
+	count("rare")
+	count("hot")
+	for i := 0; i < 3; i++ {
+		count("hot")
+		count("warm")
+	}
+	// warm overtook rare, so the series of rare is gone while the others are kept
+	if got := testutil.CollectAndCount(counter); got != 3 {
+		t.Errorf("%d series, want hot, warm and other", got)
+	}
+	if got := testutil.ToFloat64(counter.WithLabelValues("sync", "hot")); got != 4 {
+		t.Errorf("hot = %v, want 4", got)
+	}
+	if counter.DeleteLabelValues("sync", "rare") {
+		t.Error("the series of the evicted value is still there")
+	}
+}
@@ -0,0 +1,288 @@
+// Package logging writes levelled, structured JSON log entries. Entries with the same level and
+// message are sampled, so that per message logs don't flood the container logs at high rates.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of an entry, entries below the level of a logger are discarded.
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// samplerBuckets bounds the memory of the sampler, messages sharing a bucket share a budget
+const samplerBuckets = 4096
+
+var (
+	SampledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log_entries_sampled_out",
+		Help: "Counter for log entries dropped by sampling, by level",
+	}, []string{"level"})
+
+	levelNames = []string{"debug", "info", "warn", "error"}
+	std        = mustNew("", Config{})
+)
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+func (l Level) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// Config sets the initial level, info when empty. With sampling, the first Initial entries of each
+// level and message are written every second, then only every Thereafter-th. Errors are never
+// sampled, a zero Initial disables sampling.
+type Config struct {
+	Level    string         `json:"level"`
+	Sampling SamplingConfig `json:"sampling"`
+}
+
+type SamplingConfig struct {
+	Initial    int `json:"initial"`
+	Thereafter int `json:"thereafter"`
+}
+
+// Field is a key value pair added to an entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key string, value string) Field          { return Field{key, value} }
+func Int(key string, value int) Field                { return Field{key, value} }
+func Int32(key string, value int32) Field            { return Field{key, value} }
+func Int64(key string, value int64) Field            { return Field{key, value} }
+func Float64(key string, value float64) Field        { return Field{key, value} }
+func Bool(key string, value bool) Field              { return Field{key, value} }
+func Any(key string, value interface{}) Field        { return Field{key, value} }
+func Duration(key string, value time.Duration) Field { return Field{key, value.String()} }
+
+// Err adds err under the error key.
+func Err(err error) Field {
+	if err == nil {
+		return Field{"error", nil}
+	}
+	return Field{"error", err.Error()}
+}
+
+// Logger writes entries carrying its fields. Loggers derived with With share the level, output
+// and sampler of their parent. It is safe for concurrent use.
+type Logger struct {
+	core   *core
+	fields []Field
+}
+
+type core struct {
+	service string
+	level   atomic.Int32
+
+	mu         sync.Mutex
+	out        io.Writer
+	initial    uint64
+	thereafter uint64
+	counts     [samplerBuckets]sampleCount
+}
+
+type sampleCount struct {
+	second int64
+	n      uint64
+}
+
+// New creates a logger writing to stderr, tagging every entry with service.
+func New(service string, config Config) (*Logger, error) {
+	level := InfoLevel
+	if config.Level != "" {
+		var err error
+		if level, err = ParseLevel(config.Level); err != nil {
+			return nil, err
+		}
+	}
+	c := &core{service: service, out: os.Stderr}
+	c.level.Store(int32(level))
+	if config.Sampling.Initial > 0 {
+		c.initial = uint64(config.Sampling.Initial)
+		c.thereafter = uint64(config.Sampling.Thereafter)
+	}
+	return &Logger{core: c}, nil
+}
+
+func mustNew(service string, config Config) *Logger {
+	l, err := New(service, config)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// SetDefault replaces the logger used by the package level functions.
+func SetDefault(l *Logger) {
+	std = l
+}
+
+func Default() *Logger {
+	return std
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.core.level.Store(int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(l.core.level.Load())
+}
+
+// Enabled reports whether entries of level are written, to skip building expensive fields.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// With returns a logger adding fields to every entry.
+func (l *Logger) With(fields ...Field) *Logger {
+	return &Logger{core: l.core, fields: append(append([]Field{}, l.fields...), fields...)}
+}
+
+// WithContext returns a logger adding the trace and span id of the span in ctx, if any.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return l
+	}
+	return l.With(String("trace_id", spanContext.TraceID().String()), String("span_id", spanContext.SpanID().String()))
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.log(DebugLevel, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.log(InfoLevel, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.log(WarnLevel, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.log(ErrorLevel, msg, fields) }
+
+// Fatal writes an error entry and exits.
+func (l *Logger) Fatal(msg string, fields ...Field) {
+	l.log(ErrorLevel, msg, fields)
+	os.Exit(1)
+}
+
+// Panic writes an error entry and panics with msg.
+func (l *Logger) Panic(msg string, fields ...Field) {
+	l.log(ErrorLevel, msg, fields)
+	panic(msg)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	// Sampled out entries aren't even formatted
+	if level < ErrorLevel && !l.core.sample(level, msg, now.Unix()) {
+		SampledCounter.WithLabelValues(level.String()).Inc()
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeValue(&buf, now.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeValue(&buf, level.String())
+	if l.core.service != "" {
+		buf.WriteString(`,"service":`)
+		writeValue(&buf, l.core.service)
+	}
+	buf.WriteString(`,"msg":`)
+	writeValue(&buf, msg)
+	for _, field := range l.fields {
+		writeField(&buf, field)
+	}
+	for _, field := range fields {
+		writeField(&buf, field)
+	}
+	buf.WriteString("}\n")
+
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	_, _ = l.core.out.Write(buf.Bytes())
+}
+
+// sample counts the entry and reports whether it is written.
+func (c *core) sample(level Level, msg string, second int64) bool {
+	if c.initial == 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := fnv.New32a()
+	_, _ = h.Write([]byte{byte(level)})
+	_, _ = h.Write([]byte(msg))
+	count := &c.counts[h.Sum32()%samplerBuckets]
+	if count.second != second {
+		count.second = second
+		count.n = 0
+	}
+	count.n++
+	if count.n <= c.initial {
+		return true
+	}
+	return c.thereafter > 0 && (count.n-c.initial)%c.thereafter == 0
+}
+
+func writeField(buf *bytes.Buffer, field Field) {
+	buf.WriteByte(',')
+	writeValue(buf, field.Key)
+	buf.WriteByte(':')
+	writeValue(buf, field.Value)
+}
+
+// writeValue writes value as JSON, falling back to its string form when it can't be marshalled.
+func writeValue(buf *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+	buf.Write(encoded)
+}
+
+// Package level functions log through the default logger.
+
+func With(fields ...Field) *Logger            { return std.With(fields...) }
+func WithContext(ctx context.Context) *Logger { return std.WithContext(ctx) }
+func Debug(msg string, fields ...Field)       { std.Debug(msg, fields...) }
+func Info(msg string, fields ...Field)        { std.Info(msg, fields...) }
+func Warn(msg string, fields ...Field)        { std.Warn(msg, fields...) }
+func Error(msg string, fields ...Field)       { std.Error(msg, fields...) }
+func Fatal(msg string, fields ...Field)       { std.Fatal(msg, fields...) }
+func Panic(msg string, fields ...Field)       { std.Panic(msg, fields...) }
+func Enabled(level Level) bool                { return std.Enabled(level) }
@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(t *testing.T, config Config) (*Logger, *bytes.Buffer) {
+	t.Helper()
+	l, err := New("test", config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var out bytes.Buffer
+	l.core.out = &out
+	return l, &out
+}
+
+func entries(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var result []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("entry %q isn't JSON: %v", line, err)
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+func TestSampler(t *testing.T) {
+	l, _ := newTestLogger(t, Config{Sampling: SamplingConfig{Initial: 2, Thereafter: 3}})
+
+	var written []int
+	for n := 1; n <= 8; n++ {
+		if l.core.sample(InfoLevel, "message", 100) {
+			written = append(written, n)
+		}
+	}
+	// The first 2, then every 3rd of the rest
+	if want := []int{1, 2, 5, 8}; !reflect.DeepEqual(written, want) {
+		t.Errorf("wrote entries %v, want %v", written, want)
+	}
+	if !l.core.sample(InfoLevel, "other message", 100) {
+		t.Error("another message shared the count of the first")
+	}
+	if !l.core.sample(InfoLevel, "message", 101) {
+		t.Error("the count didn't start over in the next second")
+	}
+}
+
+func TestSamplerWithoutThereafter(t *testing.T) {
+	l, _ := newTestLogger(t, Config{Sampling: SamplingConfig{Initial: 1}})
+	if !l.core.sample(WarnLevel, "message", 100) || l.core.sample(WarnLevel, "message", 100) {
+		t.Error("want only the first entry of the second written")
+	}
+}
+
+func TestSampledEntriesAreCounted(t *testing.T) {
+	l, out := newTestLogger(t, Config{Sampling: SamplingConfig{Initial: 1}})
+	sampled := testutil.ToFloat64(SampledCounter.WithLabelValues("warn"))
+
+	for n := 0; n < 5; n++ {
+		l.Warn("repeated")
+		l.Error("failed")
+	}
+	// Assuming the loop doesn't straddle a second, only the first warning is written
+	var warnings, errorEntries int
+	for _, entry := range entries(t, out) {
+		switch entry["level"] {
+		case "warn":
+			warnings++
+		case "error":
+			errorEntries++
+		}
+	}
+	if errorEntries != 5 {
+		t.Errorf("wrote %d errors, want all 5, errors aren't sampled", errorEntries)
+	}
+	if got := testutil.ToFloat64(SampledCounter.WithLabelValues("warn")) - sampled; warnings+int(got) != 5 || warnings > 2 {
+		t.Errorf("wrote %d warnings and counted %v sampled out, want them to add up to 5", warnings, got)
+	}
+}
+
+func TestEntryFields(t *testing.T) {
+	l, out := newTestLogger(t, Config{Level: "warn"})
+	l.Info("dropped")
+	l.With(String("topic", "t")).Warn("written", Int("partition", 3), Err(errors.New("boom")))
+
+	got := entries(t, out)
+	if len(got) != 1 {
+		t.Fatalf("got %d entries, want only the one above the level", len(got))
+	}
+	want := map[string]interface{}{"level": "warn", "service": "test", "msg": "written", "topic": "t", "partition": 3.0, "error": "boom"}
+	for key, value := range want {
+		if got[0][key] != value {
+			t.Errorf("%s = %v, want %v", key, got[0][key], value)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != WarnLevel {
+		t.Errorf("ParseLevel(WARN) = %v, %v", level, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("accepted an unknown level")
+	}
+	if _, err := New("test", Config{Level: "loud"}); err == nil {
+		t.Error("New accepted an unknown level")
+	}
+}
@@ -0,0 +1,216 @@
+package serde
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"shared/envelope"
+	"sync"
+	"time"
+)
+
+// avroSchema is the writer schema registered for the avro encoding. Fields are written in this
+// order by hand, so any change here must be mirrored in Encode and Decode.
+const avroSchema = `{
+  "type": "record",
+  "name": "Envelope",
+  "namespace": "go_metrics_grafana",
+  "fields": [
+    {"name": "schema_version", "type": "int"},
+    {"name": "event_id", "type": "string"},
+    {"name": "event_time", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+    {"name": "source", "type": "string"},
+    {"name": "id", "type": "string"},
+    {"name": "value", "type": "double"},
+    {"name": "attributes", "type": {"type": "map", "values": "string"}}
+  ]
+}`
+
+// Confluent wire format: a zero magic byte and the big endian schema id precede the avro body
+const (
+	avroMagic      = 0
+	avroHeaderSize = 5
+)
+
+var errShortAvro = errors.New("avro: unexpected end of data")
+
+type avroSerializer struct {
+	registry Registry
+	schemaId int
+
+	// writer schemas already checked against ours, by id
+	mu    sync.Mutex
+	known map[int]bool
+}
+
+func newAvroSerializer(registry Registry, subject string) (*avroSerializer, error) {
+	if registry == nil {
+		return nil, errors.New("avro encoding needs a schema registry")
+	}
+	id, err := registry.Register(subject, avroSchema)
+	if err != nil {
+		return nil, fmt.Errorf("registering avro schema under %q: %w", subject, err)
+	}
+	return &avroSerializer{registry: registry, schemaId: id, known: map[int]bool{id: true}}, nil
+}
+
+func (s *avroSerializer) Name() string {
+	return Avro
+}
+
+func (s *avroSerializer) Encode(e envelope.Envelope) ([]byte, error) {
+	b := make([]byte, avroHeaderSize, 128)
+	b[0] = avroMagic
+	binary.BigEndian.PutUint32(b[1:avroHeaderSize], uint32(s.schemaId))
+
+	var micros int64
+	if !e.EventTime.IsZero() {
+		micros = e.EventTime.UnixMicro()
+	}
+	b = appendAvroLong(b, int64(e.SchemaVersion))
+	b = appendAvroString(b, e.EventId)
+	b = appendAvroLong(b, micros)
+	b = appendAvroString(b, e.Source)
+	b = appendAvroString(b, e.Id)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(e.Value))
+	if len(e.Attributes) > 0 {
+		b = appendAvroLong(b, int64(len(e.Attributes)))
+		for key, value := range e.Attributes {
+			b = appendAvroString(b, key)
+			b = appendAvroString(b, value)
+		}
+	}
+	// An empty block ends the map
+	return appendAvroLong(b, 0), nil
+}
+
+func (s *avroSerializer) Decode(data []byte) (envelope.Envelope, error) {
+	if len(data) < avroHeaderSize || data[0] != avroMagic {
+		return envelope.Envelope{}, errors.New("avro: missing confluent wire format header")
+	}
+	if err := s.checkSchema(int(binary.BigEndian.Uint32(data[1:avroHeaderSize]))); err != nil {
+		return envelope.Envelope{}, err
+	}
+
+	r := avroReader{data: data[avroHeaderSize:]}
+	var e envelope.Envelope
+	e.SchemaVersion = int(r.long())
+	e.EventId = r.string()
+	if micros := r.long(); micros != 0 {
+		e.EventTime = time.UnixMicro(micros).UTC()
+	}
+	e.Source = r.string()
+	e.Id = r.string()
+	e.Value = r.double()
+	for {
+		count := r.long()
+		if count == 0 || r.err != nil {
+			break
+		}
+		if count < 0 {
+			// A negative count is followed by the block size in bytes, which we don't need
+			count = -count
+			r.long()
+		}
+		if e.Attributes == nil {
+			e.Attributes = make(map[string]string, count)
+		}
+		for i := int64(0); i < count && r.err == nil; i++ {
+			key := r.string()
+			e.Attributes[key] = r.string()
+		}
+	}
+	if r.err != nil {
+		return envelope.Envelope{}, r.err
+	}
+
+	if e.SchemaVersion > envelope.SchemaVersion {
+		return envelope.Envelope{}, fmt.Errorf("unsupported envelope schema version %d", e.SchemaVersion)
+	}
+	return e, nil
+}
+
+// checkSchema makes sure a writer schema id resolves to the schema this serializer can read.
+func (s *avroSerializer) checkSchema(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.known[id] {
+		return nil
+	}
+
+	schema, err := s.registry.Schema(id)
+	if err != nil {
+		return fmt.Errorf("avro: looking up schema %d: %w", id, err)
+	}
+	if !sameSchema(schema, avroSchema) {
+		return fmt.Errorf("avro: schema %d doesn't match the envelope schema", id)
+	}
+	s.known[id] = true
+	return nil
+}
+
+func sameSchema(a, b string) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, []byte(a)) != nil || json.Compact(&cb, []byte(b)) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func appendAvroLong(b []byte, v int64) []byte {
+	return binary.AppendUvarint(b, uint64((v<<1)^(v>>63)))
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = appendAvroLong(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// avroReader reads avro primitives, remembering the first error so callers can check once.
+type avroReader struct {
+	data []byte
+	err  error
+}
+
+func (r *avroReader) long() int64 {
+	if r.err != nil {
+		return 0
+	}
+	u, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errShortAvro
+		return 0
+	}
+	r.data = r.data[n:]
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *avroReader) string() string {
+	n := r.long()
+	if r.err != nil {
+		return ""
+	}
+	if n < 0 || int64(len(r.data)) < n {
+		r.err = errShortAvro
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *avroReader) double() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 8 {
+		r.err = errShortAvro
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.data))
+	r.data = r.data[8:]
+	return v
+}
@@ -0,0 +1,160 @@
+package serde
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"shared/envelope"
+	"time"
+)
+
+// Field numbers of the Envelope message in envelope.proto
+const (
+	pbSchemaVersion = 1
+	pbEventId       = 2
+	pbEventTime     = 3
+	pbSource        = 4
+	pbId            = 5
+	pbValue         = 6
+	pbAttributes    = 7
+
+	pbMapKey   = 1
+	pbMapValue = 2
+)
+
+type protobufSerializer struct{}
+
+func (protobufSerializer) Name() string {
+	return Protobuf
+}
+
+func (protobufSerializer) Encode(e envelope.Envelope) ([]byte, error) {
+	var b []byte
+	if e.SchemaVersion != 0 {
+		b = protowire.AppendTag(b, pbSchemaVersion, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.SchemaVersion))
+	}
+	b = appendString(b, pbEventId, e.EventId)
+	if !e.EventTime.IsZero() {
+		b = protowire.AppendTag(b, pbEventTime, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.EventTime.UnixNano()))
+	}
+	b = appendString(b, pbSource, e.Source)
+	b = appendString(b, pbId, e.Id)
+	if e.Value != 0 {
+		b = protowire.AppendTag(b, pbValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(e.Value))
+	}
+	for key, value := range e.Attributes {
+		var entry []byte
+		entry = appendString(entry, pbMapKey, key)
+		entry = appendString(entry, pbMapValue, value)
+		b = protowire.AppendTag(b, pbAttributes, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+func (protobufSerializer) Decode(data []byte) (envelope.Envelope, error) {
+	var e envelope.Envelope
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return envelope.Envelope{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == pbSchemaVersion && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return envelope.Envelope{}, protowire.ParseError(n)
+			}
+			e.SchemaVersion, data = int(v), data[n:]
+		case num == pbEventTime && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return envelope.Envelope{}, protowire.ParseError(n)
+			}
+			e.EventTime, data = time.Unix(0, int64(v)).UTC(), data[n:]
+		case num == pbValue && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return envelope.Envelope{}, protowire.ParseError(n)
+			}
+			e.Value, data = math.Float64frombits(v), data[n:]
+		case typ == protowire.BytesType && (num == pbEventId || num == pbSource || num == pbId || num == pbAttributes):
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return envelope.Envelope{}, protowire.ParseError(n)
+			}
+			data = data[n:]
+			if err := setBytesField(&e, num, v); err != nil {
+				return envelope.Envelope{}, err
+			}
+		default:
+			// Skip fields added by newer writers
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return envelope.Envelope{}, protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+
+	if e.SchemaVersion > envelope.SchemaVersion {
+		return envelope.Envelope{}, fmt.Errorf("unsupported envelope schema version %d", e.SchemaVersion)
+	}
+	return e, nil
+}
+
+func setBytesField(e *envelope.Envelope, num protowire.Number, v []byte) error {
+	switch num {
+	case pbEventId:
+		e.EventId = string(v)
+	case pbSource:
+		e.Source = string(v)
+	case pbId:
+		e.Id = string(v)
+	case pbAttributes:
+		var key, value string
+		for len(v) > 0 {
+			entryNum, typ, n := protowire.ConsumeTag(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			v = v[n:]
+			if typ != protowire.BytesType {
+				n = protowire.ConsumeFieldValue(entryNum, typ, v)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				v = v[n:]
+				continue
+			}
+			s, n := protowire.ConsumeBytes(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			v = v[n:]
+			if entryNum == pbMapKey {
+				key = string(s)
+			} else if entryNum == pbMapValue {
+				value = string(s)
+			}
+		}
+		if e.Attributes == nil {
+			e.Attributes = make(map[string]string)
+		}
+		e.Attributes[key] = value
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
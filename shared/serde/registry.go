@@ -0,0 +1,148 @@
+package serde
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry stores schemas and hands out the ids written in front of avro messages.
+type Registry interface {
+	// Register returns the id of schema under subject, registering it if it is new.
+	Register(subject, schema string) (int, error)
+	// Schema returns the schema with the given id.
+	Schema(id int) (string, error)
+}
+
+// NewRegistry returns a client for the schema registry at url, or an in-memory registry when url is empty.
+func NewRegistry(url string) Registry {
+	if url == "" {
+		return NewMemoryRegistry()
+	}
+	return NewHTTPRegistry(url)
+}
+
+// MemoryRegistry is a process local registry handing out sequential ids. Services that register the
+// same schemas in the same order agree on ids, which is enough for local runs without a registry.
+type MemoryRegistry struct {
+	mu      sync.Mutex
+	ids     map[string]int
+	schemas []string
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{ids: make(map[string]int)}
+}
+
+func (m *MemoryRegistry) Register(subject, schema string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, known := range m.schemas {
+		if sameSchema(known, schema) {
+			m.ids[subject] = id + 1
+			return id + 1, nil
+		}
+	}
+	m.schemas = append(m.schemas, schema)
+	m.ids[subject] = len(m.schemas)
+	return len(m.schemas), nil
+}
+
+func (m *MemoryRegistry) Schema(id int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id < 1 || id > len(m.schemas) {
+		return "", fmt.Errorf("schema %d not found", id)
+	}
+	return m.schemas[id-1], nil
+}
+
+// HTTPRegistry talks to a Confluent compatible schema registry, caching schemas by id.
+type HTTPRegistry struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	schemas map[int]string
+}
+
+const registryContentType = "application/vnd.schemaregistry.v1+json"
+
+func NewHTTPRegistry(url string) *HTTPRegistry {
+	return &HTTPRegistry{
+		url:     strings.TrimSuffix(url, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		schemas: make(map[int]string),
+	}
+}
+
+func (r *HTTPRegistry) Register(subject, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Id int `json:"id"`
+	}
+	if err := r.do(http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", body, &result); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	r.schemas[result.Id] = schema
+	r.mu.Unlock()
+	return result.Id, nil
+}
+
+func (r *HTTPRegistry) Schema(id int) (string, error) {
+	r.mu.Lock()
+	schema, ok := r.schemas[id]
+	r.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	var result struct {
+		Schema string `json:"schema"`
+	}
+	if err := r.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &result); err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	r.schemas[id] = result.Schema
+	r.mu.Unlock()
+	return result.Schema, nil
+}
+
+func (r *HTTPRegistry) do(method, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, r.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", registryContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", registryContentType)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("schema registry %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, result)
+}
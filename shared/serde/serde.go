@@ -0,0 +1,51 @@
+package serde
+
+import (
+	"fmt"
+	"shared/envelope"
+)
+
+const (
+	JSON     = "json"
+	Protobuf = "protobuf"
+	Avro     = "avro"
+
+	// EncodingHeader tells the consumer which serializer a message was written with
+	EncodingHeader = "x-encoding"
+)
+
+// Serializer converts envelopes to and from their wire format.
+type Serializer interface {
+	Name() string
+	Encode(e envelope.Envelope) ([]byte, error)
+	Decode(data []byte) (envelope.Envelope, error)
+}
+
+// New returns the serializer for encoding, defaulting to JSON. Avro needs a schema registry
+// and registers the envelope schema under subject.
+func New(encoding string, registry Registry, subject string) (Serializer, error) {
+	switch encoding {
+	case "", JSON:
+		return jsonSerializer{}, nil
+	case Protobuf:
+		return protobufSerializer{}, nil
+	case Avro:
+		return newAvroSerializer(registry, subject)
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Name() string {
+	return JSON
+}
+
+func (jsonSerializer) Encode(e envelope.Envelope) ([]byte, error) {
+	return envelope.Encode(e)
+}
+
+func (jsonSerializer) Decode(data []byte) (envelope.Envelope, error) {
+	return envelope.Decode(data)
+}
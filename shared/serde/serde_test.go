@@ -0,0 +1,256 @@
+package serde
+
+import (
+	"bytes"
+	"encoding/binary"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"reflect"
+	"shared/envelope"
+	"testing"
+	"time"
+)
+
+func testEnvelope() envelope.Envelope {
+	return envelope.Envelope{
+		SchemaVersion: envelope.SchemaVersion,
+		EventId:       "2f1c6c3e-8a3b-4d55-9b0e-6f4e2b7d9c10",
+		// Avro keeps microseconds, so the test time has no nanoseconds
+		EventTime:  time.Date(2023, 1, 5, 10, 30, 15, 123456000, time.UTC),
+		Source:     "producer-1",
+		Message:    envelope.Message{Id: "42", Value: -17.25},
+		Attributes: map[string]string{"region": "eu", "tenant": "a"},
+	}
+}
+
+func newSerializers(t testing.TB) []Serializer {
+	var serializers []Serializer
+	for _, encoding := range []string{JSON, Protobuf, Avro} {
+		s, err := New(encoding, NewMemoryRegistry(), "user_details_1-value")
+		if err != nil {
+			t.Fatalf("New(%q): %v", encoding, err)
+		}
+		serializers = append(serializers, s)
+	}
+	return serializers
+}
+
+func TestRoundTrip(t *testing.T) {
+	minimal := envelope.Envelope{SchemaVersion: envelope.SchemaVersion, Message: envelope.Message{Id: "1"}}
+	for _, s := range newSerializers(t) {
+		for _, want := range []envelope.Envelope{testEnvelope(), minimal} {
+			data, err := s.Encode(want)
+			if err != nil {
+				t.Fatalf("%s: Encode: %v", s.Name(), err)
+			}
+			got, err := s.Decode(data)
+			if err != nil {
+				t.Fatalf("%s: Decode: %v", s.Name(), err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: round trip = %+v, want %+v", s.Name(), got, want)
+			}
+		}
+	}
+}
+
+func TestRejectsNewerSchemaVersion(t *testing.T) {
+	e := testEnvelope()
+	e.SchemaVersion = envelope.SchemaVersion + 1
+	for _, s := range newSerializers(t) {
+		data, err := s.Encode(e)
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", s.Name(), err)
+		}
+		if _, err := s.Decode(data); err == nil {
+			t.Errorf("%s: Decode accepted schema version %d", s.Name(), e.SchemaVersion)
+		}
+	}
+}
+
+func TestAvroConfluentHeader(t *testing.T) {
+	registry := NewMemoryRegistry()
+	// Take id 1 so that the envelope schema gets another one
+	if _, err := registry.Register("other", `{"type": "string"}`); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Avro, registry, "user_details_1-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Encode(testEnvelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != avroMagic {
+		t.Errorf("magic byte = %d, want %d", data[0], avroMagic)
+	}
+	if id := binary.BigEndian.Uint32(data[1:avroHeaderSize]); id != 2 {
+		t.Errorf("schema id = %d, want 2", id)
+	}
+
+	// A reader with its own serializer resolves the writer schema through the registry
+	reader, err := New(Avro, registry, "user_details_1-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Decode(data); err != nil {
+		t.Errorf("Decode with a second serializer: %v", err)
+	}
+
+	if _, err := s.Decode(data[avroHeaderSize:]); err == nil {
+		t.Error("Decode accepted a message without header")
+	}
+	unknown := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(unknown[1:avroHeaderSize], 1)
+	if _, err := s.Decode(unknown); err == nil {
+		t.Error("Decode accepted a writer schema that isn't the envelope schema")
+	}
+	if _, err := s.Decode(data[:len(data)-3]); err == nil {
+		t.Error("Decode accepted a truncated message")
+	}
+}
+
+func TestAvroZigZag(t *testing.T) {
+	tests := []struct {
+		value int64
+		want  []byte
+	}{
+		{0, []byte{0x00}},
+		{-1, []byte{0x01}},
+		{1, []byte{0x02}},
+		{-2, []byte{0x03}},
+		{63, []byte{0x7e}},
+		{-64, []byte{0x7f}},
+		{64, []byte{0x80, 0x01}},
+		{-65, []byte{0x81, 0x01}},
+	}
+	for _, tt := range tests {
+		if got := appendAvroLong(nil, tt.value); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendAvroLong(%d) = %x, want %x", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []int64{0, 1, -1, 1 << 40, -(1 << 40), math.MaxInt64, math.MinInt64} {
+		r := avroReader{data: appendAvroLong(nil, value)}
+		if got := r.long(); got != value || r.err != nil || len(r.data) != 0 {
+			t.Errorf("long() of %d = %d, err %v, %d bytes left", value, got, r.err, len(r.data))
+		}
+	}
+}
+
+func TestAvroTimestampMicros(t *testing.T) {
+	s, err := New(Avro, NewMemoryRegistry(), "user_details_1-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testEnvelope()
+	e.EventTime = time.Date(2023, 1, 5, 10, 30, 15, 123456789, time.UTC)
+	data, err := s.Encode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// event_time follows schema_version and event_id
+	r := avroReader{data: data[avroHeaderSize:]}
+	r.long()
+	r.string()
+	if micros := r.long(); micros != e.EventTime.UnixMicro() {
+		t.Errorf("event_time = %d, want %d micros", micros, e.EventTime.UnixMicro())
+	}
+
+	got, err := s.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := e.EventTime.Truncate(time.Microsecond); !got.EventTime.Equal(want) {
+		t.Errorf("EventTime = %v, want %v", got.EventTime, want)
+	}
+
+	e.EventTime = time.Time{}
+	if data, err = s.Encode(e); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = s.Decode(data); err != nil || !got.EventTime.IsZero() {
+		t.Errorf("zero EventTime came back as %v, err %v", got.EventTime, err)
+	}
+}
+
+func TestProtobufFieldNumbers(t *testing.T) {
+	data, err := protobufSerializer{}.Encode(testEnvelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[protowire.Number]protowire.Type{
+		1: protowire.VarintType,
+		2: protowire.BytesType,
+		3: protowire.VarintType,
+		4: protowire.BytesType,
+		5: protowire.BytesType,
+		6: protowire.Fixed64Type,
+		7: protowire.BytesType,
+	}
+	got := make(map[protowire.Number]protowire.Type)
+	for b := data; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		got[num] = typ
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fields = %v, want %v", got, want)
+	}
+}
+
+func TestProtobufSkipsUnknownFields(t *testing.T) {
+	data, err := protobufSerializer{}.Encode(testEnvelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = protowire.AppendTag(data, 99, protowire.BytesType)
+	data = protowire.AppendString(data, "added by a newer writer")
+	got, err := protobufSerializer{}.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testEnvelope(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode = %+v, want %+v", got, want)
+	}
+}
+
+// BenchmarkSerializers compares the encodings, the B/msg metric is the encoded size.
+func BenchmarkSerializers(b *testing.B) {
+	e := testEnvelope()
+	for _, s := range newSerializers(b) {
+		data, err := s.Encode(e)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(s.Name()+"/encode", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Encode(e); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "B/msg")
+		})
+		b.Run(s.Name()+"/decode", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "B/msg")
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Package tracing sets up OpenTelemetry tracing for the services and propagates W3C trace
+// context through kafka message headers and http requests.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"shared/envelope"
+)
+
+// Exporters
+const (
+	// OTLP exports over OTLP/HTTP to Endpoint, or to OTEL_EXPORTER_OTLP_ENDPOINT when empty
+	OTLP = "otlp"
+	// Stdout prints spans as JSON to stdout, for local runs
+	Stdout = "stdout"
+	// File appends spans as JSON to File
+	File = "file"
+
+	// ExemplarLabel carries the trace id on histogram exemplars
+	ExemplarLabel = "trace_id"
+)
+
+// Config selects the span exporter. Disabled tracing still propagates incoming trace context, it
+// just doesn't record spans. SampleRatio applies to new traces, 0 samples every trace.
+type Config struct {
+	Enabled     bool    `json:"enabled"`
+	Exporter    string  `json:"exporter"`
+	Endpoint    string  `json:"endpoint"`
+	Insecure    bool    `json:"insecure"`
+	File        string  `json:"file"`
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Init installs the global tracer provider and W3C propagator for service. The returned function
+// flushes pending spans and must be called before exiting.
+func Init(ctx context.Context, service string, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	ratio := config.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, config Config) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case OTLP, "":
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, options...)
+	case Stdout:
+		return stdouttrace.New()
+	case File:
+		if config.File == "" {
+			return nil, fmt.Errorf("file exporter needs a file")
+		}
+		file, err := os.OpenFile(config.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", config.Exporter)
+	}
+}
+
+// Tracer returns the named tracer of the global provider.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// StartPublishSpan starts the span publishing msg and injects its context into the headers of
+// msg, so that the consumer continues the trace.
+func StartPublishSpan(ctx context.Context, tracer trace.Tracer, msg *sarama.ProducerMessage, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	attributes = append(attributes,
+		semconv.MessagingSystem("kafka"),
+		semconv.MessagingOperationPublish,
+		semconv.MessagingDestinationName(msg.Topic))
+	ctx, span := tracer.Start(ctx, msg.Topic+" publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attributes...))
+	otel.GetTextMapPropagator().Inject(ctx, producerMessageCarrier{msg})
+	return ctx, span
+}
+
+// StartProcessSpan starts the span processing msg, as a child of the span that published it.
+func StartProcessSpan(ctx context.Context, tracer trace.Tracer, msg *sarama.ConsumerMessage, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	attributes = append(attributes,
+		semconv.MessagingSystem("kafka"),
+		semconv.MessagingOperationProcess,
+		semconv.MessagingSourceName(msg.Topic),
+		semconv.MessagingKafkaSourcePartition(int(msg.Partition)),
+		semconv.MessagingKafkaMessageOffset(int(msg.Offset)))
+	ctx = otel.GetTextMapPropagator().Extract(ctx, consumerMessageCarrier{msg})
+	return tracer.Start(ctx, msg.Topic+" process", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attributes...))
+}
+
+// EnvelopeAttributes describes the message of e on a span.
+func EnvelopeAttributes(e envelope.Envelope) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{attribute.String("message.id", e.Id)}
+	if e.EventId != "" {
+		attributes = append(attributes, semconv.MessagingMessageID(e.EventId))
+	}
+	return attributes
+}
+
+// Published returns the trace context injected into msg, to observe its delivery with.
+func Published(msg *sarama.ProducerMessage) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), producerMessageCarrier{msg})
+}
+
+// StartClientSpan starts the span of the outgoing request req and injects its context into the
+// headers of req, so that the server continues the trace.
+func StartClientSpan(ctx context.Context, tracer trace.Tracer, req *http.Request) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, req.Method+" "+req.URL.Path, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(httpconv.ClientRequest(req)...))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return ctx, span
+}
+
+// EndClientSpan records the response, or the error, of the request of span and ends it.
+func EndClientSpan(span trace.Span, res *http.Response, err error) {
+	if err != nil {
+		RecordError(span, err)
+	} else {
+		span.SetAttributes(httpconv.ClientResponse(res)...)
+		span.SetStatus(httpconv.ClientStatus(res.StatusCode))
+	}
+	span.End()
+}
+
+// StartServerSpan starts the span of the incoming request r, continuing the trace of the caller.
+func StartServerSpan(tracer trace.Tracer, r *http.Request) (context.Context, trace.Span) {
+	return tracer.Start(ExtractHTTP(r), r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(httpconv.ServerRequest("", r)...))
+}
+
+// ExtractHTTP returns the context of r with the trace context found in its headers.
+func ExtractHTTP(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// RecordError marks span as failed with err, a nil err leaves span untouched.
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Observe records value on observer with the trace id of ctx as exemplar, if its span is sampled.
+// Exemplars are only exposed in the OpenMetrics format.
+func Observe(ctx context.Context, observer prometheus.Observer, value float64) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && spanContext.IsSampled() {
+		exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{ExemplarLabel: spanContext.TraceID().String()})
+		return
+	}
+	observer.Observe(value)
+}
+
+// producerMessageCarrier sets trace context headers, replacing those of a copied message.
+type producerMessageCarrier struct {
+	msg *sarama.ProducerMessage
+}
+
+func (c producerMessageCarrier) Get(key string) string {
+	for _, header := range c.msg.Headers {
+		if string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (c producerMessageCarrier) Set(key string, value string) {
+	for i, header := range c.msg.Headers {
+		if string(header.Key) == key {
+			c.msg.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	c.msg.Headers = append(c.msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+func (c producerMessageCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.msg.Headers))
+	for _, header := range c.msg.Headers {
+		keys = append(keys, string(header.Key))
+	}
+	return keys
+}
+
+// consumerMessageCarrier only reads, consumed messages aren't modified.
+type consumerMessageCarrier struct {
+	msg *sarama.ConsumerMessage
+}
+
+func (c consumerMessageCarrier) Get(key string) string {
+	for _, header := range c.msg.Headers {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (c consumerMessageCarrier) Set(string, string) {}
+
+func (c consumerMessageCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.msg.Headers))
+	for _, header := range c.msg.Headers {
+		if header != nil {
+			keys = append(keys, string(header.Key))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"reflect"
+	"testing"
+)
+
+const traceparent = "traceparent"
+
+// newTestTracer installs the propagators and returns a tracer recording its spans.
+func newTestTracer(t *testing.T) (trace.Tracer, *tracetest.SpanRecorder) {
+	t.Helper()
+	if _, err := Init(context.Background(), "test", Config{}); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return provider.Tracer("test"), recorder
+}
+
+func TestProducerCarrierReplacesHeaders(t *testing.T) {
+	msg := &sarama.ProducerMessage{Headers: []sarama.RecordHeader{
+		{Key: []byte("x-encoding"), Value: []byte("json")},
+		{Key: []byte(traceparent), Value: []byte("old")},
+	}}
+	carrier := producerMessageCarrier{msg}
+	carrier.Set(traceparent, "new")
+	carrier.Set("tracestate", "a=b")
+
+	if got := carrier.Get(traceparent); got != "new" {
+		t.Errorf("traceparent = %q, want new", got)
+	}
+	if want := []string{"x-encoding", traceparent, "tracestate"}; !reflect.DeepEqual(carrier.Keys(), want) {
+		t.Errorf("keys = %v, want %v, replaced headers aren't added twice", carrier.Keys(), want)
+	}
+}
+
+func TestConsumerCarrierSkipsNilHeaders(t *testing.T) {
+	msg := &sarama.ConsumerMessage{Headers: []*sarama.RecordHeader{nil, {Key: []byte(traceparent), Value: []byte("value")}}}
+	carrier := consumerMessageCarrier{msg}
+	if got := carrier.Get(traceparent); got != "value" {
+		t.Errorf("traceparent = %q, want value", got)
+	}
+	carrier.Set(traceparent, "other")
+	if got := carrier.Get(traceparent); got != "value" {
+		t.Error("the consumer carrier modified a consumed message")
+	}
+	if want := []string{traceparent}; !reflect.DeepEqual(carrier.Keys(), want) {
+		t.Errorf("keys = %v, want %v", carrier.Keys(), want)
+	}
+}
+
+func TestTraceContinuesThroughKafkaHeaders(t *testing.T) {
+	tracer, recorder := newTestTracer(t)
+
+	msg := &sarama.ProducerMessage{Topic: "topic"}
+	_, publishSpan := StartPublishSpan(context.Background(), tracer, msg)
+	publishSpan.End()
+	if (producerMessageCarrier{msg}).Get(traceparent) == "" {
+		t.Fatal("the publish span wasn't injected into the message headers")
+	}
+
+	consumed := &sarama.ConsumerMessage{Topic: "topic"}
+	for i := range msg.Headers {
+		consumed.Headers = append(consumed.Headers, &msg.Headers[i])
+	}
+	_, processSpan := StartProcessSpan(context.Background(), tracer, consumed)
+	processSpan.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	publish, process := spans[0], spans[1]
+	if process.Parent().SpanID() != publish.SpanContext().SpanID() || process.SpanContext().TraceID() != publish.SpanContext().TraceID() {
+		t.Error("the process span doesn't continue the trace of the publish span")
+	}
+	if publish.SpanKind() != trace.SpanKindProducer || process.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("span kinds %v and %v, want producer and consumer", publish.SpanKind(), process.SpanKind())
+	}
+}
+
+func TestObserveAddsExemplarOfSampledSpans(t *testing.T) {
+	tracer, _ := newTestTracer(t)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Buckets: []float64{1}})
+
+	ctx, span := tracer.Start(context.Background(), "span")
+	Observe(ctx, histogram, 0.5)
+	span.End()
+	Observe(context.Background(), histogram, 0.5)
+
+	var metric dto.Metric
+	if err := histogram.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	bucket := metric.GetHistogram().GetBucket()[0]
+	if bucket.GetCumulativeCount() != 2 {
+		t.Errorf("bucket count = %d, want both observations", bucket.GetCumulativeCount())
+	}
+	exemplar := bucket.GetExemplar()
+	if exemplar == nil || exemplar.GetLabel()[0].GetValue() != span.SpanContext().TraceID().String() {
+		t.Errorf("exemplar = %v, want the trace id of the span", exemplar)
+	}
+}